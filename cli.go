@@ -169,7 +169,7 @@ func getCommandLineOptions() []cli.Flag {
 // parseCLIOptions parses the command line options and constructs a config object
 func parseCLIOptions(cx *cli.Context, config *Config) (err error) {
 	// step: we can ignore these options in the Config struct
-	ignoredOptions := []string{"tag-data", "match-claims", "resources", "headers"}
+	ignoredOptions := []string{"tag-data", "match-claims", "resources", "headers", "trusted-issuers"}
 	// step: iterate the Config and grab command line options via reflection
 	count := reflect.TypeOf(config).Elem().NumField()
 
@@ -226,6 +226,14 @@ func parseCLIOptions(cx *cli.Context, config *Config) (err error) {
 		mergeMaps(config.Headers, headers)
 	}
 
+	if cx.IsSet("uma-method-scopes") {
+		scopes, err := decodeKeyPairs(cx.StringSlice("uma-method-scopes"))
+		if err != nil {
+			return err
+		}
+		mergeMaps(config.UmaMethodScopes, scopes)
+	}
+
 	if cx.IsSet("resources") {
 		for _, x := range cx.StringSlice("resources") {
 			resource, err := newResource().parse(x)
@@ -236,5 +244,15 @@ func parseCLIOptions(cx *cli.Context, config *Config) (err error) {
 		}
 	}
 
+	if cx.IsSet("trusted-issuers") {
+		for _, x := range cx.StringSlice("trusted-issuers") {
+			issuer, err := newTrustedIssuer().parse(x)
+			if err != nil {
+				return fmt.Errorf("invalid trusted issuer %s, %s", x, err)
+			}
+			config.TrustedIssuers = append(config.TrustedIssuers, issuer)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,186 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// the fields of the client certificates the identity can be taken from
+const (
+	certFieldCommonName = "cn"
+	certFieldSubject    = "subject"
+	certFieldSerial     = "serial"
+	certFieldDNS        = "dns"
+	certFieldURI        = "uri"
+	certFieldEmail      = "email"
+)
+
+// clientCertMapping maps the verified client certificates of the callers to their identity
+type clientCertMapping struct {
+	// ID is the field of the certificate the id of the callers is taken from, the common name by default
+	ID string `json:"id" yaml:"id"`
+	// Name is the field of the certificate the name of the callers is taken from, the common name by default
+	Name string `json:"name" yaml:"name"`
+	// Roles are the roles of the callers, by the common name or any subject alternative name of their
+	// certificate, typed as cn:, dns:, uri: or email: so a name of one kind can not pass for another
+	Roles map[string][]string `json:"roles" yaml:"roles"`
+}
+
+// newClientCertMapping reads the mapping file, the certificates having no roles without one
+func newClientCertMapping(filename string) (*clientCertMapping, error) {
+	mapping := &clientCertMapping{}
+
+	if filename != "" {
+		content, err := ioutil.ReadFile(filename)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// @note: yaml being a superset of json, both are read
+		if err := yaml.Unmarshal(content, mapping); err != nil {
+			return nil, fmt.Errorf("the client certificate mapping %s is invalid, %s", filename, err)
+		}
+	}
+
+	mapping.ID = defaultTo(mapping.ID, certFieldCommonName)
+	mapping.Name = defaultTo(mapping.Name, certFieldCommonName)
+
+	for _, field := range []string{mapping.ID, mapping.Name} {
+		switch field {
+		case certFieldCommonName, certFieldSubject, certFieldSerial, certFieldDNS, certFieldURI, certFieldEmail:
+		default:
+			return nil, fmt.Errorf(
+				"the client certificate field %s is invalid, should be cn, subject, serial, dns, uri or email",
+				field,
+			)
+		}
+	}
+
+	for name := range mapping.Roles {
+		switch strings.SplitN(name, ":", 2)[0] {
+		case certFieldCommonName, certFieldDNS, certFieldURI, certFieldEmail:
+		default:
+			return nil, fmt.Errorf(
+				"the client certificate name %s is invalid, should be prefixed by cn:, dns:, uri: or email:",
+				name,
+			)
+		}
+	}
+
+	return mapping, nil
+}
+
+// identity returns the identity of the caller of the certificate
+func (m *clientCertMapping) identity(cert *x509.Certificate) *userContext {
+	roles := make([]string, 0)
+
+	for _, name := range getCertificateNames(cert) {
+		for _, role := range m.Roles[name] {
+			if !containedIn(role, roles) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	id := getCertificateField(cert, m.ID)
+	name := getCertificateField(cert, m.Name)
+	email := getCertificateField(cert, certFieldEmail)
+
+	return &userContext{
+		id:            id,
+		email:         email,
+		expiresAt:     cert.NotAfter,
+		name:          name,
+		preferredName: name,
+		roles:         roles,
+		claims: map[string]interface{}{
+			"sub":     id,
+			"name":    name,
+			"email":   email,
+			"cn":      cert.Subject.CommonName,
+			"subject": cert.Subject.String(),
+		},
+	}
+}
+
+// getCertificateField returns the field of the certificate, the first of the subject alternative
+// names of the kind
+func getCertificateField(cert *x509.Certificate, field string) string {
+	switch field {
+	case certFieldCommonName:
+		return cert.Subject.CommonName
+	case certFieldSubject:
+		return cert.Subject.String()
+	case certFieldSerial:
+		return cert.SerialNumber.String()
+	case certFieldDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case certFieldURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case certFieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	}
+
+	return ""
+}
+
+// getCertificateNames returns the common name and the subject alternative names of the certificate,
+// prefixed by their kind, i.e. cn:billing or dns:billing.svc.cluster.local
+func getCertificateNames(cert *x509.Certificate) []string {
+	var names []string
+
+	if cert.Subject.CommonName != "" {
+		names = append(names, certFieldCommonName+":"+cert.Subject.CommonName)
+	}
+
+	for _, name := range cert.DNSNames {
+		names = append(names, certFieldDNS+":"+name)
+	}
+
+	for _, uri := range cert.URIs {
+		names = append(names, certFieldURI+":"+uri.String())
+	}
+
+	for _, email := range cert.EmailAddresses {
+		names = append(names, certFieldEmail+":"+email)
+	}
+
+	return names
+}
+
+// getClientCertIdentity returns the identity of the verified client certificate of the request, if any
+func (r *oauthProxy) getClientCertIdentity(req *http.Request) *userContext {
+	if r.certMapping == nil || req.TLS == nil || len(req.TLS.VerifiedChains) == 0 ||
+		len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return r.certMapping.identity(req.TLS.VerifiedChains[0][0])
+}
@@ -14,6 +14,8 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -73,6 +75,8 @@ type DefaultTestTokenClaims struct {
 	SessionState      string                    `json:"session_state"`
 	Sub               string                    `json:"sub"`
 	Typ               string                    `json:"typ"`
+	Scope             string                    `json:"scope,omitempty"`
+	Nonce             string                    `json:"nonce,omitempty"`
 	Groups            []string                  `json:"groups"`
 	RealmAccess       RoleClaim                 `json:"realm_access"`
 	ResourceAccess    map[string]RoleClaim      `json:"resource_access"`
@@ -630,7 +634,9 @@ func (f *fakeProxy) performUserLogin(uri string) error {
 		return err
 	}
 	for _, cookie := range resp.Cookies() {
-		if cookie.Name == f.config.CookieAccessName || cookie.Name == f.config.CookieRefreshName {
+		if cookie.Name == f.config.CookieAccessName ||
+			cookie.Name == f.config.CookieRefreshName ||
+			cookie.Name == f.config.CookieSessionName {
 			f.cookies[cookie.Name] = &http.Cookie{
 				Name:   cookie.Name,
 				Path:   "/",
@@ -726,6 +732,7 @@ func newFakeKeycloakConfig() *Config {
 		ClientSecret:                fakeSecret,
 		CookieAccessName:            "kc-access",
 		CookieRefreshName:           "kc-state",
+		CookieSessionName:           "kc-session",
 		DisableAllLogging:           true,
 		DiscoveryURL:                "127.0.0.1:0",
 		EnableAuthorizationCookies:  true,
@@ -800,6 +807,11 @@ func makeTestCodeFlowLogin(location string) (*http.Response, []*http.Cookie, err
 			flowCookies = append(flowCookies, cookies...)
 		}
 
+		// @note: the cookies of the flow, i.e. the state and pkce ones, are sent back like a browser does
+		for _, cookie := range flowCookies {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+
 		// step: make the request
 		tr := &http.Transport{
 			TLSClientConfig: &tls.Config{
@@ -985,6 +997,13 @@ type fakeAuthServer struct {
 	server                    *httptest.Server
 	expiration                time.Duration
 	resourceSetHandlerFailure bool
+	resourceSetRequests       int32
+	enablePKCE                bool
+	codeChallenges            sync.Map
+	invalidNonce              bool
+	nonces                    sync.Map
+	introspections            int32
+	revokedTokens             sync.Map
 }
 
 const fakePrivateKey = `
@@ -1072,14 +1091,20 @@ type fakeOidcDiscoveryResponse struct {
 	TokenURL    string   `json:"token_endpoint"`
 	JWKSURL     string   `json:"jwks_uri"`
 	UserInfoURL string   `json:"userinfo_endpoint"`
+	Introspect  string   `json:"introspection_endpoint"`
 	Algorithms  []string `json:"id_token_signing_alg_values_supported"`
 }
 
+// fakeOpaqueToken is the opaque token the fake oauth service introspects as active
+const fakeOpaqueToken = "aGVsbG8gb3BhcXVlIHRva2Vu"
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 type fakeAuthConfig struct {
 	EnableTLS                 bool
 	EnableProxy               bool
+	EnablePKCE                bool
+	InvalidNonce              bool
 	Expiration                time.Duration
 	ResourceSetHandlerFailure bool
 }
@@ -1119,6 +1144,7 @@ func newFakeAuthServer(config *fakeAuthConfig) *fakeAuthServer {
 	router.Post("/auth/realms/hod-test/protocol/openid-connect/logout", service.logoutHandler)
 	router.Post("/auth/realms/hod-test/protocol/openid-connect/revoke", service.revocationHandler)
 	router.Post("/auth/realms/hod-test/protocol/openid-connect/token", service.tokenHandler)
+	router.Post("/auth/realms/hod-test/protocol/openid-connect/token/introspect", service.introspectionHandler)
 	router.Get("/auth/realms/hod-test/authz/protection/resource_set", service.ResourcesHandler)
 	router.Get("/auth/realms/hod-test/authz/protection/resource_set/{id}", service.ResourceHandler)
 	router.Post("/auth/realms/hod-test/authz/protection/permission", service.PermissionTicketHandler)
@@ -1141,6 +1167,8 @@ func newFakeAuthServer(config *fakeAuthConfig) *fakeAuthServer {
 	}
 	service.location = location
 	service.resourceSetHandlerFailure = config.ResourceSetHandlerFailure
+	service.enablePKCE = config.EnablePKCE
+	service.invalidNonce = config.InvalidNonce
 
 	service.expiration = time.Duration(1) * time.Hour
 
@@ -1179,6 +1207,7 @@ func (r *fakeAuthServer) discoveryHandler(w http.ResponseWriter, req *http.Reque
 		TokenURL:    fmt.Sprintf("%s://%s/auth/realms/hod-test/protocol/openid-connect/token", r.location.Scheme, r.location.Host),
 		JWKSURL:     fmt.Sprintf("%s://%s/auth/realms/hod-test/protocol/openid-connect/certs", r.location.Scheme, r.location.Host),
 		UserInfoURL: fmt.Sprintf("%s://%s/auth/realms/hod-test/protocol/openid-connect/userinfo", r.location.Scheme, r.location.Host),
+		Introspect:  fmt.Sprintf("%s://%s/auth/realms/hod-test/protocol/openid-connect/token/introspect", r.location.Scheme, r.location.Host),
 		Algorithms:  []string{"RS256"},
 	})
 }
@@ -1205,6 +1234,21 @@ func (r *fakeAuthServer) authHandler(wrt http.ResponseWriter, req *http.Request)
 		return
 	}
 
+	if r.enablePKCE {
+		challenge := req.URL.Query().Get("code_challenge")
+
+		if challenge == "" || req.URL.Query().Get("code_challenge_method") != "S256" {
+			wrt.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.codeChallenges.Store(randString, challenge)
+	}
+
+	if nonce := req.URL.Query().Get("nonce"); nonce != "" {
+		r.nonces.Store(randString, nonce)
+	}
+
 	redirectionURL := fmt.Sprintf("%s?state=%s&code=%s", redirect, state, randString)
 
 	http.Redirect(wrt, req, redirectionURL, http.StatusSeeOther)
@@ -1218,14 +1262,61 @@ func (r *fakeAuthServer) revocationHandler(wrt http.ResponseWriter, req *http.Re
 	// according RFC revocation endpoint can be access/refresh token, keycloak
 	// implementation https://github.com/keycloak/keycloak/pull/6704, accepts
 	// refresh/offline tokens
-	if token := req.FormValue("token"); token == "" {
+	token := req.FormValue("token")
+
+	if token == "" {
 		wrt.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	r.revokedTokens.Store(token, true)
+
 	wrt.WriteHeader(http.StatusOK)
 }
 
+// introspectionHandler introspects the tokens it issued and fakeOpaqueToken, the revoked ones being inactive
+func (r *fakeAuthServer) introspectionHandler(wrt http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.introspections, 1)
+
+	if _, _, found := req.BasicAuth(); !found {
+		wrt.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	token := req.FormValue("token")
+	inactive := map[string]interface{}{"active": false}
+
+	if _, revoked := r.revokedTokens.Load(token); revoked {
+		renderJSON(http.StatusOK, wrt, req, inactive)
+		return
+	}
+
+	claims := make(map[string]interface{})
+
+	if token == fakeOpaqueToken {
+		opaque := newTestToken(r.getLocation())
+		opaque.setExpiration(time.Now().Add(r.expiration))
+		content, _ := json.Marshal(opaque.claims)
+		_ = json.Unmarshal(content, &claims)
+	} else {
+		signed, err := jwt.ParseSigned(token)
+
+		if err != nil || signed.UnsafeClaimsWithoutVerification(&claims) != nil {
+			renderJSON(http.StatusOK, wrt, req, inactive)
+			return
+		}
+	}
+
+	if exp, _ := claims["exp"].(float64); int64(exp) <= time.Now().Unix() {
+		renderJSON(http.StatusOK, wrt, req, inactive)
+		return
+	}
+
+	claims["active"] = true
+	claims["client_id"] = claims["azp"]
+	renderJSON(http.StatusOK, wrt, req, claims)
+}
+
 func (r *fakeAuthServer) userInfoHandler(wrt http.ResponseWriter, req *http.Request) {
 	items := strings.Split(req.Header.Get("Authorization"), " ")
 	if len(items) != 2 {
@@ -1278,6 +1369,16 @@ func (r *fakeAuthServer) tokenHandler(w http.ResponseWriter, req *http.Request)
 		}
 	}
 
+	if req.FormValue("grant_type") == GrantTypeAuthCode {
+		if nonce, found := r.nonces.LoadAndDelete(req.FormValue("code")); found {
+			token.claims.Nonce = nonce.(string)
+		}
+
+		if r.invalidNonce {
+			token.claims.Nonce = "invalid"
+		}
+	}
+
 	// sign the token with the private key
 	jwtAccess, err := token.getToken()
 	if err != nil {
@@ -1390,6 +1491,18 @@ func (r *fakeAuthServer) tokenHandler(w http.ResponseWriter, req *http.Request)
 			ExpiresIn:   float64(expires.Second()),
 		})
 	case GrantTypeAuthCode:
+		if r.enablePKCE {
+			challenge, found := r.codeChallenges.LoadAndDelete(req.FormValue("code"))
+
+			if !found || getCodeChallenge(req.FormValue("code_verifier")) != challenge {
+				renderJSON(http.StatusBadRequest, w, req, map[string]string{
+					"error":             "invalid_grant",
+					"error_description": "invalid pkce code verifier",
+				})
+				return
+			}
+		}
+
 		renderJSON(http.StatusOK, w, req, tokenResponse{
 			IDToken:      jwtAccess,
 			AccessToken:  jwtAccess,
@@ -1409,6 +1522,7 @@ func (r *fakeAuthServer) tokenHandler(w http.ResponseWriter, req *http.Request)
 }
 
 func (r *fakeAuthServer) ResourcesHandler(w http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&r.resourceSetRequests, 1)
 	response := []string{"6ef1b62e-0fd4-47f2-81fc-eead97a01c22"}
 	renderJSON(http.StatusOK, w, req, response)
 }
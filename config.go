@@ -39,11 +39,14 @@ func newDefaultConfig() *Config {
 		AccessTokenDuration:           time.Duration(720) * time.Hour,
 		CookieAccessName:              accessCookie,
 		CookieRefreshName:             refreshCookie,
+		CookieSessionName:             sessionCookie,
 		CookieOAuthStateName:          requestStateCookie,
 		CookieRequestURIName:          requestURICookie,
+		CookiePKCEName:                requestPKCECookie,
 		EnableAuthorizationCookies:    true,
 		EnableAuthorizationHeader:     true,
 		EnableDefaultDeny:             true,
+		EnableNonce:                   true,
 		EnableSessionCookies:          true,
 		EnableTokenHeader:             true,
 		HTTPOnlyCookie:                true,
@@ -67,6 +70,7 @@ func newDefaultConfig() *Config {
 		ServerWriteTimeout:            10 * time.Second,
 		SkipOpenIDProviderTLSVerify:   false,
 		SkipUpstreamTLSVerify:         true,
+		StoreTimeout:                  2 * time.Second,
 		Tags:                          make(map[string]string),
 		TLSMinVersion:                 "tlsv1.3",
 		UpstreamExpectContinueTimeout: 10 * time.Second,
@@ -79,6 +83,11 @@ func newDefaultConfig() *Config {
 		ForwardingGrantType:           GrantTypeUserCreds,
 		PatRetryCount:                 5,
 		PatRetryInterval:              10 * time.Second,
+		AuthzCacheSize:                10000,
+		AuthzCacheTTL:                 10 * time.Second,
+		UmaMethodScopes:               make(map[string]string),
+		UmaResourceCacheInterval:      5 * time.Minute,
+		HTTPAuthzTimeout:              5 * time.Second,
 	}
 }
 
@@ -310,6 +319,8 @@ func (r *Config) isForwardingProxySettingsValid() error {
 			r.isClientIDValid,
 			r.isDiscoveryURLValid,
 			r.isForwardingGrantValid,
+			r.isUmaMethodScopesValid,
+			r.isUmaResourceCacheValid,
 			func() error {
 				if r.TLSCertificate != "" {
 					return errors.New("you don't need to specify a " +
@@ -344,9 +355,15 @@ func (r *Config) isReverseProxySettingsValid() error {
 			r.isUpstreamValid,
 			r.isDefaultDenyValid,
 			r.isEnableUmaValid,
+			r.isUmaMethodScopesValid,
+			r.isUmaResourceCacheValid,
+			r.isHTTPAuthzValid,
 			r.isTokenVerificationSettingsValid,
 			r.isResourceValid,
+			r.isVirtualHostsValid,
 			r.isMatchClaimValid,
+			r.isRewriteValid,
+			r.isClientCertIdentityValid,
 		}
 
 		for _, validationFunc := range validationRegistry {
@@ -375,6 +392,11 @@ func (r *Config) isTokenVerificationSettingsValid() error {
 			r.isTokenEncryptionValid,
 			r.isSecureCookieValid,
 			r.isStoreURLValid,
+			r.isServerSideSessionsValid,
+			r.isStoreEncryptionValid,
+			r.isAuthzCacheValid,
+			r.isTrustedIssuersValid,
+			r.isTokenIntrospectionValid,
 		}
 
 		for _, validationFunc := range validationRegistry {
@@ -490,7 +512,13 @@ func (r *Config) isTokenEncryptionValid() error {
 		)
 	}
 
-	if r.EnableRefreshTokens && (len(r.EncryptionKey) != 16 &&
+	if r.EnablePKCE && r.EncryptionKey == "" {
+		return errors.New(
+			"you have not specified an encryption key for encoding the pkce code verifier",
+		)
+	}
+
+	if (r.EnableRefreshTokens || r.EnablePKCE) && (len(r.EncryptionKey) != 16 &&
 		len(r.EncryptionKey) != 32) {
 		return fmt.Errorf(
 			"the encryption key (%d) must be either 16 or 32 "+
@@ -523,6 +551,54 @@ func (r *Config) isStoreURLValid() error {
 	return nil
 }
 
+func (r *Config) isServerSideSessionsValid() error {
+	if r.EnableServerSideSessions && r.StoreURL == "" {
+		return errors.New("enable-server-side-sessions requires a store-url")
+	}
+
+	return nil
+}
+
+func (r *Config) isStoreEncryptionValid() error {
+	if !r.EnableStoreEncryption {
+		return nil
+	}
+
+	if r.StoreURL == "" {
+		return errors.New("enable-store-encryption requires a store-url")
+	}
+
+	if len(r.EncryptionKey) != 16 && len(r.EncryptionKey) != 32 {
+		return fmt.Errorf(
+			"the encryption key (%d) must be either 16 or 32 "+
+				"characters for AES-128/AES-256 selection",
+			len(r.EncryptionKey),
+		)
+	}
+
+	return nil
+}
+
+func (r *Config) isAuthzCacheValid() error {
+	if r.AuthzCacheSize < 0 {
+		return errors.New("the authz-cache-size cannot be negative")
+	}
+
+	if r.AuthzCacheTTL < 0 {
+		return errors.New("the authz-cache-ttl cannot be negative")
+	}
+
+	if r.AuthzAllowTTL < 0 {
+		return errors.New("the authz-allow-ttl cannot be negative")
+	}
+
+	if r.AuthzDenyTTL < 0 {
+		return errors.New("the authz-deny-ttl cannot be negative")
+	}
+
+	return nil
+}
+
 func (r *Config) isResourceValid() error {
 	// step: add custom http methods for check
 	if r.CustomHTTPMethods != nil {
@@ -542,6 +618,94 @@ func (r *Config) isResourceValid() error {
 	return nil
 }
 
+// isVirtualHostsValid checks the upstream of the resources of a host can tell the hosts apart, as
+// the host is chosen by the client, a request on a shared upstream could pick the rules of any host
+func (r *Config) isVirtualHostsValid() error {
+	if r.PreserveHost {
+		return nil
+	}
+
+	for _, resource := range r.Resources {
+		if len(resource.Hosts) > 0 && (resource.Upstream == "" || resource.Upstream == r.Upstream) {
+			return fmt.Errorf(
+				"the resource %s of the hosts %s shares the upstream of the other hosts, "+
+					"set an upstream-url of its own or --preserve-host",
+				resource.URL,
+				strings.Join(resource.Hosts, ","),
+			)
+		}
+	}
+
+	return nil
+}
+
+func (r *Config) isTrustedIssuersValid() error {
+	discoveryURLs := make(map[string]bool)
+
+	for _, issuer := range r.TrustedIssuers {
+		if err := issuer.valid(); err != nil {
+			return err
+		}
+
+		if discoveryURLs[issuer.DiscoveryURL] || issuer.DiscoveryURL == r.DiscoveryURL {
+			return fmt.Errorf("the issuer %s is trusted more than once", issuer.DiscoveryURL)
+		}
+
+		discoveryURLs[issuer.DiscoveryURL] = true
+	}
+
+	return nil
+}
+
+func (r *Config) isTokenIntrospectionValid() error {
+	if r.useTokenIntrospection() && r.ClientSecret == "" {
+		return errors.New("the token introspection requires the client secret to authenticate to the provider")
+	}
+
+	return nil
+}
+
+// isAdminListenerAuthenticated checks the admin listener requires the client certificates
+func (r *Config) isAdminListenerAuthenticated() bool {
+	return r.ListenAdmin != "" && r.ListenAdminScheme == secureScheme &&
+		(r.TLSAdminClientCertificate != "" || r.TLSClientCertificate != "")
+}
+
+// useTokenIntrospection checks whether any of the tokens are introspected
+func (r *Config) useTokenIntrospection() bool {
+	if r.EnableTokenIntrospection {
+		return true
+	}
+
+	for _, resource := range r.Resources {
+		if resource.Introspect {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Config) isClientCertIdentityValid() error {
+	if !r.EnableClientCertIdentity {
+		if r.ClientCertMapping != "" {
+			return errors.New("the client-cert-mapping requires the enable-client-cert-identity")
+		}
+
+		return nil
+	}
+
+	if r.TLSClientCertificate == "" {
+		return errors.New("the client certificate identity requires the mutual tls, i.e. the tls-client-certificate")
+	}
+
+	if r.ClientCertMapping != "" && !fileExists(r.ClientCertMapping) {
+		return fmt.Errorf("the client certificate mapping %s does not exist", r.ClientCertMapping)
+	}
+
+	return nil
+}
+
 func (r *Config) isMatchClaimValid() error {
 	// step: validate the claims are validate regex's
 	for k, claim := range r.MatchClaims {
@@ -557,6 +721,66 @@ func (r *Config) isMatchClaimValid() error {
 	return nil
 }
 
+func (r *Config) isRewriteValid() error {
+	_, err := newPathRewrite(r.StripPrefix, r.AddPrefix, r.RewriteRules)
+
+	return err
+}
+
+func (r *Config) isUmaMethodScopesValid() error {
+	scopes, err := normalizeMethodScopes(r.UmaMethodScopes)
+	if err != nil {
+		return err
+	}
+
+	r.UmaMethodScopes = scopes
+
+	return nil
+}
+
+func (r *Config) isUmaResourceCacheValid() error {
+	if r.EnableUmaResourceCache {
+		if !r.EnableUma {
+			return errors.New(
+				"enable-uma-resource-cache requires enable-uma option",
+			)
+		}
+		if r.UmaResourceCacheInterval < 0 {
+			return errors.New(
+				"uma-resource-cache-interval must not be negative",
+			)
+		}
+	}
+	return nil
+}
+
+func (r *Config) isHTTPAuthzValid() error {
+	if r.EnableHTTPAuthz {
+		if r.EnableUma {
+			return errors.New(
+				"only one of enable-uma/enable-http-authz can be true",
+			)
+		}
+		if r.HTTPAuthzURL == "" {
+			return errors.New(
+				"enable-http-authz requires http-authz-url option",
+			)
+		}
+		if uri, err := url.ParseRequestURI(r.HTTPAuthzURL); err != nil || uri.Host == "" {
+			return fmt.Errorf(
+				"the http-authz-url: %s is not a valid url",
+				r.HTTPAuthzURL,
+			)
+		}
+		if r.HTTPAuthzTimeout <= 0 {
+			return errors.New(
+				"http-authz-timeout must be greater than zero",
+			)
+		}
+	}
+	return nil
+}
+
 func (r *Config) isEnableUmaValid() error {
 	if r.EnableUma {
 		if r.ClientID == "" || r.ClientSecret == "" {
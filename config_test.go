@@ -1552,6 +1552,30 @@ func TestIsTokenEncryptionValid(t *testing.T) {
 			},
 			Valid: false,
 		},
+		{
+			Name: "ValidTokenEncryptionEnablePKCE",
+			Config: &Config{
+				EnablePKCE:    true,
+				EncryptionKey: "sdkljfalisujeoir",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidTokenEncryptionEnablePKCEMissingEncryptionKey",
+			Config: &Config{
+				EnablePKCE:    true,
+				EncryptionKey: "",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidTokenEncryptionEnablePKCEInvalidEncryptionKey",
+			Config: &Config{
+				EnablePKCE:    true,
+				EncryptionKey: "ssdsds",
+			},
+			Valid: false,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -1656,6 +1680,191 @@ func TestIsStoreURLValid(t *testing.T) {
 	}
 }
 
+func TestIsServerSideSessionsValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name: "ValidServerSideSessions",
+			Config: &Config{
+				EnableServerSideSessions: true,
+				StoreURL:                 "memory://",
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidWithoutServerSideSessions",
+			Config: &Config{
+				EnableServerSideSessions: false,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidServerSideSessionsWithoutStore",
+			Config: &Config{
+				EnableServerSideSessions: true,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isServerSideSessionsValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsStoreEncryptionValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name: "ValidStoreEncryption",
+			Config: &Config{
+				EnableStoreEncryption: true,
+				EncryptionKey:         testEncryptionKey,
+				StoreURL:              "memory://",
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidWithoutStoreEncryption",
+			Config: &Config{
+				StoreURL: "memory://",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidStoreEncryptionWithoutStore",
+			Config: &Config{
+				EnableStoreEncryption: true,
+				EncryptionKey:         testEncryptionKey,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidStoreEncryptionKey",
+			Config: &Config{
+				EnableStoreEncryption: true,
+				EncryptionKey:         "short",
+				StoreURL:              "memory://",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isStoreEncryptionValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsVirtualHostsValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name: "ValidWithoutHosts",
+			Config: &Config{
+				Upstream:  "http://app:8080",
+				Resources: []*Resource{{URL: "/admin/*", Roles: []string{fakeAdminRole}}},
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidHostsWithPreserveHost",
+			Config: &Config{
+				Upstream:     "http://app:8080",
+				PreserveHost: true,
+				Resources: []*Resource{
+					{URL: "/admin/*", Hosts: []string{"admin.example.com"}, Roles: []string{fakeAdminRole}},
+					{URL: "/admin/*", Hosts: []string{"docs.example.com"}, WhiteListed: true},
+				},
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidHostsWithUpstreams",
+			Config: &Config{
+				Upstream: "http://app:8080",
+				Resources: []*Resource{
+					{URL: "/admin/*", Hosts: []string{"admin.example.com"}, Upstream: "http://admin:8080"},
+					{URL: "/admin/*", Hosts: []string{"docs.example.com"}, Upstream: "http://docs:8080"},
+				},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InValidHostsSharingTheUpstream",
+			Config: &Config{
+				Upstream: "http://app:8080",
+				Resources: []*Resource{
+					{URL: "/admin/*", Hosts: []string{"admin.example.com"}, Roles: []string{fakeAdminRole}},
+					{URL: "/admin/*", Hosts: []string{"docs.example.com"}, WhiteListed: true},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InValidHostWithTheDefaultUpstream",
+			Config: &Config{
+				Upstream: "http://app:8080",
+				Resources: []*Resource{
+					{URL: "/admin/*", Hosts: []string{"docs.example.com"}, Upstream: "http://app:8080", WhiteListed: true},
+				},
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isVirtualHostsValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
 func TestIsResourceValid(t *testing.T) {
 	testCases := []struct {
 		Name   string
@@ -1853,6 +2062,202 @@ func TestEnableUmaValid(t *testing.T) {
 	}
 }
 
+func TestIsUmaResourceCacheValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidDisabledCache",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidUmaResourceCache",
+			Config: &Config{
+				EnableUma:                true,
+				EnableUmaResourceCache:   true,
+				UmaResourceCacheInterval: time.Minute,
+			},
+			Valid: true,
+		},
+		{
+			Name: "ValidOnDemandRefreshOnly",
+			Config: &Config{
+				EnableUma:              true,
+				EnableUmaResourceCache: true,
+			},
+			Valid: true,
+		},
+		{
+			Name: "MissingEnableUma",
+			Config: &Config{
+				EnableUmaResourceCache:   true,
+				UmaResourceCacheInterval: time.Minute,
+			},
+			Valid: false,
+		},
+		{
+			Name: "NegativeInterval",
+			Config: &Config{
+				EnableUma:                true,
+				EnableUmaResourceCache:   true,
+				UmaResourceCacheInterval: -time.Minute,
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isUmaResourceCacheValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsAuthzCacheValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidDefaults",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidTTLs",
+			Config: &Config{
+				AuthzCacheSize: 10,
+				AuthzCacheTTL:  time.Second,
+				AuthzAllowTTL:  time.Minute,
+				AuthzDenyTTL:   time.Second,
+			},
+			Valid: true,
+		},
+		{
+			Name:   "NegativeCacheSize",
+			Config: &Config{AuthzCacheSize: -1},
+			Valid:  false,
+		},
+		{
+			Name:   "NegativeAllowTTL",
+			Config: &Config{AuthzAllowTTL: -time.Minute},
+			Valid:  false,
+		},
+		{
+			Name:   "NegativeDenyTTL",
+			Config: &Config{AuthzDenyTTL: -time.Minute},
+			Valid:  false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isAuthzCacheValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsHTTPAuthzValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidDisabledHTTPAuthz",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidHTTPAuthz",
+			Config: &Config{
+				EnableHTTPAuthz:  true,
+				HTTPAuthzURL:     "http://127.0.0.1:8181/v1/data/gatekeeper/allow",
+				HTTPAuthzTimeout: time.Second,
+			},
+			Valid: true,
+		},
+		{
+			Name: "InvalidWithUma",
+			Config: &Config{
+				EnableUma:        true,
+				EnableHTTPAuthz:  true,
+				HTTPAuthzURL:     "http://127.0.0.1:8181/v1/data/gatekeeper/allow",
+				HTTPAuthzTimeout: time.Second,
+			},
+			Valid: false,
+		},
+		{
+			Name: "MissingHTTPAuthzURL",
+			Config: &Config{
+				EnableHTTPAuthz:  true,
+				HTTPAuthzTimeout: time.Second,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InvalidHTTPAuthzURL",
+			Config: &Config{
+				EnableHTTPAuthz:  true,
+				HTTPAuthzURL:     "127.0.0.1:8181",
+				HTTPAuthzTimeout: time.Second,
+			},
+			Valid: false,
+		},
+		{
+			Name: "MissingHTTPAuthzTimeout",
+			Config: &Config{
+				EnableHTTPAuthz: true,
+				HTTPAuthzURL:    "http://127.0.0.1:8181/v1/data/gatekeeper/allow",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isHTTPAuthzValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
 func TestUpdateDiscoveryURI(t *testing.T) {
 	testCases := []struct {
 		Name   string
@@ -1996,3 +2401,182 @@ func TestDefaultDenyValid(t *testing.T) {
 		)
 	}
 }
+
+func TestIsTrustedIssuersValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name: "ValidTrustedIssuers",
+			Config: &Config{
+				DiscoveryURL: "https://sso/realms/employees",
+				TrustedIssuers: []*TrustedIssuer{
+					{DiscoveryURL: "https://sso/realms/services", ClientID: "api"},
+					{DiscoveryURL: "https://sso/realms/partners", SkipClientIDCheck: true},
+				},
+			},
+			Valid: true,
+		},
+		{
+			Name: "InvalidTrustedIssuer",
+			Config: &Config{
+				DiscoveryURL:   "https://sso/realms/employees",
+				TrustedIssuers: []*TrustedIssuer{{DiscoveryURL: "https://sso/realms/services"}},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InvalidDuplicateTrustedIssuer",
+			Config: &Config{
+				DiscoveryURL: "https://sso/realms/employees",
+				TrustedIssuers: []*TrustedIssuer{
+					{DiscoveryURL: "https://sso/realms/services", ClientID: "api"},
+					{DiscoveryURL: "https://sso/realms/services", ClientID: "other"},
+				},
+			},
+			Valid: false,
+		},
+		{
+			Name: "InvalidTrustedDiscoveryURL",
+			Config: &Config{
+				DiscoveryURL:   "https://sso/realms/employees",
+				TrustedIssuers: []*TrustedIssuer{{DiscoveryURL: "https://sso/realms/employees", ClientID: "api"}},
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isTrustedIssuersValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsTokenIntrospectionValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidWithoutIntrospection",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidTokenIntrospection",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+				ClientSecret:             "secret",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InvalidTokenIntrospectionWithoutSecret",
+			Config: &Config{
+				EnableTokenIntrospection: true,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InvalidResourceIntrospectionWithoutSecret",
+			Config: &Config{
+				Resources: []*Resource{{URL: "/payments/*", Introspect: true}},
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isTokenIntrospectionValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
+
+func TestIsClientCertIdentityValid(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Config *Config
+		Valid  bool
+	}{
+		{
+			Name:   "ValidWithoutClientCertIdentity",
+			Config: &Config{},
+			Valid:  true,
+		},
+		{
+			Name: "ValidClientCertIdentity",
+			Config: &Config{
+				EnableClientCertIdentity: true,
+				TLSClientCertificate:     "ca.pem",
+			},
+			Valid: true,
+		},
+		{
+			Name: "InvalidClientCertIdentityWithoutMutualTLS",
+			Config: &Config{
+				EnableClientCertIdentity: true,
+			},
+			Valid: false,
+		},
+		{
+			Name: "InvalidMissingClientCertMapping",
+			Config: &Config{
+				EnableClientCertIdentity: true,
+				TLSClientCertificate:     "ca.pem",
+				ClientCertMapping:        "/not/there/mapping.yml",
+			},
+			Valid: false,
+		},
+		{
+			Name: "InvalidClientCertMappingWithoutIdentity",
+			Config: &Config{
+				ClientCertMapping: "mapping.yml",
+			},
+			Valid: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				err := testCase.Config.isClientCertIdentityValid()
+				if err != nil && testCase.Valid {
+					t.Fatalf("Expected test not to fail")
+				}
+
+				if err == nil && !testCase.Valid {
+					t.Fatalf("Expected test to fail")
+				}
+			},
+		)
+	}
+}
@@ -140,12 +140,13 @@ func (r *oauthProxy) dropRefreshTokenCookie(req *http.Request, w http.ResponseWr
 	r.dropCookieWithChunks(req, w, r.config.CookieRefreshName, value, duration)
 }
 
-// writeStateParameterCookie sets a state parameter cookie into the response
-func (r *oauthProxy) writeStateParameterCookie(req *http.Request, wrt http.ResponseWriter) string {
+// writeStateParameterCookie sets a state parameter cookie into the response, along with the pkce
+// code verifier one when enabled
+func (r *oauthProxy) writeStateParameterCookie(req *http.Request, wrt http.ResponseWriter) (string, error) {
 	uuid, err := uuid.NewV4()
 
 	if err != nil {
-		wrt.WriteHeader(http.StatusInternalServerError)
+		return "", err
 	}
 
 	requestURI := base64.StdEncoding.EncodeToString([]byte(req.URL.RequestURI()))
@@ -153,13 +154,51 @@ func (r *oauthProxy) writeStateParameterCookie(req *http.Request, wrt http.Respo
 	r.dropCookie(wrt, req.Host, r.config.CookieRequestURIName, requestURI, 0)
 	r.dropCookie(wrt, req.Host, r.config.CookieOAuthStateName, uuid.String(), 0)
 
-	return uuid.String()
+	if r.config.EnablePKCE {
+		if _, err := r.writeCodeVerifierCookie(req, wrt); err != nil {
+			return "", err
+		}
+	}
+
+	return uuid.String(), nil
+}
+
+// writeCodeVerifierCookie generates the pkce code verifier of a login and sets it, encrypted,
+// into the response
+func (r *oauthProxy) writeCodeVerifierCookie(req *http.Request, wrt http.ResponseWriter) (string, error) {
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := encodeText(verifier, r.config.EncryptionKey)
+	if err != nil {
+		return "", err
+	}
+
+	r.dropCookie(wrt, req.Host, r.config.CookiePKCEName, encrypted, 0)
+
+	return verifier, nil
+}
+
+// getCodeVerifier returns the pkce code verifier of the login from its cookie
+func (r *oauthProxy) getCodeVerifier(req *http.Request) (string, error) {
+	cookie, err := req.Cookie(r.config.CookiePKCEName)
+	if err != nil {
+		return "", err
+	}
+
+	return decodeText(cookie.Value, r.config.EncryptionKey)
 }
 
 // clearAllCookies is just a helper function for the below
 func (r *oauthProxy) clearAllCookies(req *http.Request, w http.ResponseWriter) {
 	r.clearAccessTokenCookie(req, w)
 	r.clearRefreshTokenCookie(req, w)
+
+	if r.config.EnableServerSideSessions {
+		r.dropCookie(w, req.Host, r.config.CookieSessionName, "", -10*time.Hour)
+	}
 }
 
 // clearRefreshSessionCookie clears the session cookie
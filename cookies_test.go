@@ -144,6 +144,31 @@ func TestDropCookie(t *testing.T) {
 		"we have not set the cookie, headers: %v", resp.Header())
 }
 
+func TestWriteStateParameterCookie(t *testing.T) {
+	proxy, _, _ := newTestProxyService(nil)
+	proxy.config.EnablePKCE = true
+	proxy.config.EncryptionKey = testEncryptionKey
+	proxy.config.CookieRequestURIName = requestURICookie
+	proxy.config.CookieOAuthStateName = requestStateCookie
+	proxy.config.CookiePKCEName = requestPKCECookie
+
+	req := newFakeHTTPRequest("GET", "/admin")
+	resp := httptest.NewRecorder()
+	state, err := proxy.writeStateParameterCookie(req, resp)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, state)
+	assert.Len(t, resp.Result().Cookies(), 3)
+
+	// step: the caller answers the failures, nothing is written
+	proxy.config.EncryptionKey = "invalid"
+	resp = httptest.NewRecorder()
+	state, err = proxy.writeStateParameterCookie(req, resp)
+	assert.Error(t, err)
+	assert.Empty(t, state)
+	assert.False(t, resp.Flushed)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
 func TestDropRefreshCookie(t *testing.T) {
 	p, _, _ := newTestProxyService(nil)
 
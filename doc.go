@@ -22,7 +22,9 @@ import (
 	"strconv"
 	"time"
 
+	oidc3 "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/gogatekeeper/gatekeeper/pkg/policy"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -47,6 +49,8 @@ const (
 	headerUpgrade       = "Upgrade"
 	versionHeader       = "X-Auth-Proxy-Version"
 
+	authzDecisionReasonHeader = "X-Auth-Decision-Reason"
+
 	authorizationURL = "/authorize"
 	callbackURL      = "/callback"
 	expiredURL       = "/expired"
@@ -57,13 +61,17 @@ const (
 	tokenURL         = "/token"
 	debugURL         = "/debug/pprof"
 	discoveryURL     = "/discovery"
+	umaResourcesURL  = "/uma-resources"
+	authzURL         = "/authz"
 
 	claimResourceRoles = "roles"
 
 	accessCookie       = "kc-access"
 	refreshCookie      = "kc-state"
+	sessionCookie      = "kc-session"
 	requestURICookie   = "request_uri"
 	requestStateCookie = "OAuth_Token_Request_State"
+	requestPKCECookie  = "OAuth_Token_Request_PKCE"
 	unsecureScheme     = "http"
 	secureScheme       = "https"
 	anyMethod          = "ANY"
@@ -111,12 +119,31 @@ var (
 		},
 		[]string{"code", "method"},
 	)
+	shadowDenialsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_shadow_denials_total",
+			Help: "The requests which would have been denied, let through by the shadow mode",
+		},
+		[]string{"resource", "reason"},
+	)
+)
+
+// the reasons the shadow denials are counted under
+const (
+	shadowReasonRoles  = "roles"
+	shadowReasonGroups = "groups"
+	shadowReasonScopes = "scopes"
+	shadowReasonClaims = "claims"
+	shadowReasonPolicy = "policy"
+	shadowReasonAuthz  = "authz"
 )
 
 // Resource represents a url resource to protect
 type Resource struct {
 	// URL the url for the resource
 	URL string `json:"uri" yaml:"uri"`
+	// Hosts are the virtual hosts of the resource, i.e. admin.example.com or *.example.com, all by default
+	Hosts []string `json:"hosts" yaml:"hosts"`
 	// Methods the method type
 	Methods []string `json:"methods" yaml:"methods"`
 	// WhiteListed permits the prefix through
@@ -127,6 +154,62 @@ type Resource struct {
 	Roles []string `json:"roles" yaml:"roles"`
 	// Groups is a list of groups the user is in
 	Groups []string `json:"groups" yaml:"groups"`
+	// Scopes are the oauth scopes the token must hold to access this url
+	Scopes []string `json:"scopes" yaml:"scopes"`
+	// RequireAnyScope indicates that ANY of the scopes are required, the default is all
+	RequireAnyScope bool `json:"require-any-scope" yaml:"require-any-scope"`
+	// UmaMethodScopes maps the http methods to the uma scope they require, overriding the global mapping
+	UmaMethodScopes map[string]string `json:"uma-method-scopes" yaml:"uma-method-scopes"`
+	// Policy is an expression on the request and the identity which must hold to access the resource
+	Policy string `json:"policy" yaml:"policy"`
+	// Shadow records the denials on the resource without enforcing them
+	Shadow bool `json:"shadow" yaml:"shadow"`
+	// Introspect checks the tokens against the introspection endpoint on every request, so revoked ones are rejected at once
+	Introspect bool `json:"introspect" yaml:"introspect"`
+	// MatchClaims are the claims the token must match on the resource, on top of the global ones
+	MatchClaims map[string]string `json:"match-claims" yaml:"match-claims"`
+	// Upstream is the upstream endpoint of the resource, the global upstream by default
+	Upstream string `json:"upstream-url" yaml:"upstream-url"`
+	// UpstreamCA is the path to a CA certificate in PEM format to validate the upstream of the resource
+	UpstreamCA string `json:"upstream-ca" yaml:"upstream-ca"`
+	// UpstreamTimeout is the maximum amount of time a dial to the upstream of the resource will wait
+	UpstreamTimeout time.Duration `json:"upstream-timeout" yaml:"upstream-timeout"`
+	// SkipUpstreamTLSVerify skips the verification of the tls of the upstream of the resource
+	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify"`
+
+	// StripPrefix is removed from the start of the paths of the upstream requests, the global one by default
+	StripPrefix string `json:"strip-prefix" yaml:"strip-prefix"`
+	// AddPrefix is prepended to the paths of the upstream requests, the global one by default
+	AddPrefix string `json:"add-prefix" yaml:"add-prefix"`
+	// RewriteRules are the regex rewrites of the paths of the upstream requests, the global ones by default
+	RewriteRules []string `json:"rewrite-rules" yaml:"rewrite-rules"`
+
+	// compiledPolicy is the policy compiled when the proxy is created
+	compiledPolicy *policy.Expression
+	// rewrite rewrites the paths of the upstream requests of the resource, if any
+	rewrite *pathRewrite
+	// endpoint is the parsed upstream of the resource, if any
+	endpoint *url.URL
+	// upstream is the proxy to the upstream of the resource, if any
+	upstream reverseProxy
+}
+
+// TrustedIssuer is an additional openid provider whose bearer tokens are accepted
+type TrustedIssuer struct {
+	// DiscoveryURL is the url the openid configuration of the issuer is retrieved from
+	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url"`
+	// ClientID is the audience the tokens of the issuer must hold
+	ClientID string `json:"client-id" yaml:"client-id"`
+	// SkipClientIDCheck accepts the tokens of the issuer whatever their audience
+	SkipClientIDCheck bool `json:"skip-client-id-check" yaml:"skip-client-id-check"`
+	// RolesClaims are the claims, i.e. roles or resource_access.api.roles, the roles of the users
+	// are read from, in place of the keycloak ones
+	RolesClaims []string `json:"roles-claims" yaml:"roles-claims"`
+
+	// issuer is the issuer of the tokens, as advertised by the discovery
+	issuer string
+	// verifier verifies the tokens of the issuer
+	verifier *oidc3.IDTokenVerifier
 }
 
 // Config is the configuration for the proxy
@@ -143,6 +226,8 @@ type Config struct {
 	ListenAdminScheme string `json:"listen-admin-scheme" yaml:"listen-admin-scheme" usage:"scheme to serve admin-only endpoint (http or https)." env:"LISTEN_ADMIN_SCHEME"`
 	// DiscoveryURL is the url for the keycloak server
 	DiscoveryURL string `json:"discovery-url" yaml:"discovery-url" usage:"discovery url to retrieve the openid configuration" env:"DISCOVERY_URL"`
+	// TrustedIssuers are the other issuers whose bearer tokens are accepted, picked by the iss of the tokens
+	TrustedIssuers []*TrustedIssuer `json:"trusted-issuers" yaml:"trusted-issuers" usage:"list of other issuers whose bearer tokens are accepted 'discovery-url=https://sso/realms/services|client-id=api|roles-claims=roles'"`
 	// ClientID is the client id
 	ClientID string `json:"client-id" yaml:"client-id" usage:"client id used to authenticate to the oauth service" env:"CLIENT_ID"`
 	// ClientSecret is the secret for AS
@@ -151,6 +236,10 @@ type Config struct {
 	RedirectionURL string `json:"redirection-url" yaml:"redirection-url" usage:"redirection url for the oauth callback url, defaults to host header if absent" env:"REDIRECTION_URL"`
 	// RevocationEndpoint is the token revocation endpoint to revoke refresh tokens
 	RevocationEndpoint string `json:"revocation-url" yaml:"revocation-url" usage:"url for the revocation endpoint to revoke refresh token" env:"REVOCATION_URL"`
+	// IntrospectionEndpoint is the token introspection endpoint, the one of the discovery by default
+	IntrospectionEndpoint string `json:"introspection-url" yaml:"introspection-url" usage:"url for the introspection endpoint to verify the access tokens, defaults to the one of the discovery" env:"INTROSPECTION_URL"`
+	// EnableTokenIntrospection verifies the access tokens against the introspection endpoint instead of offline
+	EnableTokenIntrospection bool `json:"enable-token-introspection" yaml:"enable-token-introspection" usage:"verifies the access tokens, opaque ones included, against the introspection endpoint instead of offline, the active ones being cached in the store until they expire" env:"ENABLE_TOKEN_INTROSPECTION"`
 	// SkipOpenIDProviderTLSVerify skips the tls verification for openid provider communication
 	SkipOpenIDProviderTLSVerify bool `json:"skip-openid-provider-tls-verify" yaml:"skip-openid-provider-tls-verify" usage:"skip the verification of any TLS communication with the openid provider" env:"SKIP_OPENID_PROVIDER_TLSVERIFY"`
 	// OpenIDProviderProxy proxy for openid provider communication
@@ -173,6 +262,14 @@ type Config struct {
 	Headers map[string]string `json:"headers" yaml:"headers" usage:"custom headers to the upstream request, key=value"`
 	// PreserveHost preserves the host header of the proxied request in the upstream request
 	PreserveHost bool `json:"preserve-host" yaml:"preserve-host" usage:"preserve the host header of the proxied request in the upstream request" env:"PRESERVE_HOST"`
+	// StripPrefix is removed from the start of the paths of the upstream requests
+	StripPrefix string `json:"strip-prefix" yaml:"strip-prefix" usage:"prefix removed from the paths of the upstream requests, i.e. /app1" env:"STRIP_PREFIX"`
+	// AddPrefix is prepended to the paths of the upstream requests
+	AddPrefix string `json:"add-prefix" yaml:"add-prefix" usage:"prefix added to the paths of the upstream requests, once stripped" env:"ADD_PREFIX"`
+	// RewriteRules are the regex rewrites of the paths of the upstream requests
+	RewriteRules []string `json:"rewrite-rules" yaml:"rewrite-rules" usage:"regex rewrites of the paths of the upstream requests applied in order, 'pattern replacement' i.e. '^/v1/(.*)$ /api/$1'"`
+	// EnableResponseRewrite rewrites the prefixes of the redirects and cookie paths of the upstream responses back
+	EnableResponseRewrite bool `json:"enable-response-rewrite" yaml:"enable-response-rewrite" usage:"rewrites the prefixes of the location headers and cookie paths of the upstream responses back" env:"ENABLE_RESPONSE_REWRITE"`
 	// RequestIDHeader is the header name for request ids
 	RequestIDHeader string `json:"request-id-header" yaml:"request-id-header" usage:"the http header name for request id" env:"REQUEST_ID_HEADER"`
 	// ResponseHeader is a map of response headers to add to the response
@@ -209,8 +306,14 @@ type Config struct {
 	EnableSecurityFilter bool `json:"enable-security-filter" yaml:"enable-security-filter" usage:"enables the security filter handler" env:"ENABLE_SECURITY_FILTER"`
 	// EnableRefreshTokens indicate's you wish to ignore using refresh tokens and re-auth on expiration of access token
 	EnableRefreshTokens bool `json:"enable-refresh-tokens" yaml:"enable-refresh-tokens" usage:"enables the handling of the refresh tokens" env:"ENABLE_REFRESH_TOKEN"`
+	// EnablePKCE protects the authorization code flow with a pkce (S256) code verifier per login
+	EnablePKCE bool `json:"enable-pkce" yaml:"enable-pkce" usage:"enables the pkce (S256) code challenge in the authorization code flow, opt-in as the code verifier is kept in a cookie encrypted with the encryption-key" env:"ENABLE_PKCE"`
+	// EnableNonce binds the id tokens of the logins to their state cookie through the nonce
+	EnableNonce bool `json:"enable-nonce" yaml:"enable-nonce" usage:"sends a nonce bound to the state cookie in the authorization code flow and rejects the id tokens not carrying it, on by default, turn it off for the providers not returning the nonce" env:"ENABLE_NONCE"`
 	// EnableSessionCookies indicates the cookies, both token and refresh should not be persisted
 	EnableSessionCookies bool `json:"enable-session-cookies" yaml:"enable-session-cookies" usage:"access and refresh tokens are session only i.e. removed browser close" env:"ENABLE_SESSION_COOKIES"`
+	// EnableServerSideSessions indicates the tokens are kept in the store and the browser only holds a session id
+	EnableServerSideSessions bool `json:"enable-server-side-sessions" yaml:"enable-server-side-sessions" usage:"keeps the session tokens in the store, the browser only receives an opaque session id cookie, requires store-url" env:"ENABLE_SERVER_SIDE_SESSIONS"`
 	// EnableLoginHandler indicates we want the login handler enabled
 	EnableLoginHandler bool `json:"enable-login-handler" yaml:"enable-login-handler" usage:"enables the handling of the refresh tokens" env:"ENABLE_LOGIN_HANDLER"`
 	// EnableTokenHeader adds the JWT token to the upstream authentication headers
@@ -241,6 +344,30 @@ type Config struct {
 	EnableUma        bool          `json:"enable-uma" yaml:"enable-uma" usage:"enable uma authorization, please don't use it in production, we would like to receive feedback" env:"ENABLE_UMA"`
 	PatRetryCount    int           `json:"pat-retry-count" yaml:"pat-retry-count" usage:"number of retries to get PAT" env:"PAT_RETRY_COUNT"`
 	PatRetryInterval time.Duration `json:"pat-retry-interval" yaml:"pat-retry-interval" usage:"interval between retries to get PAT" env:"PAT_RETRY_INTERVAL"`
+	// UmaMethodScopes maps the http methods to the uma scope they require
+	UmaMethodScopes map[string]string `json:"uma-method-scopes" yaml:"uma-method-scopes" usage:"maps http methods to the uma scope they require, e.g. GET=read, without a mapping any scope of the resource is accepted"`
+	// EnableUmaResourceCache keeps the uma resources of the client in memory and matches paths locally
+	EnableUmaResourceCache bool `json:"enable-uma-resource-cache" yaml:"enable-uma-resource-cache" usage:"load the uma resources of the client in memory and match the paths locally instead of asking the idp on every request" env:"ENABLE_UMA_RESOURCE_CACHE"`
+	// UmaResourceCacheInterval is how often the uma resources are reloaded
+	UmaResourceCacheInterval time.Duration `json:"uma-resource-cache-interval" yaml:"uma-resource-cache-interval" usage:"interval between reloads of the uma resources, zero only reloads them on demand via the admin endpoint" env:"UMA_RESOURCE_CACHE_INTERVAL"`
+	// EnableHTTPAuthz enables the authorization by an external policy endpoint
+	EnableHTTPAuthz bool `json:"enable-http-authz" yaml:"enable-http-authz" usage:"enable authorization by an external policy endpoint, e.g. an opa sidecar, instead of uma" env:"ENABLE_HTTP_AUTHZ"`
+	// HTTPAuthzURL is the policy endpoint the description of the requests is posted to
+	HTTPAuthzURL string `json:"http-authz-url" yaml:"http-authz-url" usage:"url of the policy endpoint the requests are described to, e.g. http://127.0.0.1:8181/v1/data/gatekeeper/allow" env:"HTTP_AUTHZ_URL"`
+	// HTTPAuthzHeaders are the request headers described to the policy endpoint
+	HTTPAuthzHeaders []string `json:"http-authz-headers" yaml:"http-authz-headers" usage:"request headers described to the policy endpoint and keyed with its cached decisions, all but the credentials when none are set"`
+	// HTTPAuthzTimeout is the timeout of the requests to the policy endpoint
+	HTTPAuthzTimeout time.Duration `json:"http-authz-timeout" yaml:"http-authz-timeout" usage:"timeout of the requests to the policy endpoint" env:"HTTP_AUTHZ_TIMEOUT"`
+	// EnableShadowMode records the admission and authorization denials without enforcing them
+	EnableShadowMode bool `json:"enable-shadow-mode" yaml:"enable-shadow-mode" usage:"evaluate the admission and authorization of all the resources without enforcing it, the requests which would be denied are logged and counted but let through" env:"ENABLE_SHADOW_MODE"`
+	// AuthzCacheSize is the number of authz decisions kept in process, in front of the store
+	AuthzCacheSize int `json:"authz-cache-size" yaml:"authz-cache-size" usage:"number of uma authorization decisions cached in process in front of the store, zero disables the local cache" env:"AUTHZ_CACHE_SIZE"`
+	// AuthzCacheTTL is how long an authz decision is cached in process
+	AuthzCacheTTL time.Duration `json:"authz-cache-ttl" yaml:"authz-cache-ttl" usage:"how long uma authorization decisions are cached in process, never longer than in the store" env:"AUTHZ_CACHE_TTL"`
+	// AuthzAllowTTL is how long an allowed decision is kept in the store
+	AuthzAllowTTL time.Duration `json:"authz-allow-ttl" yaml:"authz-allow-ttl" usage:"how long allowed authorization decisions are cached in the store, zero caches them until the token expires" env:"AUTHZ_ALLOW_TTL"`
+	// AuthzDenyTTL is how long a denied decision is kept in the store
+	AuthzDenyTTL time.Duration `json:"authz-deny-ttl" yaml:"authz-deny-ttl" usage:"how long denied authorization decisions are cached in the store, zero caches them until the token expires" env:"AUTHZ_DENY_TTL"`
 
 	// AccessTokenDuration is default duration applied to the access token cookie
 	AccessTokenDuration time.Duration `json:"access-token-duration" yaml:"access-token-duration" usage:"fallback cookie duration for the access token when using refresh tokens" env:"ACCESS_TOKEN_DURATION"`
@@ -250,10 +377,14 @@ type Config struct {
 	CookieAccessName string `json:"cookie-access-name" yaml:"cookie-access-name" usage:"name of the cookie use to hold the access token" env:"COOKIE_ACCESS_NAME"`
 	// CookieRefreshName is the name of the refresh cookie
 	CookieRefreshName string `json:"cookie-refresh-name" yaml:"cookie-refresh-name" usage:"name of the cookie used to hold the encrypted refresh token" env:"COOKIE_REFRESH_NAME"`
+	// CookieSessionName is the name of the cookie holding the server side session id
+	CookieSessionName string `json:"cookie-session-name" yaml:"cookie-session-name" usage:"name of the cookie used to hold the server side session id" env:"COOKIE_SESSION_NAME"`
 	// CookieOAuthStateName is the name of the Oauth Token request state
 	CookieOAuthStateName string `json:"cookie-oauth-state-name" yaml:"cookie-oauth-state-name" usage:"name of the cookie used to hold the Oauth request state" env:"COOKIE_OAUTH_STATE_NAME"`
 	// CookieRequestURIName is the name of the Request Uri cookie
 	CookieRequestURIName string `json:"cookie-request-uri-name" yaml:"cookie-request-uri-name" usage:"name of the cookie used to hold the request uri" env:"COOKIE_REQUEST_URI_NAME"`
+	// CookiePKCEName is the name of the cookie holding the encrypted pkce code verifier of the login
+	CookiePKCEName string `json:"cookie-pkce-name" yaml:"cookie-pkce-name" usage:"name of the cookie used to hold the encrypted pkce code verifier" env:"COOKIE_PKCE_NAME"`
 	// SecureCookie enforces the cookie as secure
 	SecureCookie bool `json:"secure-cookie" yaml:"secure-cookie" usage:"enforces the cookie to be secure" env:"SECURE_COOKIE"`
 	// HTTPOnlyCookie enforces the cookie as http only
@@ -276,6 +407,10 @@ type Config struct {
 	TLSCaPrivateKey string `json:"tls-ca-key" yaml:"tls-ca-key" usage:"path the ca private key, used by the forward signing proxy" env:"TLS_CA_PRIVATE_KEY"`
 	// TLSClientCertificate is path to a client certificate to use for outbound connections
 	TLSClientCertificate string `json:"tls-client-certificate" yaml:"tls-client-certificate" usage:"path to the client certificate for outbound connections in reverse and forwarding proxy modes" env:"TLS_CLIENT_CERTIFICATE"`
+	// EnableClientCertIdentity authenticates the requests without token by their verified client certificate
+	EnableClientCertIdentity bool `json:"enable-client-cert-identity" yaml:"enable-client-cert-identity" usage:"authenticates the requests without token by the client certificate verified by the mutual tls, requires the tls-client-certificate" env:"ENABLE_CLIENT_CERT_IDENTITY"`
+	// ClientCertMapping is the file mapping the client certificates to the identity of the callers
+	ClientCertMapping string `json:"client-cert-mapping" yaml:"client-cert-mapping" usage:"path to the file mapping the fields of the client certificates to the id, name and roles of the callers" env:"CLIENT_CERT_MAPPING"`
 	// SkipUpstreamTLSVerify skips the verification of any upstream tls
 	SkipUpstreamTLSVerify bool `json:"skip-upstream-tls-verify" yaml:"skip-upstream-tls-verify" usage:"skip the verification of any upstream TLS" env:"SKIP_UPSTREAM_TLS_VERIFY"`
 	// TLSMinVersion specifies server minimal TLS version
@@ -306,7 +441,13 @@ type Config struct {
 	Hostnames []string `json:"hostnames" yaml:"hostnames" usage:"list of hostnames the service will respond to"`
 
 	// Store is a url for a store resource, used to hold the refresh tokens
-	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file" env:"STORE_URL"`
+	StoreURL string `json:"store-url" yaml:"store-url" usage:"url for the storage subsystem, e.g redis://127.0.0.1:6379, file:///etc/tokens.file, memory://?max-entries=10000" env:"STORE_URL"`
+	// StoreTimeout is the maximum time an operation against the store may take, within the request deadline
+	StoreTimeout time.Duration `json:"store-timeout" yaml:"store-timeout" usage:"the maximum time an operation against the store may take, zero leaves only the request deadline" env:"STORE_TIMEOUT"`
+	// StoreKeyPrefix is prepended to every key in the store, so a store can be shared between deployments
+	StoreKeyPrefix string `json:"store-key-prefix" yaml:"store-key-prefix" usage:"prefix added to every key in the store, e.g. the client id, so one store can be shared by several proxies" env:"STORE_KEY_PREFIX"`
+	// EnableStoreEncryption indicates every value is encrypted with the encryption key before being stored
+	EnableStoreEncryption bool `json:"enable-store-encryption" yaml:"enable-store-encryption" usage:"encrypts every value in the store with the encryption-key" env:"ENABLE_STORE_ENCRYPTION"`
 	// EncryptionKey is the encryption key used to encrypt the refresh token
 	EncryptionKey string `json:"encryption-key" yaml:"encryption-key" usage:"encryption key used to encryption the session state" env:"ENCRYPTION_KEY"`
 
@@ -399,6 +540,10 @@ type RequestScope struct {
 	AccessDenied bool
 	// Identity is the user Identity of the request
 	Identity *userContext
+	// Resource is the protected resource the request matched, if any
+	Resource *Resource
+	// AuthzDecision is the authorization decision made for the request, if any
+	AuthzDecision *authorization.Decision
 	// The parsed (unescaped) value of the request path
 	Path string
 	// Preserve the original request path: KEYCLOAK-10864, KEYCLOAK-11276, KEYCLOAK-13315
@@ -431,6 +576,8 @@ type userContext struct {
 	preferredName string
 	// roles is a collection of roles the users holds
 	roles []string
+	// scopes are the oauth scopes of the token, from the space delimited scope claim
+	scopes []string
 	// rawToken
 	rawToken string
 	// claims
@@ -448,3 +595,19 @@ type tokenResponse struct {
 	ExpiresIn    float64 `json:"expires_in"`
 	Scope        string  `json:"scope,omitempty"`
 }
+
+// sessionState is a server side session as held in the store
+type sessionState struct {
+	// AccessToken is the raw access token of the session
+	AccessToken string `json:"access_token"`
+	// RefreshToken is the encrypted refresh token, if any
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// IDToken is the raw id token, if any
+	IDToken string `json:"id_token,omitempty"`
+	// ExpiresAt is the expiration of the access token
+	ExpiresAt time.Time `json:"expires_at"`
+	// Subject is the subject of the tokens
+	Subject string `json:"sub"`
+	// Email is the email of the user
+	Email string `json:"email,omitempty"`
+}
@@ -21,6 +21,7 @@ import (
 	"net/http"
 
 	"github.com/Nerzal/gocloak/v11"
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
 	"go.uber.org/zap"
 )
 
@@ -39,6 +40,12 @@ func (r *oauthProxy) proxyMiddleware(next http.Handler) http.Handler {
 			}
 		}
 
+		// @step: the resources with an upstream of their own are proxied to it
+		endpoint, upstream := r.endpoint, r.upstream
+		if scope != nil && scope.Resource != nil && scope.Resource.upstream != nil {
+			endpoint, upstream = scope.Resource.endpoint, scope.Resource.upstream
+		}
+
 		// @step: add the proxy forwarding headers
 		req.Header.Set("X-Real-IP", realIP(req))
 		if xff := req.Header.Get(headerXForwardedFor); xff == "" {
@@ -59,24 +66,39 @@ func (r *oauthProxy) proxyMiddleware(next http.Handler) http.Handler {
 		}
 
 		// @note: by default goproxy only provides a forwarding proxy, thus all requests have to be absolute and we must update the host headers
-		req.URL.Host = r.endpoint.Host
-		req.URL.Scheme = r.endpoint.Scheme
+		req.URL.Host = endpoint.Host
+		req.URL.Scheme = endpoint.Scheme
 		// Restore the unprocessed original path, so that we pass upstream exactly what we received
 		// as the resource request.
 		if scope != nil {
 			req.URL.Path = scope.Path
 			req.URL.RawPath = scope.RawPath
 		}
+
+		// @step: rewrite the path for the upstream, the resources having their own rewrites
+		rewrite := r.rewrite
+		if scope != nil && scope.Resource != nil && scope.Resource.rewrite != nil {
+			rewrite = scope.Resource.rewrite
+		}
+
+		if rewrite != nil {
+			req.URL.Path = rewrite.request(req.URL.Path)
+
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = rewrite.request(req.URL.RawPath)
+			}
+		}
+
 		if v := req.Header.Get("Host"); v != "" {
 			req.Host = v
 			req.Header.Del("Host")
 		} else if !r.config.PreserveHost {
-			req.Host = r.endpoint.Host
+			req.Host = endpoint.Host
 		}
 
 		if isUpgradedConnection(req) {
 			r.log.Debug("upgrading the connnection", zap.String("client_ip", req.RemoteAddr))
-			if err := tryUpdateConnection(req, wrt, r.endpoint); err != nil {
+			if err := tryUpdateConnection(req, wrt, endpoint); err != nil {
 				r.log.Error("failed to upgrade connection", zap.Error(err))
 				wrt.WriteHeader(http.StatusInternalServerError)
 				return
@@ -84,7 +106,11 @@ func (r *oauthProxy) proxyMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		r.upstream.ServeHTTP(wrt, req)
+		if rewrite != nil && r.config.EnableResponseRewrite {
+			wrt = &rewriteResponseWriter{ResponseWriter: wrt, rewrite: rewrite, host: req.Host}
+		}
+
+		upstream.ServeHTTP(wrt, req)
 	})
 }
 
@@ -102,22 +128,17 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 
 			defer cancel()
 
-			matchingURI := true
-
-			resourceParam := gocloak.GetResourceParams{
-				URI:         &req.URL.Path,
-				MatchingURI: &matchingURI,
-			}
-
 			r.pat.m.Lock()
 			pat := r.pat.Token.AccessToken
 			r.pat.m.Unlock()
 
-			resources, err := r.idpClient.GetResourcesClient(
+			resources, err := authorization.GetResources(
 				ctx,
+				r.umaResources,
+				r.idpClient,
 				pat,
 				r.config.Realm,
-				resourceParam,
+				req.URL.Path,
 			)
 
 			if err != nil {
@@ -138,20 +159,17 @@ func (r *oauthProxy) forwardProxyHandler() func(*http.Request, *http.Response) {
 			}
 
 			resourceID := resources[0].ID
-			resourceScopes := make([]string, 0)
+			resourceScopes, err := getTicketScopes(resources[0], r.getUmaScope(nil, req.Method))
 
-			if len(*resources[0].ResourceScopes) == 0 {
+			if err != nil {
 				r.log.Error(
-					"missing scopes for resource in IDP provider",
+					"problem getting the scopes of the resource in IDP provider",
 					zap.String("resourceID", *resourceID),
+					zap.Error(err),
 				)
 				return
 			}
 
-			for _, scope := range *resources[0].ResourceScopes {
-				resourceScopes = append(resourceScopes, *scope.Name)
-			}
-
 			permissions := []gocloak.CreatePermissionTicketParams{
 				{
 					ResourceID:     resourceID,
@@ -35,6 +35,8 @@ import (
 
 	oidc3 "github.com/coreos/go-oidc/v3/oidc"
 	"github.com/go-chi/chi/v5"
+	uuid "github.com/gofrs/uuid"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 	"gopkg.in/square/go-jose.v2/jwt"
@@ -94,7 +96,51 @@ func (r *oauthProxy) oauthAuthorizationHandler(wrt http.ResponseWriter, req *htt
 		accessType = oauth2.AccessTypeOffline
 	}
 
-	authURL := conf.AuthCodeURL(req.URL.Query().Get("state"), accessType)
+	authOptions := []oauth2.AuthCodeOption{accessType}
+	state := req.URL.Query().Get("state")
+
+	// step: send the nonce of the login, bound to its state cookie
+	if r.config.EnableNonce {
+		stateCookie, err := req.Cookie(r.config.CookieOAuthStateName)
+
+		if err != nil {
+			// @note: the authorization was requested without going through the login redirection,
+			// so the state the nonce is bound to is issued here
+			uuid, err := uuid.NewV4()
+			if err != nil {
+				r.log.Error("unable to generate the state of the login", zap.Error(err))
+				wrt.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			state = uuid.String()
+			stateCookie = &http.Cookie{Value: state}
+			r.dropCookie(wrt, req.Host, r.config.CookieOAuthStateName, state, 0)
+		}
+
+		authOptions = append(authOptions, oidc3.Nonce(getNonce(stateCookie.Value)))
+	}
+
+	// step: send the pkce challenge of the login, the verifier being kept in a cookie
+	if r.config.EnablePKCE {
+		codeVerifier, err := r.getCodeVerifier(req)
+		if err != nil {
+			// @note: the authorization was requested without going through the login redirection
+			if codeVerifier, err = r.writeCodeVerifierCookie(req, wrt); err != nil {
+				r.log.Error("unable to generate the pkce code verifier", zap.Error(err))
+				wrt.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		authOptions = append(
+			authOptions,
+			oauth2.SetAuthURLParam("code_challenge", getCodeChallenge(codeVerifier)),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+	}
+
+	authURL := conf.AuthCodeURL(state, authOptions...)
 
 	r.log.Debug(
 		"incoming authorization request from client address",
@@ -138,9 +184,24 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 
 	conf := r.newOAuth2Config(r.getRedirectionURL(w, req))
 
+	var codeVerifier string
+
+	if r.config.EnablePKCE {
+		verifier, err := r.getCodeVerifier(req)
+		if err != nil {
+			r.log.Error("unable to obtain the pkce code verifier of the login", zap.Error(err))
+			r.accessForbidden(w, req)
+			return
+		}
+
+		codeVerifier = verifier
+		r.dropCookie(w, req.Host, r.config.CookiePKCEName, "", -10*time.Hour)
+	}
+
 	resp, err := exchangeAuthenticationCode(
 		conf,
 		code,
+		codeVerifier,
 		r.config.SkipOpenIDProviderTLSVerify,
 	)
 
@@ -183,6 +244,24 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
+	// step: reject the id tokens which were not issued for the login of this browser
+	if r.config.EnableNonce {
+		state, err := req.Cookie(r.config.CookieOAuthStateName)
+
+		if err != nil || idToken.Nonce != getNonce(state.Value) {
+			r.log.Error(
+				"the nonce of the id token does not match the login",
+				zap.String("nonce", idToken.Nonce),
+				zap.String("client_ip", req.RemoteAddr),
+			)
+			r.accessForbidden(w, req)
+			return
+		}
+
+		// @note: the state is spent, so its nonce can not be matched again
+		r.dropCookie(w, req.Host, r.config.CookieOAuthStateName, "", -10*time.Hour)
+	}
+
 	token, err := jwt.ParseSigned(rawIDToken)
 
 	if err != nil {
@@ -271,8 +350,46 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 	// @metric a token has been issued
 	oauthTokensMetric.WithLabelValues("issued").Inc()
 
-	// step: does the response have a refresh token and we do NOT ignore refresh tokens?
-	if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
+	// step: are we keeping the tokens server side, or does the response have a refresh token and
+	// we do NOT ignore refresh tokens?
+	if r.config.EnableServerSideSessions {
+		session := &sessionState{
+			AccessToken: rawToken,
+			IDToken:     rawIDToken,
+			ExpiresAt:   stdClaims.Expiry.Time(),
+			Subject:     stdClaims.Subject,
+			Email:       customClaims.Email,
+		}
+		expiration := time.Until(stdClaims.Expiry.Time())
+
+		if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
+			if session.RefreshToken, err = encodeText(resp.RefreshToken, r.config.EncryptionKey); err != nil {
+				r.log.Error(
+					"failed to encrypt the refresh token",
+					zap.Error(err),
+					zap.String("sub", stdClaims.Subject),
+					zap.String("email", customClaims.Email),
+				)
+
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			expiration = r.getAccessCookieExpiration(resp.RefreshToken)
+		}
+
+		if err = r.createSession(req, w, session, expiration); err != nil {
+			r.log.Error(
+				"failed to save the session in the store",
+				zap.Error(err),
+				zap.String("sub", stdClaims.Subject),
+				zap.String("email", customClaims.Email),
+			)
+
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else if r.config.EnableRefreshTokens && resp.RefreshToken != "" {
 		var encrypted string
 		encrypted, err = encodeText(resp.RefreshToken, r.config.EncryptionKey)
 
@@ -325,7 +442,7 @@ func (r *oauthProxy) oauthCallbackHandler(w http.ResponseWriter, req *http.Reque
 
 		switch r.useStore() {
 		case true:
-			if err = r.StoreRefreshToken(rawToken, encrypted, expiration); err != nil {
+			if err = r.StoreRefreshToken(req.Context(), rawToken, encrypted, expiration); err != nil {
 				r.log.Warn(
 					"failed to save the refresh token in the store",
 					zap.Error(err),
@@ -488,8 +605,37 @@ func (r *oauthProxy) loginHandler(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 
-		// step: does the response have a refresh token and we do NOT ignore refresh tokens?
-		if r.config.EnableRefreshTokens && token.RefreshToken != "" {
+		// step: are we keeping the tokens server side, or does the response have a refresh token
+		// and we do NOT ignore refresh tokens?
+		if r.config.EnableServerSideSessions {
+			rawIDToken, _ := token.Extra("id_token").(string)
+			session := &sessionState{
+				AccessToken: token.AccessToken,
+				IDToken:     rawIDToken,
+				ExpiresAt:   identity.expiresAt,
+				Subject:     identity.id,
+				Email:       identity.email,
+			}
+			expiration := time.Until(identity.expiresAt)
+
+			if r.config.EnableRefreshTokens && token.RefreshToken != "" {
+				if session.RefreshToken, err = encodeText(token.RefreshToken, r.config.EncryptionKey); err != nil {
+					r.log.Error("failed to encrypt the refresh token", zap.Error(err))
+					return "failed to encrypt the refresh token",
+						http.StatusInternalServerError,
+						err
+				}
+
+				expiration = r.getAccessCookieExpiration(token.RefreshToken)
+			}
+
+			if err = r.createSession(req, w, session, expiration); err != nil {
+				r.log.Error("failed to save the session in the store", zap.Error(err))
+				return "failed to save the session in the store",
+					http.StatusInternalServerError,
+					err
+			}
+		} else if r.config.EnableRefreshTokens && token.RefreshToken != "" {
 			var encrypted string
 			encrypted, err = encodeText(token.RefreshToken, r.config.EncryptionKey)
 
@@ -532,7 +678,7 @@ func (r *oauthProxy) loginHandler(w http.ResponseWriter, req *http.Request) {
 
 			switch r.useStore() {
 			case true:
-				if err = r.StoreRefreshToken(token.AccessToken, encrypted, expiration); err != nil {
+				if err = r.StoreRefreshToken(req.Context(), token.AccessToken, encrypted, expiration); err != nil {
 					r.log.Warn(
 						"failed to save the refresh token in the store",
 						zap.Error(err),
@@ -635,10 +781,17 @@ func (r *oauthProxy) logoutHandler(w http.ResponseWriter, req *http.Request) {
 	// @metric increment the logout counter
 	oauthTokensMetric.WithLabelValues("logout").Inc()
 
+	// step: revoke the server side session, if any
+	if r.config.EnableServerSideSessions {
+		if id, err := r.getSessionID(req); err == nil {
+			_ = r.DeleteSession(req.Context(), id)
+		}
+	}
+
 	// step: check if the user has a state session and if so revoke it
 	if r.useStore() {
 		go func() {
-			if err = r.DeleteRefreshToken(user.rawToken); err != nil {
+			if err = r.DeleteRefreshToken(context.Background(), user.rawToken); err != nil {
 				r.log.Error(
 					"unable to remove the refresh token from store",
 					zap.Error(err),
@@ -833,6 +986,35 @@ func (r *oauthProxy) healthHandler(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write([]byte("OK\n"))
 }
 
+// umaResourcesHandler reloads the uma resources cached in process on demand
+func (r *oauthProxy) umaResourcesHandler(wrt http.ResponseWriter, req *http.Request) {
+	if err := r.loadUmaResources(); err != nil {
+		wrt.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	wrt.WriteHeader(http.StatusNoContent)
+}
+
+// authzHandler deletes the cached authz decisions of the subject, i.e. once their permissions
+// have changed in keycloak or in the policies
+func (r *oauthProxy) authzHandler(wrt http.ResponseWriter, req *http.Request) {
+	subject := chi.URLParam(req, "subject")
+
+	if err := r.DeleteAuthz(req.Context(), subject); err != nil {
+		r.log.Error(
+			"problem deleting the authz decisions",
+			zap.String("subject", subject),
+			zap.Error(err),
+		)
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	r.log.Info("deleted the authz decisions", zap.String("subject", subject))
+	wrt.WriteHeader(http.StatusNoContent)
+}
+
 // debugHandler is responsible for providing the pprof
 func (r *oauthProxy) debugHandler(w http.ResponseWriter, req *http.Request) {
 	const symbolProfile = "symbol"
@@ -883,9 +1065,16 @@ func (r *oauthProxy) proxyMetricsHandler(wrt http.ResponseWriter, req *http.Requ
 
 // retrieveRefreshToken retrieves the refresh token from store or cookie
 func (r *oauthProxy) retrieveRefreshToken(req *http.Request, user *userContext) (token, encrypted string, err error) {
-	switch r.useStore() {
-	case true:
-		token, err = r.GetRefreshToken(user.rawToken)
+	switch {
+	case r.config.EnableServerSideSessions && !user.bearerToken:
+		var session *sessionState
+		if session, err = r.getSession(req); err == nil {
+			if token = session.RefreshToken; token == "" {
+				err = apperrors.ErrNoSessionStateFound
+			}
+		}
+	case r.useStore():
+		token, err = r.GetRefreshToken(req.Context(), user.rawToken)
 	default:
 		token, err = r.getRefreshTokenFromCookie(req)
 	}
@@ -21,6 +21,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -860,6 +861,200 @@ func TestCallbackURL(t *testing.T) {
 	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
 }
 
+func TestPKCE(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnablePKCE = true
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.CookiePKCEName = requestPKCECookie
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{EnablePKCE: true}).RunTests(t, requests)
+}
+
+func TestPKCERequiredByProvider(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{EnablePKCE: true})
+
+	_, _, err := makeTestCodeFlowLogin(proxy.getServiceURL() + fakeAuthAllURL)
+	assert.Error(t, err)
+}
+
+func TestPKCECodeChallenge(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnablePKCE = true
+	cfg.EncryptionKey = testEncryptionKey
+	cfg.CookiePKCEName = requestPKCECookie
+
+	_, _, service := newTestProxyService(cfg)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(service + cfg.WithOAuthURI(authorizationURL) + "?state=test")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	var codeVerifier string
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == requestPKCECookie {
+			codeVerifier, err = decodeText(cookie.Value, testEncryptionKey)
+			require.NoError(t, err)
+		}
+	}
+
+	assert.Len(t, codeVerifier, 43)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+	assert.Equal(t, getCodeChallenge(codeVerifier), location.Query().Get("code_challenge"))
+}
+
+func TestGetCodeChallenge(t *testing.T) {
+	// @note: the example of https://datatracker.ietf.org/doc/html/rfc7636#appendix-B
+	assert.Equal(
+		t,
+		"E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		getCodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"),
+	)
+
+	first, err := newCodeVerifier()
+	require.NoError(t, err)
+	second, err := newCodeVerifier()
+	require.NoError(t, err)
+
+	assert.Len(t, first, 43)
+	assert.NotEqual(t, first, second)
+}
+
+func TestNonce(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableNonce = true
+	cfg.CookieOAuthStateName = requestStateCookie
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestNonceDropsStateCookie(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableNonce = true
+	cfg.CookieOAuthStateName = requestStateCookie
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	resp, _, err := makeTestCodeFlowLogin(proxy.getServiceURL() + fakeAuthAllURL)
+	require.NoError(t, err)
+
+	var dropped bool
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cfg.CookieOAuthStateName {
+			dropped = cookie.Value == "" && cookie.Expires.Before(time.Now())
+		}
+	}
+
+	assert.True(t, dropped, "expected the state cookie to be dropped by the callback")
+}
+
+func TestNonceMismatch(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableNonce = true
+	cfg.CookieOAuthStateName = requestStateCookie
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{InvalidNonce: true})
+
+	_, _, err := makeTestCodeFlowLogin(proxy.getServiceURL() + fakeAuthAllURL)
+	assert.Error(t, err)
+}
+
+func TestNonceAuthorizationURL(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableNonce = true
+	cfg.CookieOAuthStateName = requestStateCookie
+
+	_, _, service := newTestProxyService(cfg)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(service + cfg.WithOAuthURI(authorizationURL))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	var state string
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == cfg.CookieOAuthStateName {
+			state = cookie.Value
+		}
+	}
+
+	require.NotEmpty(t, state)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, state, location.Query().Get("state"))
+	assert.Equal(t, getNonce(state), location.Query().Get("nonce"))
+	assert.NotEqual(t, getNonce(state), getNonce(state+"x"))
+}
+
 func TestHealthHandler(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	requests := []fakeRequest{
@@ -0,0 +1,157 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"go.uber.org/zap"
+)
+
+// introspectionResponse is the part of the introspection response of a token, see
+// https://datatracker.ietf.org/doc/html/rfc7662#section-2.2, the proxy relies on
+type introspectionResponse struct {
+	Active bool  `json:"active"`
+	Exp    int64 `json:"exp"`
+}
+
+// getIntrospectionEndpoint returns the introspection endpoint, the configured one or else the
+// one the discovery advertises
+func (r *oauthProxy) getIntrospectionEndpoint() (string, error) {
+	if r.config.IntrospectionEndpoint != "" {
+		return r.config.IntrospectionEndpoint, nil
+	}
+
+	var discovery struct {
+		IntrospectionEndpoint string `json:"introspection_endpoint"`
+	}
+
+	if err := r.provider.Claims(&discovery); err != nil {
+		return "", err
+	}
+
+	if discovery.IntrospectionEndpoint == "" {
+		return "", errors.New("the provider does not advertise an introspection endpoint, set the introspection-url")
+	}
+
+	return discovery.IntrospectionEndpoint, nil
+}
+
+// getIntrospectedIdentity retrieves the user identity from the introspection of the access token
+// of the request, the introspection of the active tokens is taken from the store when cached is set
+func (r *oauthProxy) getIntrospectedIdentity(req *http.Request, cached bool) (*userContext, error) {
+	access, isBearer, err := r.getAccessToken(req)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := r.introspectToken(req.Context(), access, cached)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := extractIntrospectedIdentity(content)
+	if err != nil {
+		return nil, err
+	}
+
+	user.bearerToken = isBearer
+	user.rawToken = access
+
+	r.log.Debug("found the introspected user identity",
+		zap.String("id", user.id),
+		zap.String("name", user.name),
+		zap.String("email", user.email),
+		zap.String("roles", strings.Join(user.roles, ",")),
+		zap.String("groups", strings.Join(user.groups, ",")))
+
+	return user, nil
+}
+
+// introspectToken returns the introspection response of the token, an error if it is not active,
+// the responses of the active tokens being kept in the store until the tokens expire
+func (r *oauthProxy) introspectToken(ctx context.Context, token string, cached bool) ([]byte, error) {
+	cached = cached && r.useStore()
+	key := getIntrospectionKey(token)
+
+	if cached {
+		content, err := r.getValue(ctx, key)
+
+		if err != nil {
+			r.log.Warn("unable to retrieve the introspection of the token from the store", zap.Error(err))
+		}
+
+		if content != "" {
+			return []byte(content), nil
+		}
+	}
+
+	start := time.Now()
+	resp, err := r.idpClient.RestyClient().R().
+		SetContext(ctx).
+		SetBasicAuth(url.QueryEscape(r.config.ClientID), url.QueryEscape(r.config.ClientSecret)).
+		SetFormData(map[string]string{
+			"token":           token,
+			"token_type_hint": "access_token",
+		}).
+		Post(r.introspectURL)
+
+	if err != nil {
+		return nil, err
+	}
+
+	oauthLatencyMetric.WithLabelValues("introspection").
+		Observe(time.Since(start).Seconds())
+
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("invalid response from the introspection endpoint, status code %d", resp.StatusCode())
+	}
+
+	content := resp.Body()
+	response := &introspectionResponse{}
+
+	if err := json.Unmarshal(content, response); err != nil {
+		return nil, err
+	}
+
+	expiration := time.Until(time.Unix(response.Exp, 0))
+
+	if !response.Active || response.Exp != 0 && expiration <= 0 {
+		return nil, apperrors.ErrTokenInactive
+	}
+
+	// @note: the tokens without expiration are not cached, they would never be checked again
+	if cached && response.Exp != 0 {
+		if err := r.setValue(ctx, key, string(content), expiration); err != nil {
+			r.log.Error("failed to store the introspection of the token", zap.Error(err))
+		}
+	}
+
+	return content, nil
+}
+
+// getIntrospectionKey returns the key the introspection of the token is kept under
+func getIntrospectionKey(token string) string {
+	return "introspection:" + getHashKey(token)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func newTrustedIssuer() *TrustedIssuer {
+	return &TrustedIssuer{}
+}
+
+// parse decodes a trusted issuer definition
+func (r *TrustedIssuer) parse(issuer string) (*TrustedIssuer, error) {
+	if issuer == "" {
+		return nil, errors.New("the trusted issuer has no options")
+	}
+
+	for _, x := range strings.Split(issuer, "|") {
+		keyPair := strings.SplitN(x, "=", 2)
+
+		if len(keyPair) != 2 {
+			return nil, errors.New(
+				"invalid trusted issuer keypair, should be " +
+					"(discovery-url|client-id|skip-client-id-check|roles-claims)=comma_values",
+			)
+		}
+
+		switch keyPair[0] {
+		case "discovery-url":
+			r.DiscoveryURL = keyPair[1]
+		case "client-id":
+			r.ClientID = keyPair[1]
+		case "skip-client-id-check":
+			val, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.SkipClientIDCheck = val
+		case "roles-claims":
+			r.RolesClaims = strings.Split(keyPair[1], ",")
+		default:
+			return nil, errors.New("invalid identifier, should be discovery-url, client-id, skip-client-id-check or roles-claims")
+		}
+	}
+
+	return r, nil
+}
+
+// valid ensures the trusted issuer is valid
+func (r *TrustedIssuer) valid() error {
+	if r.DiscoveryURL == "" {
+		return errors.New("the trusted issuer does not have a discovery url")
+	}
+
+	uri, err := url.ParseRequestURI(r.DiscoveryURL)
+
+	if err != nil || uri.Host == "" {
+		return fmt.Errorf("the discovery url %s of the trusted issuer is invalid", r.DiscoveryURL)
+	}
+
+	if r.ClientID == "" && !r.SkipClientIDCheck {
+		return fmt.Errorf(
+			"the trusted issuer %s needs a client id, or the client id check skipped",
+			r.DiscoveryURL,
+		)
+	}
+
+	for _, claim := range r.RolesClaims {
+		if claim == "" || strings.HasPrefix(claim, ".") || strings.HasSuffix(claim, ".") {
+			return fmt.Errorf("the roles claim '%s' of the trusted issuer %s is invalid", claim, r.DiscoveryURL)
+		}
+	}
+
+	return nil
+}
+
+// roles returns the roles held in the roles claims of the token, the nested claims being
+// separated by dots, i.e. resource_access.api.roles
+func (r *TrustedIssuer) roles(claims map[string]interface{}) []string {
+	roles := make([]string, 0)
+
+	for _, name := range r.RolesClaims {
+		var value interface{} = claims
+
+		for _, key := range strings.Split(name, ".") {
+			object, ok := value.(map[string]interface{})
+
+			if !ok {
+				value = nil
+				break
+			}
+
+			value = object[key]
+		}
+
+		switch value := value.(type) {
+		case string:
+			roles = append(roles, value)
+		case []interface{}:
+			for _, role := range value {
+				if role, ok := role.(string); ok {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+
+	return roles
+}
+
+// getTrustedIssuer returns the trusted issuer of the token, if any
+func (r *oauthProxy) getTrustedIssuer(user *userContext) *TrustedIssuer {
+	if len(r.issuers) == 0 {
+		return nil
+	}
+
+	issuer, _ := user.claims["iss"].(string)
+
+	return r.issuers[issuer]
+}
@@ -0,0 +1,103 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedIssuerParse(t *testing.T) {
+	issuer, err := newTrustedIssuer().parse(
+		"discovery-url=https://sso.example.com/realms/services?x=1|client-id=api|" +
+			"skip-client-id-check=true|roles-claims=roles,resource_access.api.roles",
+	)
+	require.NoError(t, err)
+	assert.Equal(
+		t,
+		&TrustedIssuer{
+			DiscoveryURL:      "https://sso.example.com/realms/services?x=1",
+			ClientID:          "api",
+			SkipClientIDCheck: true,
+			RolesClaims:       []string{"roles", "resource_access.api.roles"},
+		},
+		issuer,
+	)
+
+	for _, option := range []string{
+		"",
+		"discovery-url",
+		"unknown=bad",
+		"discovery-url=https://sso.example.com|skip-client-id-check=maybe",
+	} {
+		_, err := newTrustedIssuer().parse(option)
+		assert.Error(t, err, "%s should have failed", option)
+	}
+}
+
+func TestIsValidTrustedIssuer(t *testing.T) {
+	testCases := []struct {
+		Issuer *TrustedIssuer
+		Ok     bool
+	}{
+		{Issuer: &TrustedIssuer{DiscoveryURL: "https://sso/realms/services", ClientID: "api"}, Ok: true},
+		{Issuer: &TrustedIssuer{DiscoveryURL: "https://sso/realms/services", SkipClientIDCheck: true}, Ok: true},
+		{
+			Issuer: &TrustedIssuer{
+				DiscoveryURL: "https://sso/realms/services",
+				ClientID:     "api",
+				RolesClaims:  []string{"roles", "resource_access.api.roles"},
+			},
+			Ok: true,
+		},
+		{Issuer: &TrustedIssuer{ClientID: "api"}},
+		{Issuer: &TrustedIssuer{DiscoveryURL: "sso/realms/services", ClientID: "api"}},
+		{Issuer: &TrustedIssuer{DiscoveryURL: "https://sso/realms/services"}},
+		{Issuer: &TrustedIssuer{DiscoveryURL: "https://sso/realms/services", ClientID: "api", RolesClaims: []string{""}}},
+		{Issuer: &TrustedIssuer{DiscoveryURL: "https://sso/realms/services", ClientID: "api", RolesClaims: []string{"a."}}},
+	}
+
+	for idx, testCase := range testCases {
+		err := testCase.Issuer.valid()
+
+		if testCase.Ok {
+			assert.NoError(t, err, "case %d", idx)
+		} else {
+			assert.Error(t, err, "case %d", idx)
+		}
+	}
+}
+
+func TestTrustedIssuerRoles(t *testing.T) {
+	issuer := &TrustedIssuer{
+		RolesClaims: []string{"roles", "resource_access.api.roles", "role", "missing.roles", "role.name"},
+	}
+	claims := map[string]interface{}{
+		"roles": []interface{}{"reader", 1, "writer"},
+		"role":  "admin",
+		"resource_access": map[string]interface{}{
+			"api": map[string]interface{}{"roles": []interface{}{"api:deploy"}},
+		},
+	}
+
+	assert.Equal(t, []string{"reader", "writer", "api:deploy", "admin"}, issuer.roles(claims))
+	assert.Empty(t, (&TrustedIssuer{}).roles(claims))
+}
@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -25,6 +26,7 @@ import (
 
 	uuid "github.com/gofrs/uuid"
 	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/gogatekeeper/gatekeeper/pkg/policy"
 
 	"github.com/PuerkitoBio/purell"
 	oidc3 "github.com/coreos/go-oidc/v3/oidc"
@@ -75,6 +77,20 @@ func entrypointMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// resourceMiddleware records the protected resource the request matched in the request scope
+func resourceMiddleware(resource *Resource) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+			scope, ok := req.Context().Value(contextScopeName).(*RequestScope)
+			if ok {
+				scope.Resource = resource
+			}
+
+			next.ServeHTTP(wrt, req)
+		})
+	}
+}
+
 // requestIDMiddleware is responsible for adding a request id if none found
 func (r *oauthProxy) requestIDMiddleware(header string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -103,24 +119,24 @@ func (r *oauthProxy) loggingMiddleware(next http.Handler) http.Handler {
 
 		addr := req.RemoteAddr
 
-		if req.URL.Path == req.URL.RawPath || req.URL.RawPath == "" {
-			r.log.Info("client request",
-				zap.Duration("latency", time.Since(start)),
-				zap.Int("status", resp.Status()),
-				zap.Int("bytes", resp.BytesWritten()),
-				zap.String("client_ip", addr),
-				zap.String("method", req.Method),
-				zap.String("path", req.URL.Path))
-		} else {
-			r.log.Info("client request",
-				zap.Duration("latency", time.Since(start)),
-				zap.Int("status", resp.Status()),
-				zap.Int("bytes", resp.BytesWritten()),
-				zap.String("client_ip", addr),
-				zap.String("method", req.Method),
-				zap.String("path", req.URL.Path),
-				zap.String("raw path", req.URL.RawPath))
+		fields := []zapcore.Field{
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("status", resp.Status()),
+			zap.Int("bytes", resp.BytesWritten()),
+			zap.String("client_ip", addr),
+			zap.String("method", req.Method),
+			zap.String("path", req.URL.Path),
 		}
+
+		if req.URL.Path != req.URL.RawPath && req.URL.RawPath != "" {
+			fields = append(fields, zap.String("raw path", req.URL.RawPath))
+		}
+
+		if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok && scope.AuthzDecision != nil {
+			fields = append(fields, authzDecisionFields(scope.AuthzDecision)...)
+		}
+
+		r.log.Info("client request", fields...)
 	})
 }
 
@@ -130,9 +146,31 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
 			clientIP := req.RemoteAddr
+			scope := req.Context().Value(contextScopeName).(*RequestScope)
+
+			// step: the tokens of the resources requiring it are introspected on every request, the
+			// introspection of the others being cached when it is enabled globally
+			introspectAlways := scope.Resource != nil && scope.Resource.Introspect
+			introspect := r.config.EnableTokenIntrospection || introspectAlways
+
+			var user *userContext
+			var err error
 
 			// grab the user identity from the request
-			user, err := r.getIdentity(req)
+			if introspect {
+				user, err = r.getIntrospectedIdentity(req, !introspectAlways)
+			} else {
+				user, err = r.getIdentity(req)
+			}
+
+			// step: the requests without token are authenticated by their verified client certificate, if any
+			fromCertificate := false
+
+			if err == apperrors.ErrSessionNotFound {
+				if certUser := r.getClientCertIdentity(req); certUser != nil {
+					user, err, fromCertificate = certUser, nil, true
+				}
+			}
 
 			if err != nil {
 				r.log.Error(
@@ -145,7 +183,6 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 			}
 
 			// create the request scope
-			scope := req.Context().Value(contextScopeName).(*RequestScope)
 			scope.Identity = user
 			ctx := context.WithValue(req.Context(), contextScopeName, scope)
 
@@ -168,7 +205,20 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 					next.ServeHTTP(wrt, req.WithContext(r.redirectToAuthorization(wrt, req)))
 					return
 				}
-			} else { //nolint:gocritic
+			} else if introspect && !fromCertificate {
+				// step: an active token is not necessarily one issued for the proxy
+				if !r.config.SkipAccessTokenClientIDCheck && !user.isIssuedFor(r.config.ClientID) {
+					r.log.Error(
+						"the introspected access token was not issued for the client",
+						zap.String("client_ip", clientIP),
+						zap.String("sub", user.id),
+						zap.Strings("audiences", user.audiences),
+					)
+
+					next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+					return
+				}
+			} else if !fromCertificate { //nolint:gocritic
 				verifier := r.provider.Verifier(
 					&oidc3.Config{
 						ClientID:          r.config.ClientID,
@@ -177,6 +227,19 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 					},
 				)
 
+				// step: the tokens of the trusted issuers are verified by their own provider
+				issuer := r.getTrustedIssuer(user)
+
+				if issuer != nil {
+					verifier = issuer.verifier
+
+					// @note: the roles claims of the issuer replace the keycloak realm and resource
+					// roles, so the issuer can not hand out the roles of the discovery url
+					if len(issuer.RolesClaims) > 0 {
+						user.roles = issuer.roles(user.claims)
+					}
+				}
+
 				_, err := verifier.Verify(context.Background(), user.rawToken)
 
 				if err != nil {
@@ -194,6 +257,20 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 						return
 					}
 
+					// step: the tokens of the trusted issuers can not be refreshed here
+					if issuer != nil {
+						r.log.Error(
+							"the access token of the trusted issuer has expired",
+							zap.String("client_ip", clientIP),
+							zap.String("issuer", issuer.issuer),
+							zap.String("sub", user.id),
+							zap.String("expired_on", user.expiresAt.String()),
+						)
+
+						next.ServeHTTP(wrt, req.WithContext(r.redirectToAuthorization(wrt, req)))
+						return
+					}
+
 					// step: check if we are refreshing the access tokens and if not re-auth
 					if !r.config.EnableRefreshTokens {
 						r.log.Error(
@@ -311,6 +388,34 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 						zap.Duration("expires_in", accessExpiresIn),
 					)
 
+					// step: the server side session is updated in place, the session cookie stays the same
+					if r.config.EnableServerSideSessions && !user.bearerToken {
+						err := r.refreshSession(
+							req,
+							wrt,
+							newRawAccToken,
+							newRefreshToken,
+							accessExpiresAt,
+							refreshExpiresIn,
+						)
+
+						if err != nil {
+							r.log.Error(
+								"failed to update the session in the store",
+								zap.Error(err),
+								zap.String("email", user.email),
+								zap.String("sub", user.id),
+							)
+
+							wrt.WriteHeader(http.StatusInternalServerError)
+							return
+						}
+
+						user.rawToken = newRawAccToken
+						next.ServeHTTP(wrt, req.WithContext(ctx))
+						return
+					}
+
 					accessToken := newRawAccToken
 
 					if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie {
@@ -353,12 +458,13 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 						}
 
 						if r.useStore() {
+							// @note: the request may complete first, so these are only bounded by the store timeout
 							go func(old, new string, encrypted string) {
-								if err := r.DeleteRefreshToken(old); err != nil {
+								if err := r.DeleteRefreshToken(context.Background(), old); err != nil {
 									r.log.Error("failed to remove old token", zap.Error(err))
 								}
 
-								if err := r.StoreRefreshToken(new, encrypted, refreshExpiresIn); err != nil {
+								if err := r.StoreRefreshToken(context.Background(), new, encrypted, refreshExpiresIn); err != nil {
 									r.log.Error("failed to store refresh token", zap.Error(err))
 									return
 								}
@@ -381,7 +487,7 @@ func (r *oauthProxy) authenticationMiddleware() func(http.Handler) http.Handler
 
 // authorizationMiddleware is responsible for verifying permissions in access_token
 // nolint:funlen
-func (r *oauthProxy) authorizationMiddleware() func(http.Handler) http.Handler {
+func (r *oauthProxy) authorizationMiddleware(resource *Resource) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
 			scope := req.Context().Value(contextScopeName).(*RequestScope)
@@ -392,43 +498,77 @@ func (r *oauthProxy) authorizationMiddleware() func(http.Handler) http.Handler {
 			}
 
 			user := scope.Identity
+			umaScope := r.getUmaScope(resource, req.Method)
 			noAuthz := false
 
-			var decision authorization.AuthzDecision
+			key := &authzKey{
+				subject: user.id,
+				token:   user.rawToken,
+				method:  req.Method,
+				host:    req.Host,
+				path:    req.URL.Path,
+			}
+
+			if umaScope != "" {
+				key.scopes = []string{umaScope}
+			}
+
+			// @note: the policy endpoint is given the query and headers, so it may decide on them
+			if r.config.EnableHTTPAuthz {
+				key.query = req.URL.RawQuery
+				key.headers = authorization.NewHTTPAuthorizationHeaders(req, r.config.HTTPAuthzHeaders)
+			}
+
+			var decision *authorization.Decision
 			var err error
 
 			if r.useStore() {
-				decision, err = r.GetAuthz(user.rawToken, req.URL)
+				decision, err = r.GetAuthz(req.Context(), key)
 				noAuthz = err == apperrors.ErrNoAuthzFound
 			}
 
 			if !r.useStore() || noAuthz {
-				r.pat.m.Lock()
-				token := r.pat.Token.AccessToken
-				r.pat.m.Unlock()
-
-				provider := authorization.KeycloakAuthorizationProvider{}
-				decision, err = provider.Authorize(
-					user.permissions,
-					req,
-					r.idpClient,
-					r.config.OpenIDProviderTimeout,
-					token,
-					r.config.Realm,
+				decision, err = r.getAuthzProvider(req, user, umaScope).Authorize()
+				decision.CacheStatus = authorization.CacheNone
+
+				if noAuthz {
+					decision.CacheStatus = authorization.CacheMiss
+				}
+			}
+
+			if decision != nil {
+				scope.AuthzDecision = decision
+
+				if r.config.Verbose {
+					wrt.Header().Set(authzDecisionReasonHeader, decision.Reason)
+				}
+			}
+
+			shadow := r.isShadowed(resource)
+
+			if errors.Is(err, apperrors.ErrExternalAuthzRequest) {
+				r.log.Error(
+					"problem getting authz decision from the policy endpoint",
+					zap.Error(err),
 				)
+
+				if shadow {
+					r.shadowDenial(req, user, resource, shadowReasonAuthz)
+					next.ServeHTTP(wrt, req)
+					return
+				}
+
+				next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+				return
 			}
 
+			// @note: the denials are logged along with their reason below
 			switch err {
-			case apperrors.ErrPermissionNotInToken:
-				r.log.Info(apperrors.ErrPermissionNotInToken.Error())
-			case apperrors.ErrResourceRetrieve:
-				r.log.Info(apperrors.ErrResourceRetrieve.Error())
-			case apperrors.ErrNoIDPResourceForPath:
-				r.log.Info(apperrors.ErrNoIDPResourceForPath.Error())
-			case apperrors.ErrResourceIDNotPresent:
-				r.log.Info(apperrors.ErrResourceIDNotPresent.Error())
-			case apperrors.ErrTokenScopeNotMatchResourceScope:
-				r.log.Info(apperrors.ErrTokenScopeNotMatchResourceScope.Error())
+			case apperrors.ErrPermissionNotInToken,
+				apperrors.ErrResourceRetrieve,
+				apperrors.ErrNoIDPResourceForPath,
+				apperrors.ErrResourceIDNotPresent,
+				apperrors.ErrTokenScopeNotMatchResourceScope:
 			case apperrors.ErrNoAuthzFound:
 			default:
 				if err != nil {
@@ -436,6 +576,13 @@ func (r *oauthProxy) authorizationMiddleware() func(http.Handler) http.Handler {
 						"Undexpected error during authorization",
 						zap.Error(err),
 					)
+
+					if shadow {
+						r.shadowDenial(req, user, resource, shadowReasonAuthz)
+						next.ServeHTTP(wrt, req)
+						return
+					}
+
 					next.ServeHTTP(wrt, req.WithContext(r.revokeProxy(wrt, req)))
 					return
 				}
@@ -443,10 +590,10 @@ func (r *oauthProxy) authorizationMiddleware() func(http.Handler) http.Handler {
 
 			if noAuthz {
 				err := r.StoreAuthz(
-					user.rawToken,
-					req.URL,
+					req.Context(),
+					key,
 					decision,
-					time.Until(user.expiresAt),
+					r.getAuthzExpiration(decision.Result, user.expiresAt),
 				)
 
 				if err != nil {
@@ -457,14 +604,30 @@ func (r *oauthProxy) authorizationMiddleware() func(http.Handler) http.Handler {
 				}
 			}
 
-			if decision == authorization.DeniedAuthz {
-				if !noAuthz {
-					r.log.Debug(
-						"authz denied from cache",
-						zap.String("user", user.name),
-						zap.String("path", req.URL.Path),
-					)
+			if decision.Result == authorization.DeniedAuthz {
+				r.log.Info(
+					"authz denied",
+					append(
+						[]zapcore.Field{
+							r.accessDeniedField(resource),
+							zap.String("user", user.name),
+							zap.String("path", req.URL.Path),
+						},
+						authzDecisionFields(decision)...,
+					)...,
+				)
+
+				if shadow {
+					r.shadowDenial(req, user, resource, shadowReasonAuthz)
+					next.ServeHTTP(wrt, req)
+					return
+				}
+
+				if r.config.EnableHTTPAuthz {
+					next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+					return
 				}
+
 				next.ServeHTTP(wrt, req.WithContext(r.redirectToAuthorization(wrt, req)))
 				return
 			}
@@ -474,13 +637,94 @@ func (r *oauthProxy) authorizationMiddleware() func(http.Handler) http.Handler {
 	}
 }
 
+// authzDecisionFields are the log fields explaining the authz decision
+func authzDecisionFields(decision *authorization.Decision) []zapcore.Field {
+	return []zapcore.Field{
+		zap.Bool("authz_allowed", decision.Result == authorization.AllowedAuthz),
+		zap.String("authz_reason", decision.Reason),
+		zap.String("authz_resource", decision.ResourceID),
+		zap.Strings("authz_granted_scopes", decision.GrantedScopes),
+		zap.Strings("authz_required_scopes", decision.RequiredScopes),
+		zap.String("authz_cache", string(decision.CacheStatus)),
+	}
+}
+
+// insufficientScope tells the bearer clients which scopes the resource requires, as per rfc 6750
+func (r *oauthProxy) insufficientScope(wrt http.ResponseWriter, user *userContext, resource *Resource) {
+	if !user.bearerToken {
+		return
+	}
+
+	wrt.Header().Set(
+		"WWW-Authenticate",
+		fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(resource.Scopes, " ")),
+	)
+}
+
+// isShadowed checks whether the denials on the resource are only recorded, not enforced
+func (r *oauthProxy) isShadowed(resource *Resource) bool {
+	return r.config.EnableShadowMode || resource.Shadow
+}
+
+// accessDeniedField is the access log field of a denial, telling apart the shadowed ones
+func (r *oauthProxy) accessDeniedField(resource *Resource) zapcore.Field {
+	if r.isShadowed(resource) {
+		return zap.String("access", "shadow-denied")
+	}
+
+	return zap.String("access", "denied")
+}
+
+// shadowDenial records a denial on a resource in shadow mode, the request is let through
+func (r *oauthProxy) shadowDenial(req *http.Request, user *userContext, resource *Resource, reason string) {
+	shadowDenialsMetric.WithLabelValues(resource.URL, reason).Inc()
+
+	r.log.Warn("shadow mode, the request would have been denied",
+		zap.String("email", user.email),
+		zap.String("resource", resource.URL),
+		zap.String("method", req.Method),
+		zap.String("path", req.URL.Path),
+		zap.String("reason", reason))
+}
+
+// checkPolicy evaluates the policy of the resource against the request and the identity
+func (r *oauthProxy) checkPolicy(req *http.Request, user *userContext, resource *Resource) bool {
+	allowed, err := resource.compiledPolicy.Evaluate(&policy.Input{
+		Claims:  user.claims,
+		Roles:   user.roles,
+		Groups:  user.groups,
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Headers: req.Header,
+		IP:      realIP(req),
+	})
+
+	fields := []zapcore.Field{
+		r.accessDeniedField(resource),
+		zap.String("email", user.email),
+		zap.String("resource", resource.URL),
+		zap.String("policy", resource.Policy),
+	}
+
+	if err != nil {
+		r.log.Warn("access denied, failed to evaluate the policy", append(fields, zap.Error(err))...)
+		return false
+	}
+
+	if !allowed {
+		r.log.Warn("access denied, the policy does not hold", fields...)
+	}
+
+	return allowed
+}
+
 // checkClaim checks whether claim in userContext matches claimName, match. It can be String or Strings claim.
-func (r *oauthProxy) checkClaim(user *userContext, claimName string, match *regexp.Regexp, resourceURL string) bool {
+func (r *oauthProxy) checkClaim(user *userContext, claimName string, match *regexp.Regexp, resource *Resource) bool {
 	errFields := []zapcore.Field{
 		zap.String("claim", claimName),
-		zap.String("access", "denied"),
+		r.accessDeniedField(resource),
 		zap.String("email", user.email),
-		zap.String("resource", resourceURL),
+		zap.String("resource", resource.URL),
 	}
 
 	if _, found := user.claims[claimName]; !found {
@@ -559,6 +803,11 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 		claimMatches[k] = regexp.MustCompile(v)
 	}
 
+	// @note: the claims of the resource come on top of the global ones, overriding them
+	for k, v := range resource.MatchClaims {
+		claimMatches[k] = regexp.MustCompile(v)
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
 			// we don't need to continue is a decision has been made
@@ -571,36 +820,78 @@ func (r *oauthProxy) admissionMiddleware(resource *Resource) func(http.Handler)
 
 			user := scope.Identity
 
+			// @note: in shadow mode all the checks are evaluated and the denials only recorded
+			shadow := r.isShadowed(resource)
+
 			// @step: we need to check the roles
 			if !hasAccess(resource.Roles, user.roles, !resource.RequireAnyRole) {
 				r.log.Warn("access denied, invalid roles",
-					zap.String("access", "denied"),
+					r.accessDeniedField(resource),
 					zap.String("email", user.email),
 					zap.String("resource", resource.URL),
 					zap.String("roles", resource.getRoles()))
 
-				next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
-				return
+				if !shadow {
+					next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+					return
+				}
+
+				r.shadowDenial(req, user, resource, shadowReasonRoles)
 			}
 
 			// @step: check if we have any groups, the groups are there
 			if !hasAccess(resource.Groups, user.groups, false) {
 				r.log.Warn("access denied, invalid groups",
-					zap.String("access", "denied"),
+					r.accessDeniedField(resource),
 					zap.String("email", user.email),
 					zap.String("resource", resource.URL),
 					zap.String("groups", strings.Join(resource.Groups, ",")))
 
-				next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
-				return
+				if !shadow {
+					next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+					return
+				}
+
+				r.shadowDenial(req, user, resource, shadowReasonGroups)
+			}
+
+			// @step: check the token holds the oauth scopes of the resource
+			if !hasAccess(resource.Scopes, user.scopes, !resource.RequireAnyScope) {
+				r.log.Warn("access denied, insufficient scopes",
+					r.accessDeniedField(resource),
+					zap.String("email", user.email),
+					zap.String("resource", resource.URL),
+					zap.String("scopes", strings.Join(resource.Scopes, ",")))
+
+				if !shadow {
+					r.insufficientScope(wrt, user, resource)
+					next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+					return
+				}
+
+				r.shadowDenial(req, user, resource, shadowReasonScopes)
 			}
 
 			// step: if we have any claim matching, lets validate the tokens has the claims
 			for claimName, match := range claimMatches {
-				if !r.checkClaim(user, claimName, match, resource.URL) {
+				if !r.checkClaim(user, claimName, match, resource) {
+					if !shadow {
+						next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
+						return
+					}
+
+					r.shadowDenial(req, user, resource, shadowReasonClaims)
+				}
+			}
+
+			// @step: check the policy of the resource holds
+			if resource.compiledPolicy != nil && !r.checkPolicy(req, user, resource) {
+				if !shadow {
 					next.ServeHTTP(wrt, req.WithContext(r.accessForbidden(wrt, req)))
 					return
 				}
+
+				r.shadowDenial(req, user, resource, shadowReasonPolicy)
 			}
 
 			r.log.Debug("access permitted to resource",
@@ -663,13 +954,18 @@ func (r *oauthProxy) identityHeadersMiddleware(custom []string) func(http.Handle
 				req.Header.Set("X-Auth-Username", user.name)
 
 				// should we add the token header?
-				if r.config.EnableTokenHeader {
+				if r.config.EnableTokenHeader && user.rawToken != "" {
 					req.Header.Set("X-Auth-Token", user.rawToken)
 				}
-				// add the authorization header if requested
-				if r.config.EnableAuthorizationHeader {
+				// add the authorization header if requested, the client certificate identities have no token
+				if r.config.EnableAuthorizationHeader && user.rawToken != "" {
 					req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.rawToken))
 				}
+				// step: without a token, the token headers could only have been forged by the caller
+				if user.rawToken == "" {
+					req.Header.Del("X-Auth-Token")
+					req.Header.Del("Authorization")
+				}
 				// are we filtering out the cookies
 				if !r.config.EnableAuthorizationCookies {
 					_ = filterCookies(req, cookieFilter)
@@ -19,19 +19,24 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	resty "github.com/go-resty/resty/v2"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
 	"github.com/gogatekeeper/gatekeeper/pkg/storage"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/cors"
 	"github.com/stretchr/testify/assert"
 
@@ -823,259 +828,727 @@ func TestGroupPermissionsMiddleware(t *testing.T) {
 	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
 }
 
-func TestRolePermissionsMiddleware(t *testing.T) {
+func TestPolicyMiddleware(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.Resources = []*Resource{
 		{
-			URL:     "/admin*",
+			URL:     "/tenants/*",
 			Methods: allHTTPMethods,
-			Roles:   []string{fakeAdminRole},
-		},
-		{
-			URL:     "/test*",
-			Methods: []string{"GET"},
-			Roles:   []string{fakeTestRole},
+			Policy:  "claims.item == path.segment(2) || 'admin' in roles",
 		},
 		{
-			URL:     "/test_admin_role*",
-			Methods: []string{"GET"},
-			Roles:   []string{fakeAdminRole, fakeTestRole},
+			URL:     "/corp*",
+			Methods: allHTTPMethods,
+			Policy:  "claims.email.endsWith('@corp.com') || 'finance' in groups",
 		},
 		{
-			URL:     "/section/*",
+			URL:     "/internal*",
 			Methods: allHTTPMethods,
-			Roles:   []string{fakeAdminRole},
+			Policy:  "ip.inCIDR('10.0.0.0/8') && headers['X-Internal'] == 'true' && method == 'GET'",
 		},
 		{
-			URL:     "/section/one",
+			URL:     "/broken*",
 			Methods: allHTTPMethods,
-			Roles:   []string{"one"},
+			Policy:  "claims.item > 1",
 		},
 		{
-			URL:     "/whitelist",
-			Methods: []string{"GET"},
-			Roles:   []string{},
+			URL:     "/segments*",
+			Methods: allHTTPMethods,
+			Policy:  "claims.missing == path.segment(3)",
 		},
 		{
-			URL:     "/*",
+			URL:     "/excluded/*",
 			Methods: allHTTPMethods,
-			Roles:   []string{fakeTestRole},
+			Policy:  "claims.missing != path.segment(2)",
 		},
 	}
 	requests := []fakeRequest{
 		{
-			URI:          "/",
+			URI:          "/tenants/item/orders",
 			ExpectedCode: http.StatusUnauthorized,
 		},
-		{ // check for redirect
-			URI:          "/",
-			Redirects:    true,
-			ExpectedCode: http.StatusSeeOther,
+		{
+			URI:           "/tenants/item/orders",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
 		},
-		{ // check with a token but not test role
-			URI:          "/",
-			Redirects:    false,
+		{
+			URI:          "/tenants/other/orders",
 			HasToken:     true,
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // check with a token and wrong roles
-			URI:          "/",
-			Redirects:    false,
-			HasToken:     true,
-			Roles:        []string{"one", "two"},
-			ExpectedCode: http.StatusForbidden,
+		{
+			URI:           "/tenants/other/orders",
+			HasToken:      true,
+			Roles:         []string{"admin"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
 		},
-		{ // token, wrong roles
-			URI:          "/test",
-			Redirects:    false,
+		{
+			URI:          "/corp/test",
 			HasToken:     true,
-			Roles:        []string{"bad_role"},
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // token, but post method
-			URI:           "/test",
-			Method:        http.MethodPost,
-			Redirects:     false,
+		{
+			URI:           "/corp/test",
 			HasToken:      true,
-			Roles:         []string{fakeTestRole},
-			ExpectedCode:  http.StatusOK,
+			TokenClaims:   map[string]interface{}{"email": "jdoe@corp.com"},
 			ExpectedProxy: true,
-		},
-		{ // check with correct token
-			URI:           "/test",
-			Redirects:     false,
-			HasToken:      true,
-			Roles:         []string{fakeTestRole},
 			ExpectedCode:  http.StatusOK,
-			ExpectedProxy: true,
 		},
-		{ // check with correct token on base
-			URI:           "/",
-			Redirects:     false,
+		{
+			URI:           "/corp/test",
 			HasToken:      true,
-			Roles:         []string{fakeTestRole},
+			Groups:        []string{"finance"},
+			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:      "/internal/test",
+			HasToken: true,
+			Headers: map[string]string{
+				"X-Forwarded-For": "10.1.2.3",
+				"X-Internal":      "true",
+			},
 			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
 		},
-		{ // check with correct token, not signed
-			URI:          "/",
-			Redirects:    false,
-			HasToken:     true,
-			NotSigned:    true,
-			Roles:        []string{fakeTestRole},
-			ExpectedCode: http.StatusUnauthorized,
+		{
+			URI:      "/internal/test",
+			Method:   http.MethodPost,
+			HasToken: true,
+			Headers: map[string]string{
+				"X-Forwarded-For": "10.1.2.3",
+				"X-Internal":      "true",
+			},
+			ExpectedCode: http.StatusForbidden,
 		},
-		{ // check with correct token, signed
-			URI:          "/admin/page",
-			Method:       http.MethodPost,
-			Redirects:    false,
+		{
+			URI:          "/internal/test",
 			HasToken:     true,
-			Roles:        []string{fakeTestRole},
+			Headers:      map[string]string{"X-Internal": "true"},
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // check with correct token, signed, wrong roles (10)
-			URI:          "/admin/page",
-			Redirects:    false,
+		{
+			URI:          "/broken/test",
 			HasToken:     true,
-			Roles:        []string{fakeTestRole},
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // check with correct token, signed, wrong roles
-			URI:           "/admin/page",
-			Redirects:     false,
-			HasToken:      true,
-			Roles:         []string{fakeTestRole, fakeAdminRole},
-			ExpectedCode:  http.StatusOK,
-			ExpectedProxy: true,
-		},
-		{ // strange url
-			URI:          "/admin/..//admin/page",
-			Redirects:    false,
-			ExpectedCode: http.StatusUnauthorized,
-		},
-		{ // strange url, token
-			URI:          "/admin/../admin",
-			Redirects:    false,
+		{
+			URI:          "/segments",
 			HasToken:     true,
-			Roles:        []string{"hehe"},
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // strange url, token
-			URI:          "/test/../admin",
-			Redirects:    false,
+		{
+			URI:          "/excluded/item",
 			HasToken:     true,
 			ExpectedCode: http.StatusForbidden,
 		},
-		{ // strange url, token, role (15)
-			URI:           "/test/../admin",
-			Redirects:     false,
-			HasToken:      true,
-			Roles:         []string{fakeAdminRole},
-			ExpectedCode:  http.StatusOK,
-			ExpectedProxy: true,
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestResourceScopes(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/orders*",
+			Methods: allHTTPMethods,
+			Scopes:  []string{"orders:read", "orders:write"},
 		},
-		{ // strange url, token, but good token
-			URI:           "/test/../admin",
-			Redirects:     false,
+		{
+			URL:             "/reports*",
+			Methods:         allHTTPMethods,
+			Scopes:          []string{"reports:read", "reports:admin"},
+			RequireAnyScope: true,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/orders/1",
 			HasToken:      true,
-			Roles:         []string{fakeAdminRole},
-			ExpectedCode:  http.StatusOK,
+			TokenClaims:   map[string]interface{}{"scope": "openid orders:read orders:write"},
 			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
 		},
-		{ // strange url, token, wrong roles
-			URI:          "/test/../admin",
-			Redirects:    false,
+		{
+			URI:          "/orders/1",
 			HasToken:     true,
-			Roles:        []string{fakeTestRole},
+			TokenClaims:  map[string]interface{}{"scope": "openid orders:read"},
 			ExpectedCode: http.StatusForbidden,
+			ExpectedHeaders: map[string]string{
+				"WWW-Authenticate": `Bearer error="insufficient_scope", scope="orders:read orders:write"`,
+			},
 		},
-		{ // check with a token admin test role
-			URI:          "/test_admin_role",
-			Redirects:    false,
+		{
+			URI:          "/orders/1",
 			HasToken:     true,
 			ExpectedCode: http.StatusForbidden,
+			ExpectedHeaders: map[string]string{
+				"WWW-Authenticate": `Bearer error="insufficient_scope", scope="orders:read orders:write"`,
+			},
 		},
-		{ // check with a token but without both roles
-			URI:          "/test_admin_role",
-			Redirects:    false,
-			HasToken:     true,
-			ExpectedCode: http.StatusForbidden,
-			Roles:        []string{fakeAdminRole},
+		// the challenge is only meant for the bearer clients
+		{
+			URI:            "/orders/1",
+			HasToken:       true,
+			HasCookieToken: true,
+			ExpectedCode:   http.StatusForbidden,
+			OnResponse: func(_ int, _ *resty.Request, resp *resty.Response) {
+				assert.Empty(t, resp.Header().Get("WWW-Authenticate"))
+			},
 		},
-		{ // check with a token with both roles (20)
-			URI:           "/test_admin_role",
-			Redirects:     false,
+		{
+			URI:           "/reports/1",
 			HasToken:      true,
-			Roles:         []string{fakeAdminRole, fakeTestRole},
-			ExpectedCode:  http.StatusOK,
+			TokenClaims:   map[string]interface{}{"scope": "reports:read"},
 			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
 		},
 		{
-			URI:          "/section/test1",
-			Redirects:    false,
+			URI:          "/reports/1",
 			HasToken:     true,
-			Roles:        []string{},
+			TokenClaims:  map[string]interface{}{"scope": "orders:read"},
 			ExpectedCode: http.StatusForbidden,
 		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestResourceMatchClaims(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.MatchClaims = map[string]string{"email": "@gmail.com$"}
+	cfg.Resources = []*Resource{
+		{
+			URL:         "/billing*",
+			Methods:     allHTTPMethods,
+			MatchClaims: map[string]string{"item": "^billing$"},
+		},
 		{
-			URI:           "/section/test",
-			Redirects:     false,
+			URL:         "/acme*",
+			Methods:     allHTTPMethods,
+			MatchClaims: map[string]string{"email": "@acme.com$"},
+		},
+		{
+			URL:     "/other*",
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		// the claims of the resource come on top of the global ones
+		{
+			URI:          "/billing/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/billing/test",
 			HasToken:      true,
-			Roles:         []string{fakeTestRole, fakeAdminRole},
-			ExpectedCode:  http.StatusOK,
+			TokenClaims:   map[string]interface{}{"item": "billing"},
 			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
 		},
 		{
-			URI:          "/section/one",
-			Redirects:    false,
+			URI:          "/billing/test",
 			HasToken:     true,
-			Roles:        []string{fakeTestRole, fakeAdminRole},
+			TokenClaims:  map[string]interface{}{"item": "billing", "email": "jdoe@acme.com"},
 			ExpectedCode: http.StatusForbidden,
 		},
+		// the claims of the resource override the global ones
 		{
-			URI:           "/section/one",
-			Redirects:     false,
+			URI:          "/acme/test",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/acme/test",
 			HasToken:      true,
-			Roles:         []string{"one"},
+			TokenClaims:   map[string]interface{}{"email": "jdoe@acme.com"},
+			ExpectedProxy: true,
 			ExpectedCode:  http.StatusOK,
+		},
+		// the claims of a resource do not apply to the others
+		{
+			URI:           "/other/test",
+			HasToken:      true,
 			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/other/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"email": "jdoe@acme.com"},
+			ExpectedCode: http.StatusForbidden,
 		},
 	}
 	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
 }
 
-func TestCrossSiteHandler(t *testing.T) {
-	cases := []struct {
-		Cors    cors.Options
-		Request fakeRequest
-	}{
+func TestTrustedIssuers(t *testing.T) {
+	services := newFakeAuthServer(&fakeAuthConfig{})
+	cfg := newFakeKeycloakConfig()
+	cfg.TrustedIssuers = []*TrustedIssuer{
 		{
-			Cors: cors.Options{
-				AllowedOrigins: []string{"*"},
-			},
-			Request: fakeRequest{
-				URI: fakeAuthAllURL,
-				Headers: map[string]string{
-					"Origin": "127.0.0.1",
-				},
-				ExpectedHeaders: map[string]string{
-					"Access-Control-Allow-Origin": "*",
-				},
-			},
+			DiscoveryURL: services.getLocation(),
+			ClientID:     "test",
+			RolesClaims:  []string{"item1"},
 		},
+	}
+	cfg.Resources = []*Resource{
 		{
-			Cors: cors.Options{
-				AllowedOrigins: []string{"*", "https://examples.com"},
-			},
-			Request: fakeRequest{
-				URI: fakeAuthAllURL,
-				Headers: map[string]string{
-					"Origin": "127.0.0.1",
-				},
-				ExpectedHeaders: map[string]string{
-					"Access-Control-Allow-Origin": "*",
-				},
-			},
+			URL:     "/admin*",
+			Methods: allHTTPMethods,
+			Roles:   []string{"machine"},
+		},
+	}
+	requests := []fakeRequest{
+		// the tokens of the trusted issuer are verified by its provider, with its roles claims
+		{
+			URI:           "/admin/test",
+			HasToken:      true,
+			TokenClaims:   map[string]interface{}{"iss": services.getLocation(), "item1": []string{"machine"}},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"iss": services.getLocation()},
+			ExpectedCode: http.StatusForbidden,
+		},
+		// the keycloak roles of the trusted issuer are replaced by its roles claims
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"iss": services.getLocation()},
+			Roles:        []string{"machine"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"iss": services.getLocation(), "item1": []string{"machine"}, "aud": "other"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"iss": services.getLocation(), "item1": []string{"machine"}},
+			Expires:      -time.Hour,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		// the issuers which are not trusted are still rejected
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"iss": "https://sso.example.com/realms/other", "item1": []string{"machine"}},
+			Roles:        []string{"machine"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		// the tokens of the discovery url are left as they are
+		{
+			URI:           "/admin/test",
+			HasToken:      true,
+			Roles:         []string{"machine"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/test",
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"item1": []string{"machine"}},
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestShadowMode(t *testing.T) {
+	shadowDenials := func(resource, reason string) float64 {
+		return testutil.ToFloat64(shadowDenialsMetric.WithLabelValues(resource, reason))
+	}
+
+	// @note: the expected denials are counted from when the requests are defined
+	expectShadowDenials := func(resource string, expected map[string]float64) func(int, *resty.Request, *resty.Response) {
+		initial := make(map[string]float64)
+		for reason := range expected {
+			initial[reason] = shadowDenials(resource, reason)
+		}
+
+		return func(int, *resty.Request, *resty.Response) {
+			for reason, count := range expected {
+				assert.Equal(t, initial[reason]+count, shadowDenials(resource, reason), "%s %s", resource, reason)
+			}
+		}
+	}
+
+	t.Run("TestShadowResource", func(t *testing.T) {
+		cfg := newFakeKeycloakConfig()
+		cfg.Resources = []*Resource{
+			{
+				URL:     "/shadow*",
+				Methods: allHTTPMethods,
+				Roles:   []string{"admin"},
+				Groups:  []string{"staff"},
+				Shadow:  true,
+			},
+			{
+				URL:     "/enforced*",
+				Methods: allHTTPMethods,
+				Roles:   []string{"admin"},
+			},
+		}
+
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{
+			// the authentication is still enforced
+			{
+				URI:          "/shadow/test",
+				ExpectedCode: http.StatusUnauthorized,
+			},
+			// every failing check is recorded
+			{
+				URI:           "/shadow/test",
+				HasToken:      true,
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+				OnResponse: expectShadowDenials("/shadow*", map[string]float64{
+					shadowReasonRoles:  1,
+					shadowReasonGroups: 1,
+				}),
+			},
+			{
+				URI:           "/shadow/test",
+				HasToken:      true,
+				Roles:         []string{"admin"},
+				Groups:        []string{"staff"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+				OnResponse:    expectShadowDenials("/shadow*", map[string]float64{shadowReasonRoles: 1}),
+			},
+			{
+				URI:          "/enforced/test",
+				HasToken:     true,
+				ExpectedCode: http.StatusForbidden,
+				OnResponse:   expectShadowDenials("/enforced*", map[string]float64{shadowReasonRoles: 0}),
+			},
+		})
+	})
+
+	t.Run("TestShadowModeGlobal", func(t *testing.T) {
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableShadowMode = true
+		cfg.MatchClaims = map[string]string{"item": "^other$"}
+		cfg.Resources = []*Resource{
+			{
+				URL:     "/policy*",
+				Methods: allHTTPMethods,
+				Policy:  "'admin' in roles",
+			},
+		}
+
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{
+			{
+				URI:           "/policy/test",
+				HasToken:      true,
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+				OnResponse: expectShadowDenials("/policy*", map[string]float64{
+					shadowReasonClaims: 1,
+					shadowReasonPolicy: 1,
+				}),
+			},
+		})
+	})
+
+	t.Run("TestShadowModeAuthz", func(t *testing.T) {
+		var policyRequests int32
+
+		policyServer := newFakePolicyServer(t, &policyRequests)
+		defer policyServer.Close()
+
+		cfg := newFakeKeycloakConfig()
+		cfg.EnableShadowMode = true
+		cfg.EnableHTTPAuthz = true
+		cfg.EnableDefaultDeny = true
+		cfg.HTTPAuthzURL = policyServer.URL
+		cfg.HTTPAuthzTimeout = time.Second
+
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{
+			{
+				URI:           "/test",
+				Method:        http.MethodDelete,
+				HasToken:      true,
+				Roles:         []string{"admin"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+				OnResponse:    expectShadowDenials(allPath, map[string]float64{shadowReasonAuthz: 1}),
+			},
+			{
+				URI:           "/test",
+				HasToken:      true,
+				Roles:         []string{"admin"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+				OnResponse:    expectShadowDenials(allPath, map[string]float64{shadowReasonAuthz: 1}),
+			},
+		})
+	})
+}
+
+func TestRolePermissionsMiddleware(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:     "/test*",
+			Methods: []string{"GET"},
+			Roles:   []string{fakeTestRole},
+		},
+		{
+			URL:     "/test_admin_role*",
+			Methods: []string{"GET"},
+			Roles:   []string{fakeAdminRole, fakeTestRole},
+		},
+		{
+			URL:     "/section/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:     "/section/one",
+			Methods: allHTTPMethods,
+			Roles:   []string{"one"},
+		},
+		{
+			URL:     "/whitelist",
+			Methods: []string{"GET"},
+			Roles:   []string{},
+		},
+		{
+			URL:     "/*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeTestRole},
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:          "/",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{ // check for redirect
+			URI:          "/",
+			Redirects:    true,
+			ExpectedCode: http.StatusSeeOther,
+		},
+		{ // check with a token but not test role
+			URI:          "/",
+			Redirects:    false,
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // check with a token and wrong roles
+			URI:          "/",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{"one", "two"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // token, wrong roles
+			URI:          "/test",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{"bad_role"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // token, but post method
+			URI:           "/test",
+			Method:        http.MethodPost,
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // check with correct token
+			URI:           "/test",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // check with correct token on base
+			URI:           "/",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // check with correct token, not signed
+			URI:          "/",
+			Redirects:    false,
+			HasToken:     true,
+			NotSigned:    true,
+			Roles:        []string{fakeTestRole},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{ // check with correct token, signed
+			URI:          "/admin/page",
+			Method:       http.MethodPost,
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{fakeTestRole},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // check with correct token, signed, wrong roles (10)
+			URI:          "/admin/page",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{fakeTestRole},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // check with correct token, signed, wrong roles
+			URI:           "/admin/page",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole, fakeAdminRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // strange url
+			URI:          "/admin/..//admin/page",
+			Redirects:    false,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{ // strange url, token
+			URI:          "/admin/../admin",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{"hehe"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // strange url, token
+			URI:          "/test/../admin",
+			Redirects:    false,
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // strange url, token, role (15)
+			URI:           "/test/../admin",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // strange url, token, but good token
+			URI:           "/test/../admin",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{ // strange url, token, wrong roles
+			URI:          "/test/../admin",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{fakeTestRole},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // check with a token admin test role
+			URI:          "/test_admin_role",
+			Redirects:    false,
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{ // check with a token but without both roles
+			URI:          "/test_admin_role",
+			Redirects:    false,
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+			Roles:        []string{fakeAdminRole},
+		},
+		{ // check with a token with both roles (20)
+			URI:           "/test_admin_role",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole, fakeTestRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{
+			URI:          "/section/test1",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/section/test",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{fakeTestRole, fakeAdminRole},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+		{
+			URI:          "/section/one",
+			Redirects:    false,
+			HasToken:     true,
+			Roles:        []string{fakeTestRole, fakeAdminRole},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/section/one",
+			Redirects:     false,
+			HasToken:      true,
+			Roles:         []string{"one"},
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxy: true,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestCrossSiteHandler(t *testing.T) {
+	cases := []struct {
+		Cors    cors.Options
+		Request fakeRequest
+	}{
+		{
+			Cors: cors.Options{
+				AllowedOrigins: []string{"*"},
+			},
+			Request: fakeRequest{
+				URI: fakeAuthAllURL,
+				Headers: map[string]string{
+					"Origin": "127.0.0.1",
+				},
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+			},
+		},
+		{
+			Cors: cors.Options{
+				AllowedOrigins: []string{"*", "https://examples.com"},
+			},
+			Request: fakeRequest{
+				URI: fakeAuthAllURL,
+				Headers: map[string]string{
+					"Origin": "127.0.0.1",
+				},
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+			},
 		},
 		{
 			Cors: cors.Options{
@@ -1083,722 +1556,1737 @@ func TestCrossSiteHandler(t *testing.T) {
 				AllowedMethods: []string{"GET", "POST"},
 			},
 			Request: fakeRequest{
-				URI:    fakeAuthAllURL,
-				Method: http.MethodOptions,
-				Headers: map[string]string{
-					"Origin":                        "127.0.0.1",
-					"Access-Control-Request-Method": "GET",
+				URI:    fakeAuthAllURL,
+				Method: http.MethodOptions,
+				Headers: map[string]string{
+					"Origin":                        "127.0.0.1",
+					"Access-Control-Request-Method": "GET",
+				},
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin":  "*",
+					"Access-Control-Allow-Methods": "GET",
+				},
+			},
+		},
+	}
+
+	for _, testCase := range cases {
+		cfg := newFakeKeycloakConfig()
+		cfg.CorsCredentials = testCase.Cors.AllowCredentials
+		cfg.CorsExposedHeaders = testCase.Cors.ExposedHeaders
+		cfg.CorsHeaders = testCase.Cors.AllowedHeaders
+		cfg.CorsMaxAge = time.Duration(testCase.Cors.MaxAge) * time.Second
+		cfg.CorsMethods = testCase.Cors.AllowedMethods
+		cfg.CorsOrigins = testCase.Cors.AllowedOrigins
+
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{testCase.Request})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestRefreshTokenEncryption",
+			ProxySettings: func(c *Config) {
+				c.EnableRefreshTokens = true
+				c.EnableEncryptedToken = true
+				c.Verbose = true
+				c.EnableLogging = true
+				c.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:                           fakeAuthAllURL,
+					HasLogin:                      true,
+					Redirects:                     true,
+					OnResponse:                    delay,
+					ExpectedProxy:                 true,
+					ExpectedCode:                  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieRefreshName: checkRefreshTokenEncryption},
+				},
+				{
+					URI:           fakeAuthAllURL,
+					Redirects:     false,
+					HasLogin:      false,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name: "TestRefreshTokenExpiration",
+			ProxySettings: func(c *Config) {
+				c.EnableRefreshTokens = true
+				c.EnableEncryptedToken = true
+				c.Verbose = true
+				c.EnableLogging = true
+				c.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:       fakeAuthAllURL,
+					HasLogin:  true,
+					Redirects: true,
+					OnResponse: func(int, *resty.Request, *resty.Response) {
+						<-time.After(time.Duration(int64(3200)) * time.Millisecond)
+					},
+					ExpectedProxy:                 true,
+					ExpectedCode:                  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieRefreshName: checkRefreshTokenEncryption},
+				},
+				{
+					URI:           fakeAuthAllURL,
+					Redirects:     false,
+					HasLogin:      false,
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		cfgCopy := *cfg
+		c := &cfgCopy
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				testCase.ProxySettings(c)
+				p := newFakeProxy(c, &fakeAuthConfig{Expiration: 1500 * time.Millisecond})
+				p.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestServerSideSessions(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestSessionCookieIsOpaque",
+			ProxySettings: func(c *Config) {
+				c.EnableServerSideSessions = true
+				c.StoreURL = "memory://"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           fakeAuthAllURL,
+					HasLogin:      true,
+					Redirects:     true,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionName: checkSessionID,
+					},
+				},
+				{
+					URI:           fakeAuthAllURL,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name: "TestSessionRefresh",
+			ProxySettings: func(c *Config) {
+				c.EnableServerSideSessions = true
+				c.EnableRefreshTokens = true
+				c.EncryptionKey = testEncryptionKey
+				c.StoreURL = "memory://"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:       fakeAuthAllURL,
+					HasLogin:  true,
+					Redirects: true,
+					OnResponse: func(int, *resty.Request, *resty.Response) {
+						<-time.After(time.Duration(int64(1600)) * time.Millisecond)
+					},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{
+						cfg.CookieSessionName: checkSessionID,
+					},
+				},
+				{
+					URI:           fakeAuthAllURL,
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+			},
+		},
+		{
+			Name: "TestSessionExpiration",
+			ProxySettings: func(c *Config) {
+				c.EnableServerSideSessions = true
+				c.StoreURL = "memory://"
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:       fakeAuthAllURL,
+					HasLogin:  true,
+					Redirects: true,
+					OnResponse: func(int, *resty.Request, *resty.Response) {
+						<-time.After(time.Duration(int64(1600)) * time.Millisecond)
+					},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+				},
+				{
+					URI:           fakeAuthAllURL,
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		cfgCopy := *cfg
+		c := &cfgCopy
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				testCase.ProxySettings(c)
+				p := newFakeProxy(c, &fakeAuthConfig{Expiration: 1500 * time.Millisecond})
+				p.RunTests(t, testCase.ExecutionSettings)
+
+				_, found := p.cookies[c.CookieAccessName]
+				assert.False(t, found, "the access token should not be sent to the browser")
+				_, found = p.cookies[c.CookieRefreshName]
+				assert.False(t, found, "the refresh token should not be sent to the browser")
+			},
+		)
+	}
+}
+
+func TestServerSideSessionRevocation(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableServerSideSessions = true
+	cfg.StoreURL = "memory://"
+
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasLogin:      true,
+			Redirects:     true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse: func(int, *resty.Request, *resty.Response) {
+				session, found := p.cookies[cfg.CookieSessionName]
+				if assert.True(t, found) {
+					assert.NoError(t, p.proxy.DeleteSession(context.Background(), session.Value))
+				}
+			},
+		},
+		{
+			URI:           fakeAuthAllURL,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+	})
+}
+
+func checkSessionID(t *testing.T, cfg *Config, value string) bool {
+	_, err := jwt.ParseSigned(value)
+
+	return assert.Error(t, err, "the session cookie should not hold a token") && assert.Len(t, value, 43)
+}
+
+func delay(no int, req *resty.Request, resp *resty.Response) {
+	if no == 0 {
+		<-time.After(1000 * time.Millisecond)
+	}
+}
+
+func checkAccessTokenEncryption(t *testing.T, cfg *Config, value string) bool {
+	rawToken, err := decodeText(value, cfg.EncryptionKey)
+
+	if err != nil {
+		return false
+	}
+
+	token, err := jwt.ParseSigned(rawToken)
+
+	if err != nil {
+		return false
+	}
+
+	user, err := extractIdentity(token)
+
+	if err != nil {
+		return false
+	}
+
+	return assert.Contains(t, user.claims, "aud") && assert.Contains(t, user.claims, "email")
+}
+
+func checkRefreshTokenEncryption(t *testing.T, cfg *Config, value string) bool {
+	rawToken, err := decodeText(value, cfg.EncryptionKey)
+
+	if err != nil {
+		return false
+	}
+
+	_, err = jwt.ParseSigned(rawToken)
+
+	return err == nil
+}
+
+func TestAccessTokenEncryption(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	redisServer, err := miniredis.Run()
+
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+
+	defer redisServer.Close()
+
+	testCases := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestEnableEncryptedTokenWithRedis",
+			ProxySettings: func(conf *Config) {
+				conf.EnableRefreshTokens = true
+				conf.EnableEncryptedToken = true
+				conf.Verbose = true
+				conf.EnableLogging = true
+				conf.EncryptionKey = testEncryptionKey
+				conf.StoreURL = fmt.Sprintf("redis://%s", redisServer.Addr())
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:       fakeAuthAllURL,
+					HasLogin:  true,
+					Redirects: true,
+					OnResponse: func(int, *resty.Request, *resty.Response) {
+						<-time.After(time.Duration(int64(2500)) * time.Millisecond)
+					},
+					ExpectedProxy:                 true,
+					ExpectedCode:                  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+				},
+				{
+					URI:                      fakeAuthAllURL,
+					Redirects:                false,
+					ExpectedProxy:            true,
+					ExpectedCode:             http.StatusOK,
+					ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+				},
+			},
+		},
+		{
+			Name: "TestEnableEncryptedToken",
+			ProxySettings: func(conf *Config) {
+				conf.EnableRefreshTokens = true
+				conf.EnableEncryptedToken = true
+				conf.Verbose = true
+				conf.EnableLogging = true
+				conf.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:       fakeAuthAllURL,
+					HasLogin:  true,
+					Redirects: true,
+					OnResponse: func(int, *resty.Request, *resty.Response) {
+						<-time.After(time.Duration(int64(2500)) * time.Millisecond)
+					},
+					ExpectedProxy:                 true,
+					ExpectedCode:                  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+				},
+				{
+					URI:                      fakeAuthAllURL,
+					Redirects:                false,
+					ExpectedProxy:            true,
+					ExpectedCode:             http.StatusOK,
+					ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+				},
+			},
+		},
+		{
+			Name: "ForceEncryptedCookie",
+			ProxySettings: func(conf *Config) {
+				conf.EnableRefreshTokens = true
+				conf.EnableEncryptedToken = false
+				conf.ForceEncryptedCookie = true
+				conf.Verbose = true
+				conf.EnableLogging = true
+				conf.EncryptionKey = testEncryptionKey
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:       fakeAuthAllURL,
+					HasLogin:  true,
+					Redirects: true,
+					OnResponse: func(int, *resty.Request, *resty.Response) {
+						<-time.After(time.Duration(int64(2500)) * time.Millisecond)
+					},
+					ExpectedProxy:                 true,
+					ExpectedCode:                  http.StatusOK,
+					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+				},
+				{
+					URI:                      fakeAuthAllURL,
+					Redirects:                false,
+					ExpectedProxy:            true,
+					ExpectedCode:             http.StatusOK,
+					ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
+					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		cfgCopy := *cfg
+		c := &cfgCopy
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				testCase.ProxySettings(c)
+				p := newFakeProxy(c, &fakeAuthConfig{Expiration: 2000 * time.Millisecond})
+				p.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestTokenIntrospection(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.StoreURL = "memory://"
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin*",
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+	proxy := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token := newTestToken(proxy.idp.getLocation())
+	token.addRealmRoles([]string{fakeAdminRole})
+	signed, err := token.getToken()
+	assert.NoError(t, err)
+
+	expired := newTestToken(proxy.idp.getLocation())
+	expired.setExpiration(time.Now().Add(-time.Hour))
+	signedExpired, err := expired.getToken()
+	assert.NoError(t, err)
+
+	requests := []fakeRequest{
+		{
+			URI:           "/auth_all/test",
+			RawToken:      fakeOpaqueToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedProxyHeaders: map[string]string{
+				"X-Auth-Email": "gambol99@gmail.com",
+			},
+		},
+		{
+			URI:          "/admin/test",
+			RawToken:     fakeOpaqueToken,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/admin/test",
+			RawToken:      signed,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/auth_all/test",
+			RawToken:     "unknown",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:          "/auth_all/test",
+			RawToken:     signedExpired,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+	}
+	proxy.RunTests(t, requests)
+}
+
+func TestTokenIntrospectionAudience(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.Resources = []*Resource{
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		// the client id of the introspection response is enough
+		{
+			URI:           fakeAuthAllURL,
+			HasToken:      true,
+			TokenClaims:   map[string]interface{}{"aud": "other", "azp": fakeClientID},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		// the active tokens issued for another client are refused
+		{
+			URI:          fakeAuthAllURL,
+			HasToken:     true,
+			TokenClaims:  map[string]interface{}{"aud": "other", "azp": "other"},
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:               fakeAuthAllURL,
+			HasToken:          true,
+			TokenClaims:       map[string]interface{}{"aud": "other", "azp": "other"},
+			SkipClientIDCheck: true,
+			ExpectedProxy:     true,
+			ExpectedCode:      http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestTokenIntrospectionCache(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableTokenIntrospection = true
+	cfg.StoreURL = "memory://"
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{
+			URL:        "/payments*",
+			Methods:    allHTTPMethods,
+			Introspect: true,
+		},
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+	_, idp, service := newTestProxyService(cfg)
+
+	request := func(uri string) int {
+		resp, err := resty.New().R().SetAuthToken(fakeOpaqueToken).Get(service + uri)
+		assert.NoError(t, err)
+		return resp.StatusCode()
+	}
+
+	// the active introspection is cached, but not for the resources requiring it every time
+	for count := 0; count < 2; count++ {
+		assert.Equal(t, http.StatusOK, request("/auth_all/test"))
+		assert.Equal(t, http.StatusOK, request("/payments/test"))
+	}
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&idp.introspections))
+
+	// the revocation is seen at once by the resources requiring the introspection
+	idp.revokedTokens.Store(fakeOpaqueToken, true)
+
+	assert.Equal(t, http.StatusOK, request("/auth_all/test"))
+	assert.Equal(t, http.StatusUnauthorized, request("/payments/test"))
+}
+
+func TestResourceTokenIntrospection(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.Resources = []*Resource{
+		{
+			URL:        "/payments*",
+			Methods:    allHTTPMethods,
+			Introspect: true,
+		},
+		{
+			URL:     fakeAuthAllURL,
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		// only the resources requiring the introspection accept the opaque tokens
+		{
+			URI:           "/payments/test",
+			RawToken:      fakeOpaqueToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/auth_all/test",
+			RawToken:     fakeOpaqueToken,
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           "/payments/test",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestCustomHeadersHandler(t *testing.T) {
+	requests := []struct {
+		Match   []string
+		Request fakeRequest
+	}{
+		{
+			Match: []string{"subject", "userid", "email", "username"},
+			Request: fakeRequest{
+				URI:      fakeAuthAllURL,
+				HasToken: true,
+				TokenClaims: map[string]interface{}{
+					"sub":                "test-subject",
+					"username":           "rohith",
+					"preferred_username": "rohith",
+					"email":              "gambol99@gmail.com",
+				},
+				ExpectedProxyHeaders: map[string]string{
+					"X-Auth-Subject":  "test-subject",
+					"X-Auth-Userid":   "rohith",
+					"X-Auth-Email":    "gambol99@gmail.com",
+					"X-Auth-Username": "rohith",
+				},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+		{
+			Match: []string{"given_name", "family_name", "preferred_username|Custom-Header"},
+			Request: fakeRequest{
+				URI:      fakeAuthAllURL,
+				HasToken: true,
+				TokenClaims: map[string]interface{}{
+					"email":              "gambol99@gmail.com",
+					"name":               "Rohith Jayawardene",
+					"family_name":        "Jayawardene",
+					"preferred_username": "rjayawardene",
+					"given_name":         "Rohith",
+				},
+				ExpectedProxyHeaders: map[string]string{
+					"X-Auth-Given-Name":  "Rohith",
+					"X-Auth-Family-Name": "Jayawardene",
+					"Custom-Header":      "rjayawardene",
+				},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+	}
+	for _, c := range requests {
+		cfg := newFakeKeycloakConfig()
+		cfg.AddClaims = c.Match
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{c.Request})
+	}
+}
+
+func TestAdmissionHandlerRoles(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.NoRedirects = true
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin",
+			Methods: allHTTPMethods,
+			Roles:   []string{"admin"},
+		},
+		{
+			URL:     "/test",
+			Methods: []string{"GET"},
+			Roles:   []string{"test"},
+		},
+		{
+			URL:     "/either",
+			Methods: allHTTPMethods,
+			Roles:   []string{"admin", "test"},
+		},
+		{
+			URL:     "/",
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:          "/admin",
+			Roles:        []string{},
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/admin",
+			Roles:         []string{"admin"},
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/test",
+			Roles:         []string{"test"},
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/either",
+			Roles:         []string{"test", "admin"},
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/either",
+			Roles:        []string{"no_roles"},
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:           "/",
+			HasToken:      true,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+// check to see if custom headers are hitting the upstream
+func TestCustomHeaders(t *testing.T) {
+	requests := []struct {
+		Headers map[string]string
+		Request fakeRequest
+	}{
+		{
+			Headers: map[string]string{
+				"TestHeaderOne": "one",
+			},
+			Request: fakeRequest{
+				URI:           "/gambol99.htm",
+				ExpectedProxy: true,
+				ExpectedProxyHeaders: map[string]string{
+					"TestHeaderOne": "one",
+				},
+			},
+		},
+		{
+			Headers: map[string]string{
+				"TestHeader": "test",
+			},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				ExpectedProxy: true,
+				ExpectedProxyHeaders: map[string]string{
+					"TestHeader": "test",
+				},
+			},
+		},
+		{
+			Headers: map[string]string{
+				"TestHeaderOne": "one",
+				"TestHeaderTwo": "two",
+			},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				ExpectedProxy: true,
+				ExpectedProxyHeaders: map[string]string{
+					"TestHeaderOne": "one",
+					"TestHeaderTwo": "two",
+				},
+			},
+		},
+	}
+	for _, c := range requests {
+		cfg := newFakeKeycloakConfig()
+		cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
+		cfg.Headers = c.Headers
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{c.Request})
+	}
+}
+
+func TestRolesAdmissionHandlerClaims(t *testing.T) {
+	requests := []struct {
+		Matches map[string]string
+		Request fakeRequest
+	}{
+		// jose.StringClaim test
+		{
+			Matches: map[string]string{"item": "test"},
+			Request: fakeRequest{
+				URI:          testAdminURI,
+				HasToken:     true,
+				ExpectedCode: http.StatusForbidden,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "^tes$"},
+			Request: fakeRequest{
+				URI:          testAdminURI,
+				HasToken:     true,
+				ExpectedCode: http.StatusForbidden,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "^tes$"},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				TokenClaims:   map[string]interface{}{"item": "tes"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "not_match"},
+			Request: fakeRequest{
+				URI:          testAdminURI,
+				HasToken:     true,
+				TokenClaims:  map[string]interface{}{"item": "test"},
+				ExpectedCode: http.StatusForbidden,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "^test", "found": "something"},
+			Request: fakeRequest{
+				URI:          testAdminURI,
+				HasToken:     true,
+				TokenClaims:  map[string]interface{}{"item": "test"},
+				ExpectedCode: http.StatusForbidden,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "^test", "found": "something"},
+			Request: fakeRequest{
+				URI:      testAdminURI,
+				HasToken: true,
+				TokenClaims: map[string]interface{}{
+					"item":  "tester",
+					"found": "something",
 				},
-				ExpectedHeaders: map[string]string{
-					"Access-Control-Allow-Origin":  "*",
-					"Access-Control-Allow-Methods": "GET",
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+		{
+			Matches: map[string]string{"item": ".*"},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				TokenClaims:   map[string]interface{}{"item": "test"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "^t.*$"},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				TokenClaims:   map[string]interface{}{"item": "test"},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+		// jose.StringsClaim test
+		{
+			Matches: map[string]string{"item1": "^t.*t"},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				TokenClaims:   map[string]interface{}{"item1": []string{"nonMatchingClaim", "test", "anotherNonMatching"}},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
+			},
+		},
+		{
+			Matches: map[string]string{"item1": "^t.*t"},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				TokenClaims:   map[string]interface{}{"item1": []string{"1test", "2test", "3test"}},
+				ExpectedProxy: false,
+				ExpectedCode:  http.StatusForbidden,
+			},
+		},
+		{
+			Matches: map[string]string{"item": "^t.*t"},
+			Request: fakeRequest{
+				URI:           testAdminURI,
+				HasToken:      true,
+				TokenClaims:   map[string]interface{}{"item1": []string{}},
+				ExpectedProxy: false,
+				ExpectedCode:  http.StatusForbidden,
+			},
+		},
+		{
+			Matches: map[string]string{
+				"item1": "^t.*t",
+				"item2": "^another",
+			},
+			Request: fakeRequest{
+				URI:      testAdminURI,
+				HasToken: true,
+				TokenClaims: map[string]interface{}{
+					"item1": []string{"randomItem", "test"},
+					"item2": []string{"randomItem", "anotherItem"},
+					"item3": []string{"randomItem2", "anotherItem3"},
 				},
+				ExpectedProxy: true,
+				ExpectedCode:  http.StatusOK,
 			},
 		},
 	}
-
-	for _, testCase := range cases {
+	for _, c := range requests {
 		cfg := newFakeKeycloakConfig()
-		cfg.CorsCredentials = testCase.Cors.AllowCredentials
-		cfg.CorsExposedHeaders = testCase.Cors.ExposedHeaders
-		cfg.CorsHeaders = testCase.Cors.AllowedHeaders
-		cfg.CorsMaxAge = time.Duration(testCase.Cors.MaxAge) * time.Second
-		cfg.CorsMethods = testCase.Cors.AllowedMethods
-		cfg.CorsOrigins = testCase.Cors.AllowedOrigins
-
-		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{testCase.Request})
+		cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
+		cfg.MatchClaims = c.Matches
+		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{c.Request})
 	}
 }
 
-func TestRefreshToken(t *testing.T) {
+func TestGzipCompression(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
+	server := httptest.NewServer(&fakeUpstreamService{})
 
-	testCases := []struct {
+	requests := []struct {
 		Name              string
 		ProxySettings     func(c *Config)
 		ExecutionSettings []fakeRequest
 	}{
 		{
-			Name: "TestRefreshTokenEncryption",
+			Name: "TestCompressionWithCustomURI",
 			ProxySettings: func(c *Config) {
-				c.EnableRefreshTokens = true
-				c.EnableEncryptedToken = true
-				c.Verbose = true
+				c.EnableCompression = true
+				c.EnableLogging = false
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/gambol99.htm",
+					ExpectedProxy: true,
+					Headers: map[string]string{
+						"Accept-Encoding": "gzip, deflate, br",
+					},
+					ExpectedHeaders: map[string]string{
+						"Content-Encoding": "gzip",
+					},
+				},
+			},
+		},
+		{
+			Name: "TestCompressionWithAdminURI",
+			ProxySettings: func(c *Config) {
+				c.EnableCompression = true
+				c.EnableLogging = false
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           testAdminURI,
+					ExpectedProxy: false,
+					Headers: map[string]string{
+						"Accept-Encoding": "gzip, deflate, br",
+					},
+					ExpectedNoProxyHeaders: []string{"Content-Encoding"},
+				},
+			},
+		},
+		{
+			Name: "TestCompressionWithLogging",
+			ProxySettings: func(c *Config) {
+				c.EnableCompression = true
 				c.EnableLogging = true
-				c.EncryptionKey = testEncryptionKey
 			},
 			ExecutionSettings: []fakeRequest{
 				{
-					URI:                           fakeAuthAllURL,
-					HasLogin:                      true,
-					Redirects:                     true,
-					OnResponse:                    delay,
-					ExpectedProxy:                 true,
-					ExpectedCode:                  http.StatusOK,
-					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieRefreshName: checkRefreshTokenEncryption},
+					URL:                     server.URL + "/test",
+					ProxyRequest:            true,
+					ExpectedProxy:           true,
+					ExpectedCode:            http.StatusOK,
+					ExpectedContentContains: "/test",
+					Headers: map[string]string{
+						"Accept-Encoding": "gzip, deflate, br",
+					},
+					ExpectedHeaders: map[string]string{
+						"Content-Encoding": "gzip",
+					},
+				},
+			},
+		},
+		{
+			Name: "TestWithoutCompressionCustomURI",
+			ProxySettings: func(c *Config) {
+				c.EnableCompression = false
+				c.EnableLogging = false
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/gambol99.htm",
+					ExpectedProxy: true,
+					Headers: map[string]string{
+						"Accept-Encoding": "gzip, deflate, br",
+					},
+					ExpectedNoProxyHeaders: []string{"Content-Encoding"},
+				},
+			},
+		},
+		{
+			Name: "TestWithoutCompressionWithAdminURI",
+			ProxySettings: func(c *Config) {
+				c.EnableCompression = false
+				c.EnableLogging = false
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           testAdminURI,
+					ExpectedProxy: false,
+					Headers: map[string]string{
+						"Accept-Encoding": "gzip, deflate, br",
+					},
+					ExpectedNoProxyHeaders: []string{"Content-Encoding"},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range requests {
+		testCase := testCase
+		cfg := *cfg
+		cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
+
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				testCase.ProxySettings(&cfg)
+				p := newFakeProxy(&cfg, &fakeAuthConfig{})
+				p.RunTests(t, testCase.ExecutionSettings)
+			},
+		)
+	}
+}
+
+func TestEnableUma(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+
+	requests := []struct {
+		Name              string
+		ProxySettings     func(c *Config)
+		ExecutionSettings []fakeRequest
+	}{
+		{
+			Name: "TestUmaNoToken",
+			ProxySettings: func(conf *Config) {
+				conf.EnableUma = true
+				conf.EnableDefaultDeny = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
+			},
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/test",
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusUnauthorized,
+					ExpectedContent: func(body string, testNum int) {
+						assert.Equal(t, "", body)
+					},
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
+							assert.Contains(t, "ticket", value)
+						},
+					},
 				},
+			},
+		},
+		{
+			Name: "TestUmaTokenWithoutAuthz",
+			ProxySettings: func(conf *Config) {
+				conf.EnableUma = true
+				conf.EnableDefaultDeny = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
+			},
+			ExecutionSettings: []fakeRequest{
 				{
-					URI:           fakeAuthAllURL,
-					Redirects:     false,
-					HasLogin:      false,
-					ExpectedProxy: true,
-					ExpectedCode:  http.StatusOK,
+					URI:                "/test",
+					ExpectedProxy:      false,
+					HasToken:           true,
+					ExpectedCode:       http.StatusUnauthorized,
+					TokenAuthorization: &authorization.Permissions{},
+					ExpectedContent: func(body string, testNum int) {
+						assert.Equal(t, "", body)
+					},
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
+							assert.Contains(t, "ticket", value)
+						},
+					},
 				},
 			},
 		},
 		{
-			Name: "TestRefreshTokenExpiration",
-			ProxySettings: func(c *Config) {
-				c.EnableRefreshTokens = true
-				c.EnableEncryptedToken = true
-				c.Verbose = true
-				c.EnableLogging = true
-				c.EncryptionKey = testEncryptionKey
+			Name: "TestUmaTokenWithoutResourceId",
+			ProxySettings: func(conf *Config) {
+				conf.EnableUma = true
+				conf.EnableDefaultDeny = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
 			},
 			ExecutionSettings: []fakeRequest{
 				{
-					URI:       fakeAuthAllURL,
-					HasLogin:  true,
-					Redirects: true,
-					OnResponse: func(int, *resty.Request, *resty.Response) {
-						<-time.After(time.Duration(int64(3200)) * time.Millisecond)
+					URI:           "/test",
+					ExpectedProxy: false,
+					HasToken:      true,
+					ExpectedCode:  http.StatusUnauthorized,
+					TokenAuthorization: &authorization.Permissions{
+						Permissions: []authorization.Permission{
+							{
+								Scopes:       []string{"test"},
+								ResourceID:   "",
+								ResourceName: "some",
+							},
+						},
+					},
+					ExpectedContent: func(body string, testNum int) {
+						assert.Equal(t, "", body)
+					},
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
+							assert.Contains(t, "ticket", value)
+						},
 					},
-					ExpectedProxy:                 true,
-					ExpectedCode:                  http.StatusOK,
-					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieRefreshName: checkRefreshTokenEncryption},
 				},
+			},
+		},
+		{
+			Name: "TestUmaTokenWithoutScope",
+			ProxySettings: func(conf *Config) {
+				conf.EnableUma = true
+				conf.EnableDefaultDeny = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
+			},
+			ExecutionSettings: []fakeRequest{
 				{
-					URI:           fakeAuthAllURL,
-					Redirects:     false,
-					HasLogin:      false,
+					URI:           "/test",
 					ExpectedProxy: false,
+					HasToken:      true,
 					ExpectedCode:  http.StatusUnauthorized,
+					TokenAuthorization: &authorization.Permissions{
+						Permissions: []authorization.Permission{
+							{
+								Scopes:       []string{},
+								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
+								ResourceName: "some",
+							},
+						},
+					},
+					ExpectedContent: func(body string, testNum int) {
+						assert.Equal(t, "", body)
+					},
+					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
+						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
+							assert.Contains(t, "ticket", value)
+						},
+					},
 				},
 			},
 		},
-	}
-
-	for _, testCase := range testCases {
-		testCase := testCase
-		cfgCopy := *cfg
-		c := &cfgCopy
-		t.Run(
-			testCase.Name,
-			func(t *testing.T) {
-				testCase.ProxySettings(c)
-				p := newFakeProxy(c, &fakeAuthConfig{Expiration: 1500 * time.Millisecond})
-				p.RunTests(t, testCase.ExecutionSettings)
-			},
-		)
-	}
-}
-
-func delay(no int, req *resty.Request, resp *resty.Response) {
-	if no == 0 {
-		<-time.After(1000 * time.Millisecond)
-	}
-}
-
-func checkAccessTokenEncryption(t *testing.T, cfg *Config, value string) bool {
-	rawToken, err := decodeText(value, cfg.EncryptionKey)
-
-	if err != nil {
-		return false
-	}
-
-	token, err := jwt.ParseSigned(rawToken)
-
-	if err != nil {
-		return false
-	}
-
-	user, err := extractIdentity(token)
-
-	if err != nil {
-		return false
-	}
-
-	return assert.Contains(t, user.claims, "aud") && assert.Contains(t, user.claims, "email")
-}
-
-func checkRefreshTokenEncryption(t *testing.T, cfg *Config, value string) bool {
-	rawToken, err := decodeText(value, cfg.EncryptionKey)
-
-	if err != nil {
-		return false
-	}
-
-	_, err = jwt.ParseSigned(rawToken)
-
-	return err == nil
-}
-
-func TestAccessTokenEncryption(t *testing.T) {
-	cfg := newFakeKeycloakConfig()
-	redisServer, err := miniredis.Run()
-
-	if err != nil {
-		t.Fatalf("Starting redis failed %s", err)
-	}
-
-	defer redisServer.Close()
-
-	testCases := []struct {
-		Name              string
-		ProxySettings     func(c *Config)
-		ExecutionSettings []fakeRequest
-	}{
 		{
-			Name: "TestEnableEncryptedTokenWithRedis",
+			Name: "TestUmaMethodScopeGranted",
 			ProxySettings: func(conf *Config) {
-				conf.EnableRefreshTokens = true
-				conf.EnableEncryptedToken = true
-				conf.Verbose = true
-				conf.EnableLogging = true
-				conf.EncryptionKey = testEncryptionKey
-				conf.StoreURL = fmt.Sprintf("redis://%s", redisServer.Addr())
+				conf.EnableUma = true
+				conf.EnableDefaultDeny = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
+				conf.UmaMethodScopes = map[string]string{
+					http.MethodGet:    "test",
+					http.MethodDelete: "delete",
+				}
 			},
 			ExecutionSettings: []fakeRequest{
 				{
-					URI:       fakeAuthAllURL,
-					HasLogin:  true,
-					Redirects: true,
-					OnResponse: func(int, *resty.Request, *resty.Response) {
-						<-time.After(time.Duration(int64(2500)) * time.Millisecond)
+					URI:           "/test",
+					ExpectedProxy: true,
+					HasToken:      true,
+					ExpectedCode:  http.StatusOK,
+					TokenAuthorization: &authorization.Permissions{
+						Permissions: []authorization.Permission{
+							{
+								Scopes:       []string{"test"},
+								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
+								ResourceName: "some",
+							},
+						},
 					},
-					ExpectedProxy:                 true,
-					ExpectedCode:                  http.StatusOK,
-					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
 				},
 				{
-					URI:                      fakeAuthAllURL,
-					Redirects:                false,
-					ExpectedProxy:            true,
-					ExpectedCode:             http.StatusOK,
-					ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
-					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
+					URI:           "/test",
+					Method:        http.MethodDelete,
+					ExpectedProxy: false,
+					HasToken:      true,
+					ExpectedCode:  http.StatusUnauthorized,
+					TokenAuthorization: &authorization.Permissions{
+						Permissions: []authorization.Permission{
+							{
+								Scopes:       []string{"test"},
+								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
+								ResourceName: "some",
+							},
+						},
+					},
 				},
 			},
 		},
 		{
-			Name: "TestEnableEncryptedToken",
+			Name: "TestUmaResourceMethodScopeOverride",
 			ProxySettings: func(conf *Config) {
-				conf.EnableRefreshTokens = true
-				conf.EnableEncryptedToken = true
-				conf.Verbose = true
-				conf.EnableLogging = true
-				conf.EncryptionKey = testEncryptionKey
+				conf.EnableUma = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
+				conf.UmaMethodScopes = map[string]string{http.MethodGet: "test"}
+				conf.Resources = []*Resource{
+					{
+						URL:             "/test",
+						Methods:         allHTTPMethods,
+						UmaMethodScopes: map[string]string{http.MethodGet: "other"},
+					},
+				}
 			},
 			ExecutionSettings: []fakeRequest{
 				{
-					URI:       fakeAuthAllURL,
-					HasLogin:  true,
-					Redirects: true,
-					OnResponse: func(int, *resty.Request, *resty.Response) {
-						<-time.After(time.Duration(int64(2500)) * time.Millisecond)
+					URI:           "/test",
+					ExpectedProxy: false,
+					HasToken:      true,
+					ExpectedCode:  http.StatusUnauthorized,
+					TokenAuthorization: &authorization.Permissions{
+						Permissions: []authorization.Permission{
+							{
+								Scopes:       []string{"test"},
+								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
+								ResourceName: "some",
+							},
+						},
 					},
-					ExpectedProxy:                 true,
-					ExpectedCode:                  http.StatusOK,
-					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
-				},
-				{
-					URI:                      fakeAuthAllURL,
-					Redirects:                false,
-					ExpectedProxy:            true,
-					ExpectedCode:             http.StatusOK,
-					ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
-					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
 				},
 			},
 		},
 		{
-			Name: "ForceEncryptedCookie",
+			Name: "TestUmaOK",
 			ProxySettings: func(conf *Config) {
-				conf.EnableRefreshTokens = true
-				conf.EnableEncryptedToken = false
-				conf.ForceEncryptedCookie = true
-				conf.Verbose = true
-				conf.EnableLogging = true
-				conf.EncryptionKey = testEncryptionKey
+				conf.EnableUma = true
+				conf.EnableDefaultDeny = true
+				conf.ClientID = validUsername
+				conf.ClientSecret = validPassword
+				conf.PatRetryCount = 5
+				conf.PatRetryInterval = 2 * time.Second
 			},
 			ExecutionSettings: []fakeRequest{
 				{
-					URI:       fakeAuthAllURL,
-					HasLogin:  true,
-					Redirects: true,
-					OnResponse: func(int, *resty.Request, *resty.Response) {
-						<-time.After(time.Duration(int64(2500)) * time.Millisecond)
+					URI:           "/test",
+					ExpectedProxy: true,
+					HasToken:      true,
+					ExpectedCode:  http.StatusOK,
+					TokenAuthorization: &authorization.Permissions{
+						Permissions: []authorization.Permission{
+							{
+								Scopes:       []string{"test"},
+								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
+								ResourceName: "some",
+							},
+						},
+					},
+					ExpectedContent: func(body string, testNum int) {
+						assert.Contains(t, body, "test")
+						assert.Contains(t, body, "method")
 					},
-					ExpectedProxy:                 true,
-					ExpectedCode:                  http.StatusOK,
-					ExpectedLoginCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
-				},
-				{
-					URI:                      fakeAuthAllURL,
-					Redirects:                false,
-					ExpectedProxy:            true,
-					ExpectedCode:             http.StatusOK,
-					ExpectedCookies:          map[string]string{cfg.CookieAccessName: ""},
-					ExpectedCookiesValidator: map[string]func(*testing.T, *Config, string) bool{cfg.CookieAccessName: checkAccessTokenEncryption},
 				},
 			},
 		},
 	}
 
-	for _, testCase := range testCases {
+	for _, testCase := range requests {
 		testCase := testCase
-		cfgCopy := *cfg
-		c := &cfgCopy
+		c := *cfg
 		t.Run(
 			testCase.Name,
 			func(t *testing.T) {
-				testCase.ProxySettings(c)
-				p := newFakeProxy(c, &fakeAuthConfig{Expiration: 2000 * time.Millisecond})
+				testCase.ProxySettings(&c)
+				p := newFakeProxy(&c, &fakeAuthConfig{})
 				p.RunTests(t, testCase.ExecutionSettings)
 			},
 		)
 	}
 }
 
-func TestCustomHeadersHandler(t *testing.T) {
-	requests := []struct {
-		Match   []string
-		Request fakeRequest
-	}{
-		{
-			Match: []string{"subject", "userid", "email", "username"},
-			Request: fakeRequest{
-				URI:      fakeAuthAllURL,
-				HasToken: true,
-				TokenClaims: map[string]interface{}{
-					"sub":                "test-subject",
-					"username":           "rohith",
-					"preferred_username": "rohith",
-					"email":              "gambol99@gmail.com",
-				},
-				ExpectedProxyHeaders: map[string]string{
-					"X-Auth-Subject":  "test-subject",
-					"X-Auth-Userid":   "rohith",
-					"X-Auth-Email":    "gambol99@gmail.com",
-					"X-Auth-Username": "rohith",
-				},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
-			},
-		},
-		{
-			Match: []string{"given_name", "family_name", "preferred_username|Custom-Header"},
-			Request: fakeRequest{
-				URI:      fakeAuthAllURL,
-				HasToken: true,
-				TokenClaims: map[string]interface{}{
-					"email":              "gambol99@gmail.com",
-					"name":               "Rohith Jayawardene",
-					"family_name":        "Jayawardene",
-					"preferred_username": "rjayawardene",
-					"given_name":         "Rohith",
-				},
-				ExpectedProxyHeaders: map[string]string{
-					"X-Auth-Given-Name":  "Rohith",
-					"X-Auth-Family-Name": "Jayawardene",
-					"Custom-Header":      "rjayawardene",
-				},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
-			},
-		},
-	}
-	for _, c := range requests {
-		cfg := newFakeKeycloakConfig()
-		cfg.AddClaims = c.Match
-		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{c.Request})
-	}
-}
-
-func TestAdmissionHandlerRoles(t *testing.T) {
+// nolint:funlen
+func TestEnableUmaResourceCache(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
-	cfg.NoRedirects = true
-	cfg.Resources = []*Resource{
-		{
-			URL:     "/admin",
-			Methods: allHTTPMethods,
-			Roles:   []string{"admin"},
-		},
-		{
-			URL:     "/test",
-			Methods: []string{"GET"},
-			Roles:   []string{"test"},
-		},
-		{
-			URL:     "/either",
-			Methods: allHTTPMethods,
-			Roles:   []string{"admin", "test"},
-		},
-		{
-			URL:     "/",
-			Methods: allHTTPMethods,
-		},
-	}
-	requests := []fakeRequest{
-		{
-			URI:          "/admin",
-			Roles:        []string{},
-			HasToken:     true,
-			ExpectedCode: http.StatusForbidden,
-		},
-		{
-			URI:           "/admin",
-			Roles:         []string{"admin"},
-			HasToken:      true,
-			ExpectedProxy: true,
-			ExpectedCode:  http.StatusOK,
-		},
-		{
-			URI:           "/test",
-			Roles:         []string{"test"},
-			HasToken:      true,
-			ExpectedProxy: true,
-			ExpectedCode:  http.StatusOK,
-		},
-		{
-			URI:           "/either",
-			Roles:         []string{"test", "admin"},
-			HasToken:      true,
-			ExpectedProxy: true,
-			ExpectedCode:  http.StatusOK,
-		},
-		{
-			URI:          "/either",
-			Roles:        []string{"no_roles"},
-			HasToken:     true,
-			ExpectedCode: http.StatusForbidden,
-		},
-		{
-			URI:           "/",
-			HasToken:      true,
-			ExpectedProxy: true,
-			ExpectedCode:  http.StatusOK,
-		},
-	}
-	newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, requests)
-}
-
-// check to see if custom headers are hitting the upstream
-func TestCustomHeaders(t *testing.T) {
-	requests := []struct {
-		Headers map[string]string
-		Request fakeRequest
-	}{
-		{
-			Headers: map[string]string{
-				"TestHeaderOne": "one",
-			},
-			Request: fakeRequest{
-				URI:           "/gambol99.htm",
-				ExpectedProxy: true,
-				ExpectedProxyHeaders: map[string]string{
-					"TestHeaderOne": "one",
-				},
-			},
-		},
-		{
-			Headers: map[string]string{
-				"TestHeader": "test",
-			},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				ExpectedProxy: true,
-				ExpectedProxyHeaders: map[string]string{
-					"TestHeader": "test",
-				},
-			},
-		},
-		{
-			Headers: map[string]string{
-				"TestHeaderOne": "one",
-				"TestHeaderTwo": "two",
-			},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				ExpectedProxy: true,
-				ExpectedProxyHeaders: map[string]string{
-					"TestHeaderOne": "one",
-					"TestHeaderTwo": "two",
-				},
-			},
-		},
-	}
-	for _, c := range requests {
-		cfg := newFakeKeycloakConfig()
-		cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
-		cfg.Headers = c.Headers
-		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{c.Request})
-	}
-}
+	cfg.EnableUma = true
+	cfg.EnableDefaultDeny = true
+	cfg.ClientID = validUsername
+	cfg.ClientSecret = validPassword
+	cfg.PatRetryCount = 5
+	cfg.PatRetryInterval = 2 * time.Second
+	cfg.EnableUmaResourceCache = true
+	cfg.UmaResourceCacheInterval = 0
+	cfg.ListenAdmin = "127.0.0.1:12303"
 
-func TestRolesAdmissionHandlerClaims(t *testing.T) {
-	requests := []struct {
-		Matches map[string]string
-		Request fakeRequest
-	}{
-		// jose.StringClaim test
-		{
-			Matches: map[string]string{"item": "test"},
-			Request: fakeRequest{
-				URI:          testAdminURI,
-				HasToken:     true,
-				ExpectedCode: http.StatusForbidden,
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	assert.True(t, p.proxy.umaResources.Loaded())
+	assert.Equal(t, 1, p.proxy.umaResources.Len())
+
+	loadRequests := atomic.LoadInt32(&p.idp.resourceSetRequests)
+	assertNoLookups := func(int, *resty.Request, *resty.Response) {
+		assert.Equal(t, loadRequests, atomic.LoadInt32(&p.idp.resourceSetRequests))
+	}
+
+	permissions := &authorization.Permissions{
+		Permissions: []authorization.Permission{
+			{
+				Scopes:       []string{"test"},
+				ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
+				ResourceName: "some",
 			},
 		},
+	}
+
+	requests := []fakeRequest{
 		{
-			Matches: map[string]string{"item": "^tes$"},
-			Request: fakeRequest{
-				URI:          testAdminURI,
-				HasToken:     true,
-				ExpectedCode: http.StatusForbidden,
-			},
+			URI:                "/test",
+			ExpectedProxy:      true,
+			HasToken:           true,
+			ExpectedCode:       http.StatusOK,
+			TokenAuthorization: permissions,
+			OnResponse:         assertNoLookups,
 		},
 		{
-			Matches: map[string]string{"item": "^tes$"},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				TokenClaims:   map[string]interface{}{"item": "tes"},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
+			URI:                "/test",
+			ExpectedProxy:      false,
+			HasToken:           true,
+			ExpectedCode:       http.StatusUnauthorized,
+			TokenAuthorization: &authorization.Permissions{},
+			OnResponse: func(idx int, req *resty.Request, resp *resty.Response) {
+				assert.Contains(t, resp.Header().Get("WWW-Authenticate"), "ticket")
+				assertNoLookups(idx, req, resp)
 			},
 		},
 		{
-			Matches: map[string]string{"item": "not_match"},
-			Request: fakeRequest{
-				URI:          testAdminURI,
-				HasToken:     true,
-				TokenClaims:  map[string]interface{}{"item": "test"},
-				ExpectedCode: http.StatusForbidden,
-			},
+			URI:          cfg.WithOAuthURI(umaResourcesURL),
+			Method:       http.MethodPost,
+			ExpectedCode: http.StatusNotFound,
+			OnResponse:   assertNoLookups,
 		},
 		{
-			Matches: map[string]string{"item": "^test", "found": "something"},
-			Request: fakeRequest{
-				URI:          testAdminURI,
-				HasToken:     true,
-				TokenClaims:  map[string]interface{}{"item": "test"},
-				ExpectedCode: http.StatusForbidden,
+			URL:          "http://127.0.0.1:12303/oauth/uma-resources",
+			Method:       http.MethodPost,
+			ExpectedCode: http.StatusNoContent,
+			OnResponse: func(int, *resty.Request, *resty.Response) {
+				assert.Equal(t, 2*loadRequests, atomic.LoadInt32(&p.idp.resourceSetRequests))
 			},
 		},
+	}
+
+	p.RunTests(t, requests)
+}
+
+func newFakePolicyServer(t *testing.T, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		policyReq := &authorization.HTTPAuthorizationRequest{}
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(policyReq))
+
+		allowed := false
+
+		if policyReq.Input.Method == http.MethodGet {
+			for _, role := range policyReq.Input.Roles {
+				allowed = allowed || role == "admin"
+			}
+		}
+
+		_ = json.NewEncoder(wrt).Encode(&authorization.HTTPAuthorizationResponse{Result: &allowed})
+	}))
+}
+
+func TestEnableHTTPAuthz(t *testing.T) {
+	var policyRequests int32
+
+	policyServer := newFakePolicyServer(t, &policyRequests)
+	defer policyServer.Close()
+
+	unavailableServer := httptest.NewServer(http.NotFoundHandler())
+	unavailableServer.Close()
+
+	requests := []struct {
+		Name              string
+		PolicyURL         string
+		ExecutionSettings []fakeRequest
+	}{
 		{
-			Matches: map[string]string{"item": "^test", "found": "something"},
-			Request: fakeRequest{
-				URI:      testAdminURI,
-				HasToken: true,
-				TokenClaims: map[string]interface{}{
-					"item":  "tester",
-					"found": "something",
+			Name:      "TestHTTPAuthzAllowed",
+			PolicyURL: policyServer.URL,
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/test",
+					HasToken:      true,
+					Roles:         []string{"admin"},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
 				},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
 			},
 		},
 		{
-			Matches: map[string]string{"item": ".*"},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				TokenClaims:   map[string]interface{}{"item": "test"},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
+			Name:      "TestHTTPAuthzDenied",
+			PolicyURL: policyServer.URL,
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/test",
+					Method:        http.MethodDelete,
+					HasToken:      true,
+					Roles:         []string{"admin"},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
+				{
+					URI:           "/test",
+					HasToken:      true,
+					Roles:         []string{"user"},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
 			},
 		},
 		{
-			Matches: map[string]string{"item": "^t.*$"},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				TokenClaims:   map[string]interface{}{"item": "test"},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
+			Name:      "TestHTTPAuthzPolicyUnavailable",
+			PolicyURL: unavailableServer.URL,
+			ExecutionSettings: []fakeRequest{
+				{
+					URI:           "/test",
+					HasToken:      true,
+					Roles:         []string{"admin"},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+				},
 			},
 		},
-		// jose.StringsClaim test
-		{
-			Matches: map[string]string{"item1": "^t.*t"},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				TokenClaims:   map[string]interface{}{"item1": []string{"nonMatchingClaim", "test", "anotherNonMatching"}},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
+	}
+
+	for _, testCase := range requests {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				cfg := newFakeKeycloakConfig()
+				cfg.EnableHTTPAuthz = true
+				cfg.EnableDefaultDeny = true
+				cfg.HTTPAuthzURL = testCase.PolicyURL
+				cfg.HTTPAuthzTimeout = time.Second
+
+				p := newFakeProxy(cfg, &fakeAuthConfig{})
+				p.RunTests(t, testCase.ExecutionSettings)
 			},
+		)
+	}
+}
+
+func TestEnableHTTPAuthzWithCache(t *testing.T) {
+	var policyRequests int32
+
+	policyServer := newFakePolicyServer(t, &policyRequests)
+	defer policyServer.Close()
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+	defer redisServer.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableHTTPAuthz = true
+	cfg.EnableDefaultDeny = true
+	cfg.HTTPAuthzURL = policyServer.URL
+	cfg.HTTPAuthzTimeout = time.Second
+	cfg.StoreURL = fmt.Sprintf("redis://%s/2", redisServer.Addr())
+
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token := newTestToken(p.idp.getLocation())
+	token.addRealmRoles([]string{"admin"})
+	rawToken, err := token.getToken()
+	assert.NoError(t, err)
+
+	expectPolicyRequests := func(expected int32) func(int, *resty.Request, *resty.Response) {
+		return func(int, *resty.Request, *resty.Response) {
+			assert.Equal(t, expected, atomic.LoadInt32(&policyRequests))
+		}
+	}
+
+	// the decisions are cached per method, a cached allow for GET must not allow a DELETE
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/test",
+			RawToken:      rawToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(1),
 		},
 		{
-			Matches: map[string]string{"item1": "^t.*t"},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				TokenClaims:   map[string]interface{}{"item1": []string{"1test", "2test", "3test"}},
-				ExpectedProxy: false,
-				ExpectedCode:  http.StatusForbidden,
-			},
+			URI:           "/test",
+			RawToken:      rawToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(1),
 		},
 		{
-			Matches: map[string]string{"item": "^t.*t"},
-			Request: fakeRequest{
-				URI:           testAdminURI,
-				HasToken:      true,
-				TokenClaims:   map[string]interface{}{"item1": []string{}},
-				ExpectedProxy: false,
-				ExpectedCode:  http.StatusForbidden,
-			},
+			URI:           "/test",
+			Method:        http.MethodDelete,
+			RawToken:      rawToken,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusForbidden,
+			OnResponse:    expectPolicyRequests(2),
 		},
 		{
-			Matches: map[string]string{
-				"item1": "^t.*t",
-				"item2": "^another",
-			},
-			Request: fakeRequest{
-				URI:      testAdminURI,
-				HasToken: true,
-				TokenClaims: map[string]interface{}{
-					"item1": []string{"randomItem", "test"},
-					"item2": []string{"randomItem", "anotherItem"},
-					"item3": []string{"randomItem2", "anotherItem3"},
-				},
-				ExpectedProxy: true,
-				ExpectedCode:  http.StatusOK,
-			},
+			URI:           "/test",
+			Method:        http.MethodDelete,
+			RawToken:      rawToken,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusForbidden,
+			OnResponse:    expectPolicyRequests(2),
 		},
+	})
+}
+
+func TestHTTPAuthzCacheHeaders(t *testing.T) {
+	var policyRequests int32
+
+	policyServer := newFakePolicyServer(t, &policyRequests)
+	defer policyServer.Close()
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
 	}
-	for _, c := range requests {
-		cfg := newFakeKeycloakConfig()
-		cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
-		cfg.MatchClaims = c.Matches
-		newFakeProxy(cfg, &fakeAuthConfig{}).RunTests(t, []fakeRequest{c.Request})
+	defer redisServer.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.EnableHTTPAuthz = true
+	cfg.EnableDefaultDeny = true
+	cfg.HTTPAuthzURL = policyServer.URL
+	cfg.HTTPAuthzTimeout = time.Second
+	cfg.HTTPAuthzHeaders = []string{"X-Tenant"}
+	cfg.StoreURL = fmt.Sprintf("redis://%s/2", redisServer.Addr())
+
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token := newTestToken(p.idp.getLocation())
+	token.addRealmRoles([]string{"admin"})
+	rawToken, err := token.getToken()
+	assert.NoError(t, err)
+
+	expectPolicyRequests := func(expected int32) func(int, *resty.Request, *resty.Response) {
+		return func(int, *resty.Request, *resty.Response) {
+			assert.Equal(t, expected, atomic.LoadInt32(&policyRequests))
+		}
 	}
+
+	// the policy may decide on the described headers, so the decisions are cached per their values
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/test",
+			RawToken:      rawToken,
+			Headers:       map[string]string{"X-Tenant": "a"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(1),
+		},
+		{
+			URI:           "/test",
+			RawToken:      rawToken,
+			Headers:       map[string]string{"X-Tenant": "a", "X-Other": "b"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(1),
+		},
+		{
+			URI:           "/test",
+			RawToken:      rawToken,
+			Headers:       map[string]string{"X-Tenant": "b"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(2),
+		},
+	})
 }
 
-func TestGzipCompression(t *testing.T) {
+func TestAuthzInvalidation(t *testing.T) {
+	var policyRequests int32
+
+	policyServer := newFakePolicyServer(t, &policyRequests)
+	defer policyServer.Close()
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+	defer redisServer.Close()
+
 	cfg := newFakeKeycloakConfig()
-	server := httptest.NewServer(&fakeUpstreamService{})
+	cfg.EnableHTTPAuthz = true
+	cfg.EnableDefaultDeny = true
+	cfg.HTTPAuthzURL = policyServer.URL
+	cfg.HTTPAuthzTimeout = time.Second
+	cfg.ListenAdmin = "127.0.0.1:12304"
+	cfg.StoreURL = fmt.Sprintf("redis://%s/4", redisServer.Addr())
+	cfg.AuthzDenyTTL = time.Minute
 
-	requests := []struct {
-		Name              string
-		ProxySettings     func(c *Config)
-		ExecutionSettings []fakeRequest
-	}{
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token := newTestToken(p.idp.getLocation())
+	token.addRealmRoles([]string{"admin"})
+	rawToken, err := token.getToken()
+	assert.NoError(t, err)
+
+	expectPolicyRequests := func(expected int32) func(int, *resty.Request, *resty.Response) {
+		return func(int, *resty.Request, *resty.Response) {
+			assert.Equal(t, expected, atomic.LoadInt32(&policyRequests))
+		}
+	}
+
+	p.RunTests(t, []fakeRequest{
 		{
-			Name: "TestCompressionWithCustomURI",
-			ProxySettings: func(c *Config) {
-				c.EnableCompression = true
-				c.EnableLogging = false
-			},
-			ExecutionSettings: []fakeRequest{
-				{
-					URI:           "/gambol99.htm",
-					ExpectedProxy: true,
-					Headers: map[string]string{
-						"Accept-Encoding": "gzip, deflate, br",
-					},
-					ExpectedHeaders: map[string]string{
-						"Content-Encoding": "gzip",
-					},
-				},
-			},
+			URI:           "/test?id=1",
+			RawToken:      rawToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(1),
+		},
+		{
+			URI:           "/test?id=1",
+			RawToken:      rawToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(1),
 		},
+		// the policy endpoint is given the query, so the decisions are cached per query
 		{
-			Name: "TestCompressionWithAdminURI",
-			ProxySettings: func(c *Config) {
-				c.EnableCompression = true
-				c.EnableLogging = false
-			},
-			ExecutionSettings: []fakeRequest{
-				{
-					URI:           testAdminURI,
-					ExpectedProxy: false,
-					Headers: map[string]string{
-						"Accept-Encoding": "gzip, deflate, br",
-					},
-					ExpectedNoProxyHeaders: []string{"Content-Encoding"},
-				},
-			},
+			URI:           "/test?id=2",
+			RawToken:      rawToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(2),
 		},
 		{
-			Name: "TestCompressionWithLogging",
-			ProxySettings: func(c *Config) {
-				c.EnableCompression = true
-				c.EnableLogging = true
-			},
-			ExecutionSettings: []fakeRequest{
-				{
-					URL:                     server.URL + "/test",
-					ProxyRequest:            true,
-					ExpectedProxy:           true,
-					ExpectedCode:            http.StatusOK,
-					ExpectedContentContains: "/test",
-					Headers: map[string]string{
-						"Accept-Encoding": "gzip, deflate, br",
-					},
-					ExpectedHeaders: map[string]string{
-						"Content-Encoding": "gzip",
-					},
-				},
+			URI:           "/test?id=1",
+			Method:        http.MethodDelete,
+			RawToken:      rawToken,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusForbidden,
+			OnResponse: func(int, *resty.Request, *resty.Response) {
+				assert.Equal(t, int32(3), atomic.LoadInt32(&policyRequests))
+
+				// the denials are cached for the deny ttl, the allows until the token expires
+				for _, key := range redisServer.DB(4).Keys() {
+					value, err := redisServer.DB(4).Get(key)
+					assert.NoError(t, err)
+
+					decision := &authorization.Decision{}
+					assert.NoError(t, json.Unmarshal([]byte(value), decision))
+
+					if decision.Result == authorization.DeniedAuthz {
+						assert.Equal(t, time.Minute, redisServer.DB(4).TTL(key))
+					} else {
+						assert.Greater(t, int64(redisServer.DB(4).TTL(key)), int64(time.Minute))
+					}
+				}
 			},
 		},
 		{
-			Name: "TestWithoutCompressionCustomURI",
-			ProxySettings: func(c *Config) {
-				c.EnableCompression = false
-				c.EnableLogging = false
-			},
-			ExecutionSettings: []fakeRequest{
-				{
-					URI:           "/gambol99.htm",
-					ExpectedProxy: true,
-					Headers: map[string]string{
-						"Accept-Encoding": "gzip, deflate, br",
-					},
-					ExpectedNoProxyHeaders: []string{"Content-Encoding"},
-				},
-			},
+			URI:          "/oauth/authz/" + token.claims.Sub,
+			Method:       http.MethodDelete,
+			ExpectedCode: http.StatusNotFound,
+			OnResponse:   expectPolicyRequests(3),
 		},
 		{
-			Name: "TestWithoutCompressionWithAdminURI",
-			ProxySettings: func(c *Config) {
-				c.EnableCompression = false
-				c.EnableLogging = false
-			},
-			ExecutionSettings: []fakeRequest{
-				{
-					URI:           testAdminURI,
-					ExpectedProxy: false,
-					Headers: map[string]string{
-						"Accept-Encoding": "gzip, deflate, br",
-					},
-					ExpectedNoProxyHeaders: []string{"Content-Encoding"},
-				},
+			URL:          "http://127.0.0.1:12304/oauth/authz/" + token.claims.Sub,
+			Method:       http.MethodDelete,
+			ExpectedCode: http.StatusNoContent,
+			OnResponse: func(int, *resty.Request, *resty.Response) {
+				assert.Empty(t, redisServer.DB(4).Keys())
 			},
 		},
-	}
+		{
+			URI:           "/test?id=1",
+			RawToken:      rawToken,
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			OnResponse:    expectPolicyRequests(4),
+		},
+	})
+}
 
-	for _, testCase := range requests {
-		testCase := testCase
-		cfg := *cfg
-		cfg.Resources = []*Resource{{URL: "/admin*", Methods: allHTTPMethods}}
+func TestAuthzDecisionReasonHeader(t *testing.T) {
+	var policyRequests int32
 
-		t.Run(
-			testCase.Name,
-			func(t *testing.T) {
-				testCase.ProxySettings(&cfg)
-				p := newFakeProxy(&cfg, &fakeAuthConfig{})
-				p.RunTests(t, testCase.ExecutionSettings)
-			},
-		)
+	policyServer := newFakePolicyServer(t, &policyRequests)
+	defer policyServer.Close()
+
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
 	}
-}
+	defer redisServer.Close()
 
-func TestEnableUma(t *testing.T) {
-	cfg := newFakeKeycloakConfig()
+	expectReason := func(expected string) func(int, *resty.Request, *resty.Response) {
+		return func(_ int, _ *resty.Request, resp *resty.Response) {
+			assert.Equal(t, expected, resp.Header().Get(authzDecisionReasonHeader))
+		}
+	}
+
+	httpAuthz := func(conf *Config) {
+		conf.EnableHTTPAuthz = true
+		conf.EnableDefaultDeny = true
+		conf.HTTPAuthzURL = policyServer.URL
+		conf.HTTPAuthzTimeout = time.Second
+	}
 
 	requests := []struct {
 		Name              string
@@ -1806,133 +3294,51 @@ func TestEnableUma(t *testing.T) {
 		ExecutionSettings []fakeRequest
 	}{
 		{
-			Name: "TestUmaNoToken",
+			Name: "TestReasonNotVerbose",
 			ProxySettings: func(conf *Config) {
-				conf.EnableUma = true
-				conf.EnableDefaultDeny = true
-				conf.ClientID = validUsername
-				conf.ClientSecret = validPassword
-				conf.PatRetryCount = 5
-				conf.PatRetryInterval = 2 * time.Second
+				httpAuthz(conf)
+				conf.Verbose = false
 			},
 			ExecutionSettings: []fakeRequest{
 				{
 					URI:           "/test",
+					Method:        http.MethodDelete,
+					HasToken:      true,
+					Roles:         []string{"admin"},
 					ExpectedProxy: false,
-					ExpectedCode:  http.StatusUnauthorized,
-					ExpectedContent: func(body string, testNum int) {
-						assert.Equal(t, "", body)
-					},
-					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
-						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
-							assert.Contains(t, "ticket", value)
-						},
-					},
-				},
-			},
-		},
-		{
-			Name: "TestUmaTokenWithoutAuthz",
-			ProxySettings: func(conf *Config) {
-				conf.EnableUma = true
-				conf.EnableDefaultDeny = true
-				conf.ClientID = validUsername
-				conf.ClientSecret = validPassword
-				conf.PatRetryCount = 5
-				conf.PatRetryInterval = 2 * time.Second
-			},
-			ExecutionSettings: []fakeRequest{
-				{
-					URI:                "/test",
-					ExpectedProxy:      false,
-					HasToken:           true,
-					ExpectedCode:       http.StatusUnauthorized,
-					TokenAuthorization: &authorization.Permissions{},
-					ExpectedContent: func(body string, testNum int) {
-						assert.Equal(t, "", body)
-					},
-					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
-						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
-							assert.Contains(t, "ticket", value)
-						},
-					},
+					ExpectedCode:  http.StatusForbidden,
+					OnResponse:    expectReason(""),
 				},
 			},
 		},
 		{
-			Name: "TestUmaTokenWithoutResourceId",
+			Name: "TestReasonVerbose",
 			ProxySettings: func(conf *Config) {
-				conf.EnableUma = true
-				conf.EnableDefaultDeny = true
-				conf.ClientID = validUsername
-				conf.ClientSecret = validPassword
-				conf.PatRetryCount = 5
-				conf.PatRetryInterval = 2 * time.Second
+				httpAuthz(conf)
+				conf.Verbose = true
 			},
 			ExecutionSettings: []fakeRequest{
 				{
 					URI:           "/test",
-					ExpectedProxy: false,
 					HasToken:      true,
-					ExpectedCode:  http.StatusUnauthorized,
-					TokenAuthorization: &authorization.Permissions{
-						Permissions: []authorization.Permission{
-							{
-								Scopes:       []string{"test"},
-								ResourceID:   "",
-								ResourceName: "some",
-							},
-						},
-					},
-					ExpectedContent: func(body string, testNum int) {
-						assert.Equal(t, "", body)
-					},
-					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
-						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
-							assert.Contains(t, "ticket", value)
-						},
-					},
+					Roles:         []string{"admin"},
+					ExpectedProxy: true,
+					ExpectedCode:  http.StatusOK,
+					OnResponse:    expectReason(authorization.ReasonPolicyAllowed),
 				},
-			},
-		},
-		{
-			Name: "TestUmaTokenWithoutScope",
-			ProxySettings: func(conf *Config) {
-				conf.EnableUma = true
-				conf.EnableDefaultDeny = true
-				conf.ClientID = validUsername
-				conf.ClientSecret = validPassword
-				conf.PatRetryCount = 5
-				conf.PatRetryInterval = 2 * time.Second
-			},
-			ExecutionSettings: []fakeRequest{
 				{
 					URI:           "/test",
-					ExpectedProxy: false,
+					Method:        http.MethodDelete,
 					HasToken:      true,
-					ExpectedCode:  http.StatusUnauthorized,
-					TokenAuthorization: &authorization.Permissions{
-						Permissions: []authorization.Permission{
-							{
-								Scopes:       []string{},
-								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
-								ResourceName: "some",
-							},
-						},
-					},
-					ExpectedContent: func(body string, testNum int) {
-						assert.Equal(t, "", body)
-					},
-					ExpectedProxyHeadersValidator: map[string]func(*testing.T, *Config, string){
-						"WWW-Authenticate": func(t *testing.T, c *Config, value string) {
-							assert.Contains(t, "ticket", value)
-						},
-					},
+					Roles:         []string{"admin"},
+					ExpectedProxy: false,
+					ExpectedCode:  http.StatusForbidden,
+					OnResponse:    expectReason(authorization.ReasonPolicyDenied),
 				},
 			},
 		},
 		{
-			Name: "TestUmaOK",
+			Name: "TestReasonVerboseUma",
 			ProxySettings: func(conf *Config) {
 				conf.EnableUma = true
 				conf.EnableDefaultDeny = true
@@ -1940,26 +3346,16 @@ func TestEnableUma(t *testing.T) {
 				conf.ClientSecret = validPassword
 				conf.PatRetryCount = 5
 				conf.PatRetryInterval = 2 * time.Second
+				conf.Verbose = true
 			},
 			ExecutionSettings: []fakeRequest{
 				{
-					URI:           "/test",
-					ExpectedProxy: true,
-					HasToken:      true,
-					ExpectedCode:  http.StatusOK,
-					TokenAuthorization: &authorization.Permissions{
-						Permissions: []authorization.Permission{
-							{
-								Scopes:       []string{"test"},
-								ResourceID:   "6ef1b62e-0fd4-47f2-81fc-eead97a01c22",
-								ResourceName: "some",
-							},
-						},
-					},
-					ExpectedContent: func(body string, testNum int) {
-						assert.Contains(t, body, "test")
-						assert.Contains(t, body, "method")
-					},
+					URI:                "/test",
+					ExpectedProxy:      false,
+					HasToken:           true,
+					ExpectedCode:       http.StatusUnauthorized,
+					TokenAuthorization: &authorization.Permissions{},
+					OnResponse:         expectReason(apperrors.ErrPermissionNotInToken.Error()),
 				},
 			},
 		},
@@ -1967,19 +3363,59 @@ func TestEnableUma(t *testing.T) {
 
 	for _, testCase := range requests {
 		testCase := testCase
-		c := *cfg
 		t.Run(
 			testCase.Name,
 			func(t *testing.T) {
-				testCase.ProxySettings(&c)
-				p := newFakeProxy(&c, &fakeAuthConfig{})
+				cfg := newFakeKeycloakConfig()
+				testCase.ProxySettings(cfg)
+
+				p := newFakeProxy(cfg, &fakeAuthConfig{})
 				p.RunTests(t, testCase.ExecutionSettings)
 			},
 		)
 	}
+
+	// a cached decision keeps the reason it was made for
+	cfg := newFakeKeycloakConfig()
+	httpAuthz(cfg)
+	cfg.Verbose = true
+	cfg.StoreURL = fmt.Sprintf("redis://%s/3", redisServer.Addr())
+
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	token := newTestToken(p.idp.getLocation())
+	token.addRealmRoles([]string{"admin"})
+	rawToken, err := token.getToken()
+	assert.NoError(t, err)
+
+	var policyDenials int32
+
+	p.RunTests(t, []fakeRequest{
+		{
+			URI:           "/test",
+			Method:        http.MethodDelete,
+			RawToken:      rawToken,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusForbidden,
+			OnResponse: func(idx int, req *resty.Request, resp *resty.Response) {
+				expectReason(authorization.ReasonPolicyDenied)(idx, req, resp)
+				policyDenials = atomic.LoadInt32(&policyRequests)
+			},
+		},
+		{
+			URI:           "/test",
+			Method:        http.MethodDelete,
+			RawToken:      rawToken,
+			ExpectedProxy: false,
+			ExpectedCode:  http.StatusForbidden,
+			OnResponse: func(idx int, req *resty.Request, resp *resty.Response) {
+				expectReason(authorization.ReasonPolicyDenied)(idx, req, resp)
+				assert.Equal(t, policyDenials, atomic.LoadInt32(&policyRequests))
+			},
+		},
+	})
 }
 
-// nolint:funlen
 func TestEnableUmaWithCache(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 
@@ -2333,7 +3769,7 @@ func TestEnableUmaWithCache(t *testing.T) {
 
 				fProxy.RunTests(t, exSettings)
 
-				result := fProxy.proxy.store.(storage.RedisStore).Client.Keys("*")
+				result := fProxy.proxy.store.(*storage.InstrumentedStore).Storage.(storage.RedisStore).Client.Keys(context.Background(), "*")
 				if len(result.Val()) != testCase.ExpectedCacheEntries {
 					t.Fatalf(
 						"expected number of entries %d, got %d",
@@ -2344,8 +3780,10 @@ func TestEnableUmaWithCache(t *testing.T) {
 
 				if testCase.ExpectedCacheValues != authorization.UndefinedAuthz {
 					for _, val := range result.Val() {
-						result := fProxy.proxy.store.(storage.RedisStore).Client.Get(val)
-						if result.Val() != testCase.ExpectedCacheValues.String() {
+						result := fProxy.proxy.store.(*storage.InstrumentedStore).Storage.(storage.RedisStore).Client.Get(context.Background(), val)
+						decision := &authorization.Decision{}
+
+						if err := json.Unmarshal([]byte(result.Val()), decision); err != nil || decision.Result != testCase.ExpectedCacheValues {
 							t.Fatalf(
 								"expecting cached authz %s, got %s",
 								testCase.ExpectedCacheValues.String(),
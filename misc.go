@@ -17,6 +17,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"path"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"github.com/Nerzal/gocloak/v11"
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
 	"go.uber.org/zap"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
@@ -121,6 +123,32 @@ func (r *oauthProxy) redirectToURL(url string, wrt http.ResponseWriter, req *htt
 	return r.revokeProxy(wrt, req)
 }
 
+// getAuthzProvider returns the provider making the authorization decision for the request
+func (r *oauthProxy) getAuthzProvider(req *http.Request, user *userContext, umaScope string) authorization.Provider {
+	if r.config.EnableHTTPAuthz {
+		return &authorization.HTTPAuthorizationProvider{
+			URL:     r.config.HTTPAuthzURL,
+			Timeout: r.config.HTTPAuthzTimeout,
+			Input:   authorization.NewHTTPAuthorizationInput(req, r.config.HTTPAuthzHeaders, user.claims, user.roles, user.groups),
+		}
+	}
+
+	r.pat.m.Lock()
+	token := r.pat.Token.AccessToken
+	r.pat.m.Unlock()
+
+	return &authorization.KeycloakAuthorizationProvider{
+		Permissions:   user.permissions,
+		TargetPath:    req.URL.Path,
+		IdpClient:     r.idpClient,
+		IdpTimeout:    r.config.OpenIDProviderTimeout,
+		PAT:           token,
+		Realm:         r.config.Realm,
+		RequiredScope: umaScope,
+		Resources:     r.umaResources,
+	}
+}
+
 // redirectToAuthorization redirects the user to authorization handler
 func (r *oauthProxy) redirectToAuthorization(wrt http.ResponseWriter, req *http.Request) context.Context {
 	if r.config.NoRedirects && !r.config.EnableUma {
@@ -136,22 +164,17 @@ func (r *oauthProxy) redirectToAuthorization(wrt http.ResponseWriter, req *http.
 
 		defer cancel()
 
-		matchingURI := true
-
-		resourceParam := gocloak.GetResourceParams{
-			URI:         &req.URL.Path,
-			MatchingURI: &matchingURI,
-		}
-
 		r.pat.m.Lock()
 		token := r.pat.Token.AccessToken
 		r.pat.m.Unlock()
 
-		resources, err := r.idpClient.GetResourcesClient(
+		resources, err := authorization.GetResources(
 			ctx,
+			r.umaResources,
+			r.idpClient,
 			token,
 			r.config.Realm,
-			resourceParam,
+			req.URL.Path,
 		)
 
 		if err != nil {
@@ -173,22 +196,24 @@ func (r *oauthProxy) redirectToAuthorization(wrt http.ResponseWriter, req *http.
 			return r.revokeProxy(wrt, req)
 		}
 
+		var resource *Resource
+		if scope, ok := req.Context().Value(contextScopeName).(*RequestScope); ok {
+			resource = scope.Resource
+		}
+
 		resourceID := resources[0].ID
-		resourceScopes := make([]string, 0)
+		resourceScopes, err := getTicketScopes(resources[0], r.getUmaScope(resource, req.Method))
 
-		if len(*resources[0].ResourceScopes) == 0 {
+		if err != nil {
 			r.log.Error(
-				"missingg scopes for resource in IDP provider",
+				"problem getting the scopes of the resource in IDP provider",
 				zap.String("resourceID", *resourceID),
+				zap.Error(err),
 			)
 			wrt.WriteHeader(http.StatusUnauthorized)
 			return r.revokeProxy(wrt, req)
 		}
 
-		for _, scope := range *resources[0].ResourceScopes {
-			resourceScopes = append(resourceScopes, *scope.Name)
-		}
-
 		permissions := []gocloak.CreatePermissionTicketParams{
 			{
 				ResourceID:     resourceID,
@@ -229,7 +254,13 @@ func (r *oauthProxy) redirectToAuthorization(wrt http.ResponseWriter, req *http.
 	}
 
 	// step: add a state referrer to the authorization page
-	uuid := r.writeStateParameterCookie(req, wrt)
+	uuid, err := r.writeStateParameterCookie(req, wrt)
+	if err != nil {
+		r.log.Error("unable to write the state of the login", zap.Error(err))
+		wrt.WriteHeader(http.StatusInternalServerError)
+		return r.revokeProxy(wrt, req)
+	}
+
 	authQuery := fmt.Sprintf("?state=%s", uuid)
 
 	// step: if verification is switched off, we can't authorization
@@ -253,6 +284,44 @@ func (r *oauthProxy) redirectToAuthorization(wrt http.ResponseWriter, req *http.
 	return r.revokeProxy(wrt, req)
 }
 
+// getUmaScope returns the uma scope required for the method, the mapping of the resource
+// takes precedence over the global one, empty when none is required
+func (r *oauthProxy) getUmaScope(resource *Resource, method string) string {
+	if resource != nil {
+		if scope, found := resource.UmaMethodScopes[method]; found {
+			return scope
+		}
+	}
+
+	return r.config.UmaMethodScopes[method]
+}
+
+// getTicketScopes returns the scopes to request the permission ticket for, only the required
+// scope when there is one, else all the scopes of the resource
+func getTicketScopes(resource *gocloak.ResourceRepresentation, required string) ([]string, error) {
+	if resource.ResourceScopes == nil || len(*resource.ResourceScopes) == 0 {
+		return nil, errors.New("missing scopes for resource in IDP provider")
+	}
+
+	scopes := make([]string, 0, len(*resource.ResourceScopes))
+
+	for _, scope := range *resource.ResourceScopes {
+		if scope.Name == nil {
+			continue
+		}
+
+		if required == "" || *scope.Name == required {
+			scopes = append(scopes, *scope.Name)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("the resource does not define the required scope %s", required)
+	}
+
+	return scopes, nil
+}
+
 // getAccessCookieExpiration calculates the expiration of the access token cookie
 func (r *oauthProxy) getAccessCookieExpiration(refresh string) time.Duration {
 	// notes: by default the duration of the access token will be the configuration option, if
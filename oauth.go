@@ -16,7 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/base64"
 	"net/http"
 	"strings"
 	"time"
@@ -161,13 +164,56 @@ func getRefreshedToken(conf *oauth2.Config, proxyConfig *Config, oldRefreshToken
 		nil
 }
 
-// exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token
-func exchangeAuthenticationCode(client *oauth2.Config, code string, skipOpenIDProviderTLSVerify bool) (*oauth2.Token, error) {
-	return getToken(client, GrantTypeAuthCode, code, skipOpenIDProviderTLSVerify)
+// exchangeAuthenticationCode exchanges the authentication code with the oauth server for a access token,
+// along with the pkce code verifier of the login if any
+func exchangeAuthenticationCode(
+	client *oauth2.Config,
+	code string,
+	codeVerifier string,
+	skipOpenIDProviderTLSVerify bool,
+) (*oauth2.Token, error) {
+	opts := make([]oauth2.AuthCodeOption, 0)
+
+	if codeVerifier != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	}
+
+	return getToken(client, GrantTypeAuthCode, code, skipOpenIDProviderTLSVerify, opts...)
+}
+
+// newCodeVerifier generates a pkce code verifier, 32 random bytes encoded as 43 characters
+func newCodeVerifier() (string, error) {
+	random := make([]byte, 32)
+
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// getCodeChallenge returns the S256 pkce code challenge of the code verifier
+func getCodeChallenge(codeVerifier string) string {
+	digest := sha256.Sum256([]byte(codeVerifier))
+
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// getNonce returns the nonce of the login, the hash of its state cookie so that the id token
+// can only be used by the browser which started the login
+func getNonce(state string) string {
+	digest := sha256.Sum256([]byte(state))
+
+	return base64.RawURLEncoding.EncodeToString(digest[:])
 }
 
 // getToken retrieves a code from the provider, extracts and verified the token
-func getToken(config *oauth2.Config, grantType, code string, skipOpenIDProviderTLSVerify bool) (*oauth2.Token, error) {
+func getToken(
+	config *oauth2.Config,
+	grantType, code string,
+	skipOpenIDProviderTLSVerify bool,
+	opts ...oauth2.AuthCodeOption,
+) (*oauth2.Token, error) {
 	ctx := context.Background()
 
 	if skipOpenIDProviderTLSVerify {
@@ -182,7 +228,7 @@ func getToken(config *oauth2.Config, grantType, code string, skipOpenIDProviderT
 	}
 
 	start := time.Now()
-	token, err := config.Exchange(ctx, code)
+	token, err := config.Exchange(ctx, code, opts...)
 
 	if err != nil {
 		return token, err
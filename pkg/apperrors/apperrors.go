@@ -17,4 +17,6 @@ var (
 	ErrInvalidSession                  = errors.New("invalid session identifier")
 	ErrRefreshTokenExpired             = errors.New("the refresh token has expired")
 	ErrDecryption                      = errors.New("failed to decrypt token")
+	ErrExternalAuthzRequest            = errors.New("problem getting decision from the external authorization")
+	ErrTokenInactive                   = errors.New("the token is not active")
 )
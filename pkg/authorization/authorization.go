@@ -2,7 +2,6 @@ package authorization
 
 import (
 	"context"
-	"net/http"
 	"strconv"
 	"time"
 
@@ -40,77 +39,191 @@ func (decision AuthzDecision) String() string {
 	return strconv.Itoa(int(DeniedAuthz))
 }
 
+// CacheStatus tells whether a decision was made for the request or read from the cache
+type CacheStatus string
+
+const (
+	// CacheNone is a decision made without a cache in front of the provider
+	CacheNone CacheStatus = "none"
+	// CacheMiss is a decision made by the provider and then cached
+	CacheMiss CacheStatus = "miss"
+	// CacheHit is a decision read from the cache
+	CacheHit CacheStatus = "hit"
+)
+
+// the reasons of the decisions which are not made on an error
+const (
+	ReasonPermissionGranted = "permission in token grants the resource"
+	ReasonPolicyAllowed     = "allowed by the policy endpoint"
+	ReasonPolicyDenied      = "denied by the policy endpoint"
+)
+
+// Decision is an authorization decision along with what it is based on
+type Decision struct {
+	Result AuthzDecision `json:"result"`
+	// Reason explains the decision
+	Reason string `json:"reason"`
+	// ResourceID is the resource the decision was made on, if any
+	ResourceID string `json:"resource_id,omitempty"`
+	// GrantedScopes are the scopes the token holds on the resource
+	GrantedScopes []string `json:"granted_scopes,omitempty"`
+	// RequiredScopes are the scopes the request needs, any of them when several
+	RequiredScopes []string `json:"required_scopes,omitempty"`
+	// CacheStatus is set by the caller, which knows about the cache
+	CacheStatus CacheStatus `json:"-"`
+}
+
+// deny turns the decision into a denial for the reason of the error
+func (d *Decision) deny(err error) (*Decision, error) {
+	d.Result = DeniedAuthz
+	d.Reason = err.Error()
+
+	return d, err
+}
+
+// Provider makes the authorization decision for a single request, it is created per request
+// with everything it needs to decide
 type Provider interface {
-	Authorize(Permissions, *http.Request, gocloak.GoCloak, time.Duration, string, string) (AuthzDecision, error)
+	Authorize() (*Decision, error)
 }
 
 var _ Provider = (*KeycloakAuthorizationProvider)(nil)
 
-type KeycloakAuthorizationProvider struct{}
-
-func (p *KeycloakAuthorizationProvider) Authorize(
-	perms Permissions,
-	req *http.Request,
-	idpClient gocloak.GoCloak,
-	idpTimeout time.Duration,
-	PAT string,
-	realm string,
-) (AuthzDecision, error) {
-	if len(perms.Permissions) == 0 {
-		return DeniedAuthz, apperrors.ErrPermissionNotInToken
+// KeycloakAuthorizationProvider checks the uma permissions in the token against the
+// resources registered in keycloak for the path
+type KeycloakAuthorizationProvider struct {
+	// Permissions are the uma permissions of the token
+	Permissions Permissions
+	// TargetPath is the path of the request
+	TargetPath string
+	IdpClient  gocloak.GoCloak
+	IdpTimeout time.Duration
+	PAT        string
+	Realm      string
+	// RequiredScope is the scope the request needs, i.e. for its method, any scope of the
+	// resource is accepted when empty
+	RequiredScope string
+	// Resources is the local cache of the resources, keycloak is asked for them when not loaded
+	Resources *ResourceCache
+}
+
+func (p *KeycloakAuthorizationProvider) Authorize() (*Decision, error) {
+	decision := &Decision{Result: DeniedAuthz, RequiredScopes: p.requiredScopes(nil)}
+
+	if len(p.Permissions.Permissions) == 0 {
+		return decision.deny(apperrors.ErrPermissionNotInToken)
 	}
 
 	resctx, cancel := context.WithTimeout(
 		context.Background(),
-		idpTimeout,
+		p.IdpTimeout,
 	)
 
 	defer cancel()
 
-	matchingURI := true
-
-	resourceParam := gocloak.GetResourceParams{
-		URI:         &req.URL.Path,
-		MatchingURI: &matchingURI,
-	}
-
-	resources, err := idpClient.GetResourcesClient(
+	resources, err := GetResources(
 		resctx,
-		PAT,
-		realm,
-		resourceParam,
+		p.Resources,
+		p.IdpClient,
+		p.PAT,
+		p.Realm,
+		p.TargetPath,
 	)
 
 	if err != nil {
-		return DeniedAuthz, apperrors.ErrResourceRetrieve
+		return decision.deny(apperrors.ErrResourceRetrieve)
 	}
 
 	if len(resources) == 0 {
-		return DeniedAuthz, apperrors.ErrNoIDPResourceForPath
+		return decision.deny(apperrors.ErrNoIDPResourceForPath)
+	}
+
+	// step: any permission in the token for any of the resources matching the uri grants access,
+	// the most specific error is kept for when none does
+	err = apperrors.ErrResourceIDNotPresent
+
+	for _, resource := range resources {
+		if resource == nil || resource.ID == nil {
+			continue
+		}
+
+		for _, perm := range p.Permissions.Permissions {
+			if perm.ResourceID != *resource.ID {
+				continue
+			}
+
+			decision.ResourceID = *resource.ID
+			decision.GrantedScopes = perm.Scopes
+			decision.RequiredScopes = p.requiredScopes(resource)
+
+			if p.grants(resource, perm) {
+				decision.Result = AllowedAuthz
+				decision.Reason = ReasonPermissionGranted
+
+				return decision, nil
+			}
+
+			err = apperrors.ErrTokenScopeNotMatchResourceScope
+		}
+	}
+
+	return decision.deny(err)
+}
+
+// requiredScopes returns the required scope, else the scopes of the resource any of which is enough
+func (p *KeycloakAuthorizationProvider) requiredScopes(resource *gocloak.ResourceRepresentation) []string {
+	if p.RequiredScope != "" {
+		return []string{p.RequiredScope}
+	}
+
+	if resource == nil || resource.ResourceScopes == nil {
+		return nil
 	}
 
-	resourceID := resources[0].ID
+	scopes := make([]string, 0, len(*resource.ResourceScopes))
 
-	if *resourceID != perms.Permissions[0].ResourceID {
-		return DeniedAuthz, apperrors.ErrResourceIDNotPresent
+	for _, scope := range *resource.ResourceScopes {
+		if scope.Name != nil {
+			scopes = append(scopes, *scope.Name)
+		}
 	}
 
-	inter := make([]bool, 0)
-	permScopes := make(map[string]bool)
+	return scopes
+}
 
-	for _, scope := range *resources[0].ResourceScopes {
-		permScopes[*scope.Name] = true
+// grants checks the permission grants the required scope, else any scope of the resource
+func (p *KeycloakAuthorizationProvider) grants(resource *gocloak.ResourceRepresentation, perm Permission) bool {
+	if p.RequiredScope == "" {
+		return scopesIntersect(resource, perm)
 	}
 
-	for _, scope := range perms.Permissions[0].Scopes {
-		if permScopes[scope] {
-			inter = append(inter, true)
+	for _, scope := range perm.Scopes {
+		if scope == p.RequiredScope {
+			return true
 		}
 	}
 
-	if len(inter) == 0 {
-		return DeniedAuthz, apperrors.ErrTokenScopeNotMatchResourceScope
+	return false
+}
+
+// scopesIntersect checks the permission grants at least one of the scopes of the resource,
+// a resource without scopes is never granted
+func scopesIntersect(resource *gocloak.ResourceRepresentation, perm Permission) bool {
+	if resource.ResourceScopes == nil {
+		return false
+	}
+
+	permScopes := make(map[string]bool, len(perm.Scopes))
+
+	for _, scope := range perm.Scopes {
+		permScopes[scope] = true
+	}
+
+	for _, scope := range *resource.ResourceScopes {
+		if scope.Name != nil && permScopes[*scope.Name] {
+			return true
+		}
 	}
 
-	return AllowedAuthz, nil
+	return false
 }
@@ -0,0 +1,329 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authorization
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v11"
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIdpClient returns the configured resources for any uri, paged when asked to
+type fakeIdpClient struct {
+	gocloak.GoCloak
+	resources []*gocloak.ResourceRepresentation
+	err       error
+	requests  int
+}
+
+func (f *fakeIdpClient) GetResourcesClient(
+	ctx context.Context,
+	token, realm string,
+	params gocloak.GetResourceParams,
+) ([]*gocloak.ResourceRepresentation, error) {
+	f.requests++
+
+	if f.err != nil || params.First == nil || params.Max == nil {
+		return f.resources, f.err
+	}
+
+	if *params.First >= len(f.resources) {
+		return nil, nil
+	}
+
+	last := *params.First + *params.Max
+	if last > len(f.resources) {
+		last = len(f.resources)
+	}
+
+	return f.resources[*params.First:last], nil
+}
+
+func newFakeResource(id string, scopes ...string) *gocloak.ResourceRepresentation {
+	resourceScopes := make([]gocloak.ScopeRepresentation, 0, len(scopes))
+
+	for _, scope := range scopes {
+		resourceScopes = append(resourceScopes, gocloak.ScopeRepresentation{Name: gocloak.StringP(scope)})
+	}
+
+	return &gocloak.ResourceRepresentation{
+		ID:             gocloak.StringP(id),
+		ResourceScopes: &resourceScopes,
+	}
+}
+
+func TestKeycloakAuthorize(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		Permissions      []Permission
+		RequiredScope    string
+		Resources        []*gocloak.ResourceRepresentation
+		ResourcesError   error
+		ExpectedDecision AuthzDecision
+		ExpectedError    error
+	}{
+		{
+			Name:             "NoPermissions",
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrPermissionNotInToken,
+		},
+		{
+			Name:             "ResourceRetrieveFailure",
+			Permissions:      []Permission{{ResourceID: "a", Scopes: []string{"read"}}},
+			ResourcesError:   errors.New("failed"),
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrResourceRetrieve,
+		},
+		{
+			Name:             "NoResourceForPath",
+			Permissions:      []Permission{{ResourceID: "a", Scopes: []string{"read"}}},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrNoIDPResourceForPath,
+		},
+		{
+			Name:             "SinglePermissionAllowed",
+			Permissions:      []Permission{{ResourceID: "a", Scopes: []string{"read"}}},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name: "MatchingPermissionNotFirst",
+			Permissions: []Permission{
+				{ResourceID: "b", Scopes: []string{"read"}},
+				{ResourceID: "c", Scopes: []string{"write"}},
+				{ResourceID: "a", Scopes: []string{"read"}},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name: "MatchingResourceNotFirst",
+			Permissions: []Permission{
+				{ResourceID: "b", Scopes: []string{"write"}},
+			},
+			Resources: []*gocloak.ResourceRepresentation{
+				newFakeResource("a", "read"),
+				newFakeResource("b", "read", "write"),
+			},
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name: "NoPermissionForResource",
+			Permissions: []Permission{
+				{ResourceID: "b", Scopes: []string{"read"}},
+				{ResourceID: "c", Scopes: []string{"read"}},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrResourceIDNotPresent,
+		},
+		{
+			Name: "ScopesDoNotIntersect",
+			Permissions: []Permission{
+				{ResourceID: "b", Scopes: []string{"read"}},
+				{ResourceID: "a", Scopes: []string{"write", "delete"}},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrTokenScopeNotMatchResourceScope,
+		},
+		{
+			Name: "ScopesIntersectOnSecondPermissionForResource",
+			Permissions: []Permission{
+				{ResourceID: "a", Scopes: []string{"delete"}},
+				{ResourceID: "a", Scopes: []string{"write", "read"}},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name: "PermissionWithoutScopes",
+			Permissions: []Permission{
+				{ResourceID: "a"},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read")},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrTokenScopeNotMatchResourceScope,
+		},
+		{
+			Name: "ResourceWithoutScopes",
+			Permissions: []Permission{
+				{ResourceID: "a"},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a")},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrTokenScopeNotMatchResourceScope,
+		},
+		{
+			Name: "ResourceWithNilScopes",
+			Permissions: []Permission{
+				{ResourceID: "a", Scopes: []string{"read"}},
+			},
+			Resources:        []*gocloak.ResourceRepresentation{{ID: gocloak.StringP("a")}},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrTokenScopeNotMatchResourceScope,
+		},
+		{
+			Name: "RequiredScopeGranted",
+			Permissions: []Permission{
+				{ResourceID: "a", Scopes: []string{"read", "write"}},
+			},
+			RequiredScope:    "write",
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read", "write", "delete")},
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name: "RequiredScopeNotGranted",
+			Permissions: []Permission{
+				{ResourceID: "a", Scopes: []string{"read"}},
+			},
+			RequiredScope:    "delete",
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read", "delete")},
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    apperrors.ErrTokenScopeNotMatchResourceScope,
+		},
+		{
+			Name: "RequiredScopeGrantedByLaterPermission",
+			Permissions: []Permission{
+				{ResourceID: "a", Scopes: []string{"read"}},
+				{ResourceID: "a", Scopes: []string{"delete"}},
+			},
+			RequiredScope:    "delete",
+			Resources:        []*gocloak.ResourceRepresentation{newFakeResource("a", "read", "delete")},
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name: "ResourceWithoutID",
+			Permissions: []Permission{
+				{ResourceID: "a", Scopes: []string{"read"}},
+			},
+			Resources: []*gocloak.ResourceRepresentation{
+				{},
+				newFakeResource("a", "read"),
+			},
+			ExpectedDecision: AllowedAuthz,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				idpClient := &fakeIdpClient{
+					resources: testCase.Resources,
+					err:       testCase.ResourcesError,
+				}
+
+				provider := &KeycloakAuthorizationProvider{
+					Permissions:   Permissions{Permissions: testCase.Permissions},
+					TargetPath:    "/resource",
+					IdpClient:     idpClient,
+					IdpTimeout:    time.Second,
+					PAT:           "pat",
+					Realm:         "realm",
+					RequiredScope: testCase.RequiredScope,
+				}
+				decision, err := provider.Authorize()
+
+				assert.Equal(t, testCase.ExpectedError, err)
+				assert.Equal(t, testCase.ExpectedDecision, decision.Result)
+
+				if testCase.ExpectedError != nil {
+					assert.Equal(t, testCase.ExpectedError.Error(), decision.Reason)
+				} else {
+					assert.Equal(t, ReasonPermissionGranted, decision.Reason)
+				}
+			},
+		)
+	}
+}
+
+func TestKeycloakAuthorizeDecision(t *testing.T) {
+	testCases := []struct {
+		Name                   string
+		Permissions            []Permission
+		RequiredScope          string
+		ExpectedResourceID     string
+		ExpectedGrantedScopes  []string
+		ExpectedRequiredScopes []string
+	}{
+		{
+			Name:                   "NoPermissions",
+			ExpectedRequiredScopes: nil,
+		},
+		{
+			Name:                   "NoPermissionsWithRequiredScope",
+			RequiredScope:          "write",
+			ExpectedRequiredScopes: []string{"write"},
+		},
+		{
+			Name:                   "NoPermissionForResource",
+			Permissions:            []Permission{{ResourceID: "b", Scopes: []string{"read"}}},
+			ExpectedRequiredScopes: nil,
+		},
+		{
+			Name:                   "ScopesOfTheResource",
+			Permissions:            []Permission{{ResourceID: "a", Scopes: []string{"write"}}},
+			ExpectedResourceID:     "a",
+			ExpectedGrantedScopes:  []string{"write"},
+			ExpectedRequiredScopes: []string{"read", "delete"},
+		},
+		{
+			Name:                   "RequiredScope",
+			Permissions:            []Permission{{ResourceID: "a", Scopes: []string{"read"}}},
+			RequiredScope:          "delete",
+			ExpectedResourceID:     "a",
+			ExpectedGrantedScopes:  []string{"read"},
+			ExpectedRequiredScopes: []string{"delete"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				provider := &KeycloakAuthorizationProvider{
+					Permissions: Permissions{Permissions: testCase.Permissions},
+					TargetPath:  "/resource",
+					IdpClient: &fakeIdpClient{
+						resources: []*gocloak.ResourceRepresentation{newFakeResource("a", "read", "delete")},
+					},
+					IdpTimeout:    time.Second,
+					PAT:           "pat",
+					Realm:         "realm",
+					RequiredScope: testCase.RequiredScope,
+				}
+				decision, _ := provider.Authorize()
+
+				assert.Equal(t, DeniedAuthz, decision.Result)
+				assert.Equal(t, testCase.ExpectedResourceID, decision.ResourceID)
+				assert.Equal(t, testCase.ExpectedGrantedScopes, decision.GrantedScopes)
+				assert.Equal(t, testCase.ExpectedRequiredScopes, decision.RequiredScopes)
+			},
+		)
+	}
+}
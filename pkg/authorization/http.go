@@ -0,0 +1,145 @@
+package authorization
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+)
+
+var _ Provider = (*HTTPAuthorizationProvider)(nil)
+
+// HTTPAuthorizationInput describes the request and the identity to the policy endpoint
+type HTTPAuthorizationInput struct {
+	Method  string                 `json:"method"`
+	Path    string                 `json:"path"`
+	Query   string                 `json:"query"`
+	Host    string                 `json:"host"`
+	Headers map[string][]string    `json:"headers"`
+	Claims  map[string]interface{} `json:"claims"`
+	Roles   []string               `json:"roles"`
+	Groups  []string               `json:"groups"`
+}
+
+// HTTPAuthorizationRequest is the body posted to the policy endpoint, the input is wrapped
+// the way the opa data api expects it
+type HTTPAuthorizationRequest struct {
+	Input *HTTPAuthorizationInput `json:"input"`
+}
+
+// HTTPAuthorizationResponse is the answer of the policy endpoint, a missing result,
+// i.e. an undefined decision in opa, is a denial
+type HTTPAuthorizationResponse struct {
+	Result *bool `json:"result"`
+}
+
+// HTTPAuthorizationProvider posts the description of the request and the identity to a
+// policy endpoint, i.e. an opa sidecar, and uses its allow or deny answer
+type HTTPAuthorizationProvider struct {
+	// URL is the policy endpoint, e.g. http://127.0.0.1:8181/v1/data/gatekeeper/allow
+	URL     string
+	Timeout time.Duration
+	Client  *http.Client
+	Input   *HTTPAuthorizationInput
+}
+
+// NewHTTPAuthorizationInput describes the request and the identity, only the given headers
+// are described, all but the credentials when none are given
+func NewHTTPAuthorizationInput(
+	req *http.Request,
+	headers []string,
+	claims map[string]interface{},
+	roles []string,
+	groups []string,
+) *HTTPAuthorizationInput {
+	return &HTTPAuthorizationInput{
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Query:   req.URL.RawQuery,
+		Host:    req.Host,
+		Headers: NewHTTPAuthorizationHeaders(req, headers),
+		Claims:  claims,
+		Roles:   roles,
+		Groups:  groups,
+	}
+}
+
+// NewHTTPAuthorizationHeaders returns the headers of the request described to the policy endpoint,
+// credentials are left out as the identity is already described by the claims
+func NewHTTPAuthorizationHeaders(req *http.Request, names []string) http.Header {
+	headers := req.Header.Clone()
+
+	if len(names) > 0 {
+		headers = make(http.Header, len(names))
+
+		for _, name := range names {
+			if values, found := req.Header[http.CanonicalHeaderKey(name)]; found {
+				headers[http.CanonicalHeaderKey(name)] = append([]string{}, values...)
+			}
+		}
+	}
+
+	headers.Del("Authorization")
+	headers.Del("Cookie")
+
+	return headers
+}
+
+func (p *HTTPAuthorizationProvider) Authorize() (*Decision, error) {
+	decision := &Decision{Result: DeniedAuthz}
+
+	body, err := json.Marshal(&HTTPAuthorizationRequest{Input: p.Input})
+	if err != nil {
+		return decision.deny(err)
+	}
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		p.Timeout,
+	)
+
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return decision.deny(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return decision.deny(fmt.Errorf("%w: %s", apperrors.ErrExternalAuthzRequest, err))
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decision.deny(fmt.Errorf("%w: unexpected status %d", apperrors.ErrExternalAuthzRequest, resp.StatusCode))
+	}
+
+	answer := &HTTPAuthorizationResponse{}
+
+	if err := json.NewDecoder(resp.Body).Decode(answer); err != nil {
+		return decision.deny(fmt.Errorf("%w: %s", apperrors.ErrExternalAuthzRequest, err))
+	}
+
+	if answer.Result == nil || !*answer.Result {
+		decision.Reason = ReasonPolicyDenied
+		return decision, nil
+	}
+
+	decision.Result = AllowedAuthz
+	decision.Reason = ReasonPolicyAllowed
+
+	return decision, nil
+}
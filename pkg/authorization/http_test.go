@@ -0,0 +1,170 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authorization
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPAuthorizationInput(t *testing.T) {
+	req := httptest.NewRequest(http.MethodDelete, "http://example.com/api/users/1?force=true", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("Cookie", "kc-access=token")
+	req.Header.Set("X-Tenant", "a")
+
+	input := NewHTTPAuthorizationInput(
+		req,
+		nil,
+		map[string]interface{}{"sub": "user"},
+		[]string{"admin"},
+		[]string{"/staff"},
+	)
+
+	assert.Equal(t, http.MethodDelete, input.Method)
+	assert.Equal(t, "/api/users/1", input.Path)
+	assert.Equal(t, "force=true", input.Query)
+	assert.Equal(t, "example.com", input.Host)
+	assert.Equal(t, []string{"a"}, input.Headers["X-Tenant"])
+	assert.NotContains(t, input.Headers, "Authorization")
+	assert.NotContains(t, input.Headers, "Cookie")
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	assert.Equal(t, "user", input.Claims["sub"])
+	assert.Equal(t, []string{"admin"}, input.Roles)
+	assert.Equal(t, []string{"/staff"}, input.Groups)
+}
+
+func TestNewHTTPAuthorizationHeaders(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Tenant", "a")
+	req.Header.Set("User-Agent", "curl")
+
+	headers := NewHTTPAuthorizationHeaders(req, []string{"x-tenant", "Authorization", "X-Missing"})
+
+	assert.Equal(t, http.Header{"X-Tenant": {"a"}}, headers)
+	assert.Len(t, NewHTTPAuthorizationHeaders(req, nil), 2)
+}
+
+func TestHTTPAuthorize(t *testing.T) {
+	testCases := []struct {
+		Name             string
+		Status           int
+		Body             string
+		Delay            time.Duration
+		ExpectedDecision AuthzDecision
+		ExpectedError    bool
+	}{
+		{
+			Name:             "Allowed",
+			Status:           http.StatusOK,
+			Body:             `{"result": true}`,
+			ExpectedDecision: AllowedAuthz,
+		},
+		{
+			Name:             "Denied",
+			Status:           http.StatusOK,
+			Body:             `{"result": false}`,
+			ExpectedDecision: DeniedAuthz,
+		},
+		{
+			Name:             "UndefinedDecision",
+			Status:           http.StatusOK,
+			Body:             `{}`,
+			ExpectedDecision: DeniedAuthz,
+		},
+		{
+			Name:             "PolicyEndpointFailure",
+			Status:           http.StatusInternalServerError,
+			Body:             `{"result": true}`,
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    true,
+		},
+		{
+			Name:             "InvalidAnswer",
+			Status:           http.StatusOK,
+			Body:             `{"result": "yes"}`,
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    true,
+		},
+		{
+			Name:             "Timeout",
+			Status:           http.StatusOK,
+			Body:             `{"result": true}`,
+			Delay:            200 * time.Millisecond,
+			ExpectedDecision: DeniedAuthz,
+			ExpectedError:    true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(
+			testCase.Name,
+			func(t *testing.T) {
+				var received HTTPAuthorizationRequest
+
+				server := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+					assert.Equal(t, http.MethodPost, req.Method)
+					assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+					assert.NoError(t, json.NewDecoder(req.Body).Decode(&received))
+
+					<-time.After(testCase.Delay)
+
+					wrt.WriteHeader(testCase.Status)
+					_, _ = wrt.Write([]byte(testCase.Body))
+				}))
+				defer server.Close()
+
+				provider := &HTTPAuthorizationProvider{
+					URL:     server.URL,
+					Timeout: 100 * time.Millisecond,
+					Input: &HTTPAuthorizationInput{
+						Method: http.MethodGet,
+						Path:   "/api",
+						Roles:  []string{"admin"},
+					},
+				}
+
+				decision, err := provider.Authorize()
+
+				assert.Equal(t, testCase.ExpectedDecision, decision.Result)
+				assert.Equal(t, testCase.ExpectedError, err != nil)
+				if testCase.ExpectedError {
+					assert.True(t, errors.Is(err, apperrors.ErrExternalAuthzRequest))
+					assert.Equal(t, err.Error(), decision.Reason)
+				} else if testCase.ExpectedDecision == AllowedAuthz {
+					assert.Equal(t, ReasonPolicyAllowed, decision.Reason)
+				} else {
+					assert.Equal(t, ReasonPolicyDenied, decision.Reason)
+				}
+
+				assert.Equal(t, "/api", received.Input.Path)
+				assert.Equal(t, []string{"admin"}, received.Input.Roles)
+			},
+		)
+	}
+}
@@ -0,0 +1,247 @@
+package authorization
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v11"
+)
+
+// resourcesPageSize is the number of resources requested per page when loading the cache
+const resourcesPageSize = 100
+
+// ResourceCache keeps the uma resources of the client in memory, so the resources
+// matching a path are found locally instead of asking keycloak on every request
+type ResourceCache struct {
+	m         sync.RWMutex
+	resources []*cachedResource
+	updated   time.Time
+}
+
+type cachedResource struct {
+	resource *gocloak.ResourceRepresentation
+	patterns []*uriPattern
+}
+
+// uriPattern is a resource uri compiled for matching, i.e. /api/*, /api/{id} or *.html
+type uriPattern struct {
+	regex    *regexp.Regexp
+	exact    bool
+	literals int
+}
+
+// resourceMatch is a resource matching a path with the most specific of its uris
+type resourceMatch struct {
+	resource *gocloak.ResourceRepresentation
+	pattern  *uriPattern
+}
+
+// NewResourceCache returns an empty resource cache, it is used once loaded
+func NewResourceCache() *ResourceCache {
+	return &ResourceCache{}
+}
+
+// Load retrieves all the resources of the client from keycloak and replaces the cached ones
+func (c *ResourceCache) Load(ctx context.Context, idpClient gocloak.GoCloak, PAT string, realm string) error {
+	deep := true
+	max := resourcesPageSize
+	seen := make(map[string]bool)
+	resources := make([]*cachedResource, 0)
+
+	for first := 0; ; first += max {
+		first := first
+		page, err := idpClient.GetResourcesClient(
+			ctx,
+			PAT,
+			realm,
+			gocloak.GetResourceParams{Deep: &deep, First: &first, Max: &max},
+		)
+
+		if err != nil {
+			return err
+		}
+
+		// @note: resources failing to be retrieved are skipped by the client, so a short
+		// page does not mean the last one, we stop once a page brings nothing new
+		added := 0
+
+		for _, resource := range page {
+			if resource == nil || resource.ID == nil || seen[*resource.ID] {
+				continue
+			}
+
+			seen[*resource.ID] = true
+			added++
+
+			resources = append(resources, newCachedResource(resource))
+		}
+
+		if added == 0 {
+			break
+		}
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.resources = resources
+	c.updated = time.Now()
+
+	return nil
+}
+
+// Loaded checks the cache has been loaded at least once
+func (c *ResourceCache) Loaded() bool {
+	if c == nil {
+		return false
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return !c.updated.IsZero()
+}
+
+// Len returns the number of cached resources
+func (c *ResourceCache) Len() int {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return len(c.resources)
+}
+
+// Match returns the resources with an uri matching the path, the most specific first,
+// like keycloak does for a matching uri lookup
+func (c *ResourceCache) Match(path string) []*gocloak.ResourceRepresentation {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	matches := make([]resourceMatch, 0)
+
+	for _, cached := range c.resources {
+		var best *uriPattern
+
+		for _, pattern := range cached.patterns {
+			if pattern.regex.MatchString(path) && pattern.moreSpecific(best) {
+				best = pattern
+			}
+		}
+
+		if best != nil {
+			matches = append(matches, resourceMatch{resource: cached.resource, pattern: best})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].pattern.moreSpecific(matches[j].pattern)
+	})
+
+	resources := make([]*gocloak.ResourceRepresentation, 0, len(matches))
+
+	for _, match := range matches {
+		resources = append(resources, match.resource)
+	}
+
+	return resources
+}
+
+// GetResources returns the resources matching the path, from the cache once it has been
+// loaded, else from keycloak
+func GetResources(
+	ctx context.Context,
+	cache *ResourceCache,
+	idpClient gocloak.GoCloak,
+	PAT string,
+	realm string,
+	path string,
+) ([]*gocloak.ResourceRepresentation, error) {
+	if cache.Loaded() {
+		return cache.Match(path), nil
+	}
+
+	matchingURI := true
+
+	resourceParam := gocloak.GetResourceParams{
+		URI:         &path,
+		MatchingURI: &matchingURI,
+	}
+
+	return idpClient.GetResourcesClient(
+		ctx,
+		PAT,
+		realm,
+		resourceParam,
+	)
+}
+
+func newCachedResource(resource *gocloak.ResourceRepresentation) *cachedResource {
+	cached := &cachedResource{resource: resource}
+
+	if resource.URIs == nil {
+		return cached
+	}
+
+	for _, uri := range *resource.URIs {
+		if uri == "" {
+			continue
+		}
+
+		cached.patterns = append(cached.patterns, compileURIPattern(uri))
+	}
+
+	return cached
+}
+
+// compileURIPattern turns a resource uri into a regex, a trailing /* matches the path and
+// anything below it, any other * matches anything and {name} matches a single path segment
+func compileURIPattern(uri string) *uriPattern {
+	pattern := &uriPattern{exact: true}
+	expr := strings.Builder{}
+
+	expr.WriteString("^")
+
+	for idx := 0; idx < len(uri); {
+		switch {
+		case uri[idx:] == "/*":
+			expr.WriteString("(/.*)?")
+			pattern.exact = false
+			idx += 2
+		case uri[idx] == '*':
+			expr.WriteString(".*")
+			pattern.exact = false
+			idx++
+		case uri[idx] == '{' && strings.IndexByte(uri[idx:], '}') > 0:
+			expr.WriteString("[^/]+")
+			pattern.exact = false
+			idx += strings.IndexByte(uri[idx:], '}') + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(uri[idx : idx+1]))
+			pattern.literals++
+			idx++
+		}
+	}
+
+	expr.WriteString("$")
+
+	pattern.regex = regexp.MustCompile(expr.String())
+
+	return pattern
+}
+
+// moreSpecific checks the pattern is more specific than the other, an exact uri beats any
+// pattern, else the one with the most literal characters wins
+func (p *uriPattern) moreSpecific(other *uriPattern) bool {
+	if other == nil {
+		return true
+	}
+
+	if p.exact != other.exact {
+		return p.exact
+	}
+
+	return p.literals > other.literals
+}
@@ -0,0 +1,139 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authorization
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v11"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeURIResource(id string, uris ...string) *gocloak.ResourceRepresentation {
+	resource := newFakeResource(id)
+	resource.URIs = &uris
+
+	return resource
+}
+
+func matchedIDs(resources []*gocloak.ResourceRepresentation) []string {
+	ids := make([]string, 0, len(resources))
+
+	for _, resource := range resources {
+		ids = append(ids, *resource.ID)
+	}
+
+	return ids
+}
+
+func TestResourceCacheMatch(t *testing.T) {
+	idpClient := &fakeIdpClient{
+		resources: []*gocloak.ResourceRepresentation{
+			newFakeURIResource("all", "/*"),
+			newFakeURIResource("api", "/api/*"),
+			newFakeURIResource("user", "/api/users/{id}", "/api/users/{id}/*"),
+			newFakeURIResource("me", "/api/users/me"),
+			newFakeURIResource("html", "/static/*.html"),
+			newFakeURIResource("nouris"),
+		},
+	}
+
+	cache := NewResourceCache()
+	assert.False(t, cache.Loaded())
+	assert.NoError(t, cache.Load(context.Background(), idpClient, "pat", "realm"))
+	assert.True(t, cache.Loaded())
+	assert.Equal(t, 6, cache.Len())
+
+	testCases := []struct {
+		Path     string
+		Expected []string
+	}{
+		{Path: "/", Expected: []string{"all"}},
+		{Path: "/other", Expected: []string{"all"}},
+		{Path: "/api", Expected: []string{"api", "all"}},
+		{Path: "/api/orders", Expected: []string{"api", "all"}},
+		{Path: "/api/users/1", Expected: []string{"user", "api", "all"}},
+		{Path: "/api/users/1/roles", Expected: []string{"user", "api", "all"}},
+		{Path: "/api/users/me", Expected: []string{"me", "user", "api", "all"}},
+		{Path: "/static/index.html", Expected: []string{"html", "all"}},
+		{Path: "/static/index.css", Expected: []string{"all"}},
+		{Path: "/api.users", Expected: []string{"all"}},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(
+			t,
+			testCase.Expected,
+			matchedIDs(cache.Match(testCase.Path)),
+			"path %s",
+			testCase.Path,
+		)
+	}
+}
+
+func TestResourceCacheLoadPages(t *testing.T) {
+	resources := make([]*gocloak.ResourceRepresentation, 0, 2*resourcesPageSize+1)
+
+	for idx := 0; idx < 2*resourcesPageSize+1; idx++ {
+		resources = append(resources, newFakeURIResource(fmt.Sprintf("%d", idx), fmt.Sprintf("/%d", idx)))
+	}
+
+	idpClient := &fakeIdpClient{resources: resources}
+	cache := NewResourceCache()
+
+	assert.NoError(t, cache.Load(context.Background(), idpClient, "pat", "realm"))
+	assert.Equal(t, len(resources), cache.Len())
+	assert.Equal(t, 4, idpClient.requests)
+	assert.Equal(t, []string{"200"}, matchedIDs(cache.Match("/200")))
+
+	// a failed reload keeps the resources loaded before
+	idpClient.err = errors.New("failed")
+
+	assert.Error(t, cache.Load(context.Background(), idpClient, "pat", "realm"))
+	assert.Equal(t, len(resources), cache.Len())
+}
+
+func TestGetResources(t *testing.T) {
+	idpClient := &fakeIdpClient{
+		resources: []*gocloak.ResourceRepresentation{newFakeURIResource("a", "/a")},
+	}
+
+	resources, err := GetResources(context.Background(), nil, idpClient, "pat", "realm", "/b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, matchedIDs(resources))
+	assert.Equal(t, 1, idpClient.requests)
+
+	cache := NewResourceCache()
+
+	resources, err = GetResources(context.Background(), cache, idpClient, "pat", "realm", "/b")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, matchedIDs(resources))
+	assert.Equal(t, 2, idpClient.requests)
+
+	assert.NoError(t, cache.Load(context.Background(), idpClient, "pat", "realm"))
+	requests := idpClient.requests
+
+	resources, err = GetResources(context.Background(), cache, idpClient, "pat", "realm", "/b")
+	assert.NoError(t, err)
+	assert.Empty(t, resources)
+	assert.Equal(t, requests, idpClient.requests)
+}
@@ -0,0 +1,526 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type node interface {
+	eval(input *Input) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(_ *Input) (interface{}, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(input *Input) (interface{}, error) {
+	switch n.name {
+	case "claims":
+		return input.Claims, nil
+	case "roles":
+		return input.Roles, nil
+	case "groups":
+		return input.Groups, nil
+	case "method":
+		return input.Method, nil
+	case "path":
+		return input.Path, nil
+	case "headers":
+		return input.Headers, nil
+	case "ip":
+		return input.IP, nil
+	}
+
+	return nil, fmt.Errorf("unknown variable %q", n.name)
+}
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(input *Input) (interface{}, error) {
+	values := make([]interface{}, 0, len(n.items))
+
+	for _, item := range n.items {
+		value, err := item.eval(input)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// memberNode is a field of a map, a missing field is null
+type memberNode struct {
+	target node
+	name   string
+}
+
+func (n *memberNode) eval(input *Input) (interface{}, error) {
+	target, err := n.target.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return lookup(target, n.name)
+}
+
+// indexNode is a field of a map or an item of a list, missing ones are null
+type indexNode struct {
+	target node
+	index  node
+}
+
+func (n *indexNode) eval(input *Input) (interface{}, error) {
+	target, err := n.target.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := n.index.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if name, ok := index.(string); ok {
+		return lookup(target, name)
+	}
+
+	position, ok := toNumber(index)
+	if !ok || position != float64(int(position)) {
+		return nil, fmt.Errorf("invalid index %v", index)
+	}
+
+	items, ok := toList(target)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a list", target)
+	}
+
+	if int(position) < 0 || int(position) >= len(items) {
+		return nil, nil
+	}
+
+	return items[int(position)], nil
+}
+
+func lookup(target interface{}, name string) (interface{}, error) {
+	switch value := target.(type) {
+	case map[string]interface{}:
+		return value[name], nil
+	case http.Header:
+		if values := value.Values(name); len(values) > 0 {
+			return values[0], nil
+		}
+
+		return nil, nil
+	case nil:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("%v has no field %q", target, name)
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(input *Input) (interface{}, error) {
+	value, err := n.operand.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := toBool(value, "!")
+	if err != nil {
+		return nil, err
+	}
+
+	return !result, nil
+}
+
+type binaryNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *binaryNode) eval(input *Input) (interface{}, error) {
+	left, err := n.left.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	// @step: the logical operators short circuit
+	switch n.op {
+	case "&&", "||":
+		result, err := toBool(left, n.op)
+		if err != nil {
+			return nil, err
+		}
+
+		if result == (n.op == "||") {
+			return result, nil
+		}
+
+		right, err := n.right.eval(input)
+		if err != nil {
+			return nil, err
+		}
+
+		return toBool(right, n.op)
+	}
+
+	right, err := n.right.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	// @note: a missing value, i.e. a claim not in the token, only compares to the null literal,
+	// so neither claims.missing == path.segment(9) nor claims.missing != 'x' hold
+	if (n.op == "==" || n.op == "!=") && (left == nil || right == nil) && !isNull(n.left) && !isNull(n.right) {
+		return false, nil
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		return contains(right, left)
+	default:
+		return compare(n.op, left, right)
+	}
+}
+
+// isNull checks the node is the null literal
+func isNull(n node) bool {
+	literal, ok := n.(*literalNode)
+
+	return ok && literal.value == nil
+}
+
+type function struct {
+	arity int
+	call  func(receiver interface{}, args []interface{}) (interface{}, error)
+}
+
+// callNode is a function called on a value, i.e. claims.email.endsWith('@corp.com')
+type callNode struct {
+	receiver node
+	name     string
+	fn       function
+	args     []node
+	regex    *regexp.Regexp
+}
+
+func (n *callNode) eval(input *Input) (interface{}, error) {
+	receiver, err := n.receiver.eval(input)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, 0, len(n.args))
+
+	for _, arg := range n.args {
+		value, err := arg.eval(input)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, value)
+	}
+
+	if n.regex != nil {
+		args[0] = n.regex
+	}
+
+	// @note: functions on a missing value, i.e. a claim not in the token, are null
+	if receiver == nil {
+		return nil, nil
+	}
+
+	value, err := n.fn.call(receiver, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", n.name, err)
+	}
+
+	return value, nil
+}
+
+// functions are the functions which can be called on values
+var functions = map[string]function{
+	"startsWith": {arity: 1, call: stringFunction(strings.HasPrefix)},
+	"endsWith":   {arity: 1, call: stringFunction(strings.HasSuffix)},
+	"contains": {arity: 1, call: func(receiver interface{}, args []interface{}) (interface{}, error) {
+		return contains(receiver, args[0])
+	}},
+	"lower": {arity: 0, call: func(receiver interface{}, _ []interface{}) (interface{}, error) {
+		value, err := toString(receiver)
+		return strings.ToLower(value), err
+	}},
+	"upper": {arity: 0, call: func(receiver interface{}, _ []interface{}) (interface{}, error) {
+		value, err := toString(receiver)
+		return strings.ToUpper(value), err
+	}},
+	"matches": {arity: 1, call: func(receiver interface{}, args []interface{}) (interface{}, error) {
+		value, err := toString(receiver)
+		if err != nil {
+			return nil, err
+		}
+
+		regex, ok := args[0].(*regexp.Regexp)
+		if !ok {
+			pattern, err := toString(args[0])
+			if err != nil {
+				return nil, err
+			}
+
+			if regex, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+		}
+
+		return regex.MatchString(value), nil
+	}},
+	"segment": {arity: 1, call: func(receiver interface{}, args []interface{}) (interface{}, error) {
+		value, err := toString(receiver)
+		if err != nil {
+			return nil, err
+		}
+
+		position, ok := toNumber(args[0])
+		if !ok || position != float64(int(position)) {
+			return nil, fmt.Errorf("invalid segment %v", args[0])
+		}
+
+		// @note: segments are counted from one, /api/tenant gives api then tenant
+		segments := strings.FieldsFunc(value, func(char rune) bool { return char == '/' })
+		if int(position) < 1 || int(position) > len(segments) {
+			return nil, nil
+		}
+
+		return segments[int(position)-1], nil
+	}},
+	"size": {arity: 0, call: func(receiver interface{}, _ []interface{}) (interface{}, error) {
+		if value, ok := receiver.(string); ok {
+			return float64(len(value)), nil
+		}
+
+		if items, ok := toList(receiver); ok {
+			return float64(len(items)), nil
+		}
+
+		return nil, fmt.Errorf("%v has no size", receiver)
+	}},
+	"inCIDR": {arity: 1, call: func(receiver interface{}, args []interface{}) (interface{}, error) {
+		value, err := toString(receiver)
+		if err != nil {
+			return nil, err
+		}
+
+		cidr, err := toString(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(value)
+
+		return ip != nil && network.Contains(ip), nil
+	}},
+}
+
+func stringFunction(fn func(string, string) bool) func(interface{}, []interface{}) (interface{}, error) {
+	return func(receiver interface{}, args []interface{}) (interface{}, error) {
+		value, err := toString(receiver)
+		if err != nil {
+			return nil, err
+		}
+
+		arg, err := toString(args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return fn(value, arg), nil
+	}
+}
+
+// contains checks the item is in the list, a substring of the string or a field of the map
+func contains(collection interface{}, item interface{}) (interface{}, error) {
+	switch value := collection.(type) {
+	case string:
+		substring, err := toString(item)
+		if err != nil {
+			return nil, err
+		}
+
+		return strings.Contains(value, substring), nil
+	case map[string]interface{}:
+		name, err := toString(item)
+		if err != nil {
+			return nil, err
+		}
+
+		_, found := value[name]
+
+		return found, nil
+	case nil:
+		return false, nil
+	}
+
+	items, ok := toList(collection)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a list", collection)
+	}
+
+	for _, candidate := range items {
+		if equal(candidate, item) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func equal(left, right interface{}) bool {
+	switch value := left.(type) {
+	case string:
+		other, ok := right.(string)
+		return ok && value == other
+	case bool:
+		other, ok := right.(bool)
+		return ok && value == other
+	case nil:
+		return right == nil
+	}
+
+	if value, ok := toNumber(left); ok {
+		other, ok := toNumber(right)
+		return ok && value == other
+	}
+
+	return false
+}
+
+func compare(op string, left, right interface{}) (interface{}, error) {
+	if left == nil || right == nil {
+		return false, nil
+	}
+
+	var result int
+
+	leftNumber, leftOk := toNumber(left)
+	rightNumber, rightOk := toNumber(right)
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+
+	switch {
+	case leftOk && rightOk:
+		switch {
+		case leftNumber < rightNumber:
+			result = -1
+		case leftNumber > rightNumber:
+			result = 1
+		}
+	case leftIsString && rightIsString:
+		result = strings.Compare(leftString, rightString)
+	default:
+		return nil, fmt.Errorf("can not compare %v and %v", left, right)
+	}
+
+	switch op {
+	case "<":
+		return result < 0, nil
+	case "<=":
+		return result <= 0, nil
+	case ">":
+		return result > 0, nil
+	default:
+		return result >= 0, nil
+	}
+}
+
+// toBool converts the operand of a logical operator, a missing value is false
+func toBool(value interface{}, op string) (bool, error) {
+	switch result := value.(type) {
+	case bool:
+		return result, nil
+	case nil:
+		return false, nil
+	}
+
+	return false, fmt.Errorf("the operand of %s is %v, not a boolean", op, value)
+}
+
+func toString(value interface{}) (string, error) {
+	if result, ok := value.(string); ok {
+		return result, nil
+	}
+
+	return "", fmt.Errorf("%v is not a string", value)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch result := value.(type) {
+	case float64:
+		return result, true
+	case int:
+		return float64(result), true
+	case int64:
+		return float64(result), true
+	}
+
+	return 0, false
+}
+
+func toList(value interface{}) ([]interface{}, bool) {
+	switch result := value.(type) {
+	case []interface{}:
+		return result, true
+	case []string:
+		items := make([]interface{}, 0, len(result))
+
+		for _, item := range result {
+			items = append(items, item)
+		}
+
+		return items, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,507 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package policy compiles and evaluates the boolean expressions used as resource policies, e.g.
+//
+//	claims.tenant == path.segment(2) && 'admin' in roles
+//	claims.email.endsWith('@corp.com') || 'finance' in groups
+package policy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Input holds the variables a policy is evaluated against
+type Input struct {
+	Claims  map[string]interface{}
+	Roles   []string
+	Groups  []string
+	Method  string
+	Path    string
+	Headers http.Header
+	IP      string
+}
+
+// Expression is a compiled policy
+type Expression struct {
+	source string
+	root   node
+}
+
+// variables are the names which can be referenced by a policy
+var variables = map[string]bool{
+	"claims":  true,
+	"roles":   true,
+	"groups":  true,
+	"method":  true,
+	"path":    true,
+	"headers": true,
+	"ip":      true,
+}
+
+// Compile parses the policy, unknown variables or functions and invalid regexes are reported
+func Compile(source string) (*Expression, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+
+	return &Expression{source: source, root: root}, nil
+}
+
+// Evaluate returns the result of the policy against the input, a policy which does not
+// evaluate to a boolean, or fails to evaluate, does not grant access
+func (e *Expression) Evaluate(input *Input) (bool, error) {
+	value, err := e.root.eval(input)
+	if err != nil {
+		return false, err
+	}
+
+	switch result := value.(type) {
+	case bool:
+		return result, nil
+	case nil:
+		return false, nil
+	default:
+		return false, fmt.Errorf("the policy evaluated to %v, not a boolean", value)
+	}
+}
+
+// String returns the source of the policy
+func (e *Expression) String() string {
+	return e.source
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// operators are matched longest first
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ".", ","}
+
+func tokenize(source string) ([]token, error) {
+	tokens := make([]token, 0)
+
+	for pos := 0; pos < len(source); {
+		char := source[pos]
+
+		switch {
+		case char == ' ' || char == '\t' || char == '\n' || char == '\r':
+			pos++
+		case char == '\'' || char == '"':
+			text, end, err := scanString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: text, pos: pos})
+			pos = end
+		case isDigit(char):
+			end := pos
+			for end < len(source) && (isDigit(source[end]) || source[end] == '.') {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenNumber, text: source[pos:end], pos: pos})
+			pos = end
+		case isIdentStart(char):
+			end := pos
+			for end < len(source) && (isIdentStart(source[end]) || isDigit(source[end])) {
+				end++
+			}
+
+			tokens = append(tokens, token{kind: tokenIdent, text: source[pos:end], pos: pos})
+			pos = end
+		default:
+			matched := false
+
+			for _, operator := range operators {
+				if strings.HasPrefix(source[pos:], operator) {
+					tokens = append(tokens, token{kind: tokenOperator, text: operator, pos: pos})
+					pos += len(operator)
+					matched = true
+
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at position %d", char, pos)
+			}
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+// scanString reads the quoted string starting at pos, returning its value and where it ends
+func scanString(source string, pos int) (string, int, error) {
+	quote := source[pos]
+	value := strings.Builder{}
+
+	for idx := pos + 1; idx < len(source); idx++ {
+		switch source[idx] {
+		case '\\':
+			if idx+1 == len(source) {
+				return "", 0, fmt.Errorf("unterminated string at position %d", pos)
+			}
+
+			idx++
+			value.WriteByte(source[idx])
+		case quote:
+			return value.String(), idx + 1, nil
+		default:
+			value.WriteByte(source[idx])
+		}
+	}
+
+	return "", 0, fmt.Errorf("unterminated string at position %d", pos)
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isIdentStart(char byte) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+
+	return tok
+}
+
+// accept consumes the next token when it is the operator or keyword
+func (p *parser) accept(text string) bool {
+	tok := p.peek()
+
+	if (tok.kind == tokenOperator || tok.kind == tokenIdent) && tok.text == text {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at position %d, found %q", text, tok.pos, tok.text)
+	}
+
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op: "||", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseEquality()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("&&") {
+		right, err := p.parseEquality()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op: "&&", left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseEquality() (node, error) {
+	left, err := p.parseRelation()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek().text
+		if p.peek().kind != tokenOperator || (op != "==" && op != "!=") {
+			return left, nil
+		}
+
+		p.next()
+
+		right, err := p.parseRelation()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) parseRelation() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+
+	switch {
+	case tok.kind == tokenOperator && (tok.text == "<" || tok.text == "<=" || tok.text == ">" || tok.text == ">="),
+		tok.kind == tokenIdent && tok.text == "in":
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &binaryNode{op: tok.text, left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &notNode{operand: operand}, nil
+	}
+
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	target, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expected a name at position %d, found %q", name.pos, name.text)
+			}
+
+			if !p.accept("(") {
+				target = &memberNode{target: target, name: name.text}
+				continue
+			}
+
+			args, err := p.parseArgs("(", ")")
+			if err != nil {
+				return nil, err
+			}
+
+			if target, err = newCallNode(target, name, args); err != nil {
+				return nil, err
+			}
+		case p.accept("["):
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+
+			target = &indexNode{target: target, index: index}
+		default:
+			return target, nil
+		}
+	}
+}
+
+// parseArgs parses the comma separated expressions up to the closing operator, the opening
+// one being consumed already
+func (p *parser) parseArgs(opening, closing string) ([]node, error) {
+	args := make([]node, 0)
+
+	if p.accept(closing) {
+		return args, nil
+	}
+
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, arg)
+
+		if p.accept(closing) {
+			return args, nil
+		}
+
+		if err := p.expect(","); err != nil {
+			return nil, fmt.Errorf("%s, missing %q after %q", err, closing, opening)
+		}
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case tokenString:
+		return &literalNode{value: tok.text}, nil
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", tok.text, tok.pos)
+		}
+
+		return &literalNode{value: value}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+
+		if !variables[tok.text] {
+			return nil, fmt.Errorf("unknown variable %q at position %d", tok.text, tok.pos)
+		}
+
+		return &variableNode{name: tok.text}, nil
+	case tokenOperator:
+		switch tok.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+
+			return inner, nil
+		case "[":
+			items, err := p.parseArgs("[", "]")
+			if err != nil {
+				return nil, err
+			}
+
+			return &listNode{items: items}, nil
+		}
+	case tokenEOF:
+		return nil, fmt.Errorf("unexpected end of the policy")
+	}
+
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+func newCallNode(receiver node, name token, args []node) (node, error) {
+	fn, found := functions[name.text]
+	if !found {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+
+	if len(args) != fn.arity {
+		return nil, fmt.Errorf(
+			"function %q at position %d takes %d argument(s), not %d",
+			name.text,
+			name.pos,
+			fn.arity,
+			len(args),
+		)
+	}
+
+	call := &callNode{receiver: receiver, name: name.text, fn: fn, args: args}
+
+	// @step: the regexes given as literals are compiled once, along with the policy
+	if name.text == "matches" {
+		if literal, ok := args[0].(*literalNode); ok {
+			pattern, ok := literal.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("function %q at position %d takes a string", name.text, name.pos)
+			}
+
+			regex, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex %q at position %d: %s", pattern, name.pos, err)
+			}
+
+			call.regex = regex
+		}
+	}
+
+	return call, nil
+}
@@ -0,0 +1,151 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeInput() *Input {
+	headers := http.Header{}
+	headers.Set("X-Tenant", "acme")
+
+	return &Input{
+		Claims: map[string]interface{}{
+			"tenant":                  "acme",
+			"email":                   "jdoe@corp.com",
+			"email_verified":          true,
+			"level":                   float64(3),
+			"scopes":                  []interface{}{"read", "write"},
+			"address":                 map[string]interface{}{"country": "FR"},
+			"https://example.com/org": "sales",
+		},
+		Roles:   []string{"admin", "user"},
+		Groups:  []string{"finance"},
+		Method:  http.MethodGet,
+		Path:    "/api/acme/items/1",
+		Headers: headers,
+		IP:      "10.1.2.3",
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	testCases := []struct {
+		Policy   string
+		Expected bool
+	}{
+		{Policy: "true", Expected: true},
+		{Policy: "false", Expected: false},
+		{Policy: "claims.tenant == path.segment(2) && 'admin' in roles", Expected: true},
+		{Policy: "claims.tenant == path.segment(1) && 'admin' in roles", Expected: false},
+		{Policy: "claims.email.endsWith('@corp.com') || 'finance' in groups", Expected: true},
+		{Policy: "claims.email.endsWith('@other.com') || 'finance' in groups", Expected: true},
+		{Policy: "claims.email.endsWith('@other.com') || 'hr' in groups", Expected: false},
+		{Policy: "!('auditor' in roles)", Expected: true},
+		{Policy: "method == 'GET' && path.startsWith('/api/')", Expected: true},
+		{Policy: "method != 'GET'", Expected: false},
+		{Policy: "headers['x-tenant'] == claims.tenant", Expected: true},
+		{Policy: "headers.missing == null", Expected: true},
+		{Policy: "ip.inCIDR('10.0.0.0/8')", Expected: true},
+		{Policy: "ip.inCIDR('192.168.0.0/16')", Expected: false},
+		{Policy: "claims.level >= 3 && claims.level < 4", Expected: true},
+		{Policy: "claims.level > 3", Expected: false},
+		{Policy: "claims.email_verified", Expected: true},
+		{Policy: "'write' in claims.scopes && claims.scopes.size() == 2", Expected: true},
+		{Policy: "claims.scopes[0] == 'read'", Expected: true},
+		{Policy: "claims.address.country == 'FR'", Expected: true},
+		{Policy: "claims['https://example.com/org'] == \"sales\"", Expected: true},
+		{Policy: "claims.email.matches('^[a-z]+@corp\\\\.com$')", Expected: true},
+		{Policy: "claims.email.lower().contains('corp')", Expected: true},
+		{Policy: "method in ['GET', 'HEAD']", Expected: true},
+		{Policy: "'tenant' in claims", Expected: true},
+		{Policy: "claims.missing", Expected: false},
+		{Policy: "claims.missing == 'x'", Expected: false},
+		{Policy: "claims.missing.endsWith('x')", Expected: false},
+		{Policy: "false && claims.tenant.unknownField", Expected: false},
+		{Policy: "path.segment(10) == claims.missing", Expected: false},
+		{Policy: "path.segment(10) != 'api'", Expected: false},
+		{Policy: "claims.missing != 'x'", Expected: false},
+		{Policy: "claims.missing != claims.tenant", Expected: false},
+		{Policy: "claims.missing == claims.other", Expected: false},
+		{Policy: "claims.missing == null", Expected: true},
+		{Policy: "claims.missing != null", Expected: false},
+		{Policy: "null != claims.tenant", Expected: true},
+		{Policy: "(false || true) && !false", Expected: true},
+	}
+
+	for _, testCase := range testCases {
+		expression, err := Compile(testCase.Policy)
+		if !assert.NoError(t, err, testCase.Policy) {
+			continue
+		}
+
+		result, err := expression.Evaluate(newFakeInput())
+		assert.NoError(t, err, testCase.Policy)
+		assert.Equal(t, testCase.Expected, result, testCase.Policy)
+	}
+}
+
+func TestEvaluateErrors(t *testing.T) {
+	testCases := []string{
+		"claims.tenant",
+		"claims.tenant && true",
+		"roles.admin",
+		"claims.level < 'x'",
+		"'admin' in claims.level",
+		"claims.level.endsWith('x')",
+		"path.segment('x') == 'api'",
+	}
+
+	for _, policy := range testCases {
+		expression, err := Compile(policy)
+		if !assert.NoError(t, err, policy) {
+			continue
+		}
+
+		result, err := expression.Evaluate(newFakeInput())
+		assert.Error(t, err, policy)
+		assert.False(t, result, policy)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	testCases := []string{
+		"",
+		"user.name == 'x'",
+		"claims.tenant ==",
+		"claims.tenant == 'x",
+		"(true",
+		"claims.email.unknown('x')",
+		"claims.email.endsWith()",
+		"claims.email.matches('[')",
+		"true true",
+		"claims.tenant = 'x'",
+		"roles[0",
+		"claims.",
+	}
+
+	for _, policy := range testCases {
+		_, err := Compile(policy)
+		assert.Error(t, err, policy)
+	}
+}
@@ -1,22 +1,26 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"time"
 )
 
 // storage is used to hold the offline refresh token, assuming you don't want to use
-// the default practice of a encrypted cookie
+// the default practice of a encrypted cookie. The context bounds how long a call may
+// take, backends give up once it is done
 type Storage interface {
 	// Set the token to the store
-	Set(string, string, time.Duration) error
-	// Get retrieves a token from the store
-	Get(string) (string, error)
+	Set(context.Context, string, string, time.Duration) error
+	// Get retrieves a token from the store, an empty value means the key was not found
+	Get(context.Context, string) (string, error)
 	// Exists checks if key exists in store
-	Exists(string) (bool, error)
+	Exists(context.Context, string) (bool, error)
 	// Delete removes a key from the store
-	Delete(string) error
+	Delete(context.Context, string) error
+	// DeletePrefix removes all the keys starting with the prefix from the store
+	DeletePrefix(context.Context, string) error
 	// Close is used to close off any resources
 	Close() error
 }
@@ -33,8 +37,12 @@ func CreateStorage(location string) (Storage, error) {
 	}
 
 	switch uri.Scheme {
-	case "redis":
+	case "redis", "rediss", "redis+sentinel", "rediss+sentinel", "redis+cluster", "rediss+cluster":
 		store, err = newRedisStore(uri)
+	case "file", "boltdb":
+		store, err = newBoltStore(uri)
+	case "memory":
+		store, err = newMemoryStore(uri)
 	default:
 		return nil, fmt.Errorf("unsupport store: %s", uri.Scheme)
 	}
@@ -0,0 +1,273 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// boltBucket is the bucket all the keys are kept under
+	boltBucket = "gatekeeper"
+	// boltDefaultExpiryInterval is how often expired keys are purged
+	boltDefaultExpiryInterval = time.Minute
+	// boltExpiryHeaderLength is the size of the expiry prefix on each value
+	boltExpiryHeaderLength = 8
+	// boltDefaultLockTimeout is how long to wait for the file lock on open
+	boltDefaultLockTimeout = time.Second
+)
+
+var _ Storage = (*BoltStore)(nil)
+
+// BoltStore is an embedded, file backed store
+type BoltStore struct {
+	Client *bolt.DB
+	// stop is closed when the store is shutting down
+	stop chan struct{}
+	// once guards the closing of the store
+	once sync.Once
+}
+
+// newBoltStore creates a new bolt store, i.e. file:///var/lib/gatekeeper/tokens.db.
+// The expiry-interval query parameter controls how often expired keys are purged and
+// lock-timeout how long to wait for the file, which cannot be shared between processes
+func newBoltStore(location *url.URL) (Storage, error) {
+	if location.Path == "" {
+		return nil, errors.New("no path specified for the bolt store")
+	}
+
+	interval := boltDefaultExpiryInterval
+	lockTimeout := boltDefaultLockTimeout
+
+	for name, field := range map[string]*time.Duration{
+		"expiry-interval": &interval,
+		"lock-timeout":    &lockTimeout,
+	} {
+		if value := location.Query().Get(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+
+			if duration <= 0 {
+				return nil, fmt.Errorf("the bolt store %s must be greater than zero", name)
+			}
+
+			*field = duration
+		}
+	}
+
+	db, err := bolt.Open(location.Path, 0600, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		if errors.Is(err, bolt.ErrTimeout) {
+			return nil, fmt.Errorf(
+				"the bolt store %s is locked, the file cannot be shared by multiple processes",
+				location.Path,
+			)
+		}
+
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(boltBucket))
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	store := &BoltStore{
+		Client: db,
+		stop:   make(chan struct{}),
+	}
+
+	go store.expire(interval)
+
+	return store, nil
+}
+
+// Set adds a token to the store, a zero expiration means the key never expires. Bolt
+// transactions cannot be interrupted, so the context is only checked before starting one
+func (r *BoltStore) Set(ctx context.Context, key, value string, expiration time.Duration) error {
+	var expiresAt int64
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if expiration > 0 {
+		expiresAt = time.Now().Add(expiration).UnixNano()
+	}
+
+	entry := make([]byte, boltExpiryHeaderLength+len(value))
+	binary.BigEndian.PutUint64(entry, uint64(expiresAt))
+	copy(entry[boltExpiryHeaderLength:], value)
+
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltBucket)).Put([]byte(key), entry)
+	})
+}
+
+// Checks if key exists in store
+func (r *BoltStore) Exists(ctx context.Context, key string) (bool, error) {
+	found := false
+
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	err := r.Client.View(func(tx *bolt.Tx) error {
+		_, found = decodeBoltEntry(tx.Bucket([]byte(boltBucket)).Get([]byte(key)), time.Now())
+		return nil
+	})
+
+	return found, err
+}
+
+// Get retrieves a token from the store, an empty value is returned
+// when the key is missing or has expired
+func (r *BoltStore) Get(ctx context.Context, key string) (string, error) {
+	var value string
+
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	err := r.Client.View(func(tx *bolt.Tx) error {
+		value, _ = decodeBoltEntry(tx.Bucket([]byte(boltBucket)).Get([]byte(key)), time.Now())
+		return nil
+	})
+
+	return value, err
+}
+
+// Delete remove the key
+func (r *BoltStore) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltBucket)).Delete([]byte(key))
+	})
+}
+
+// DeletePrefix removes all the keys starting with the prefix
+func (r *BoltStore) DeletePrefix(ctx context.Context, prefix string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltBucket))
+		matched := [][]byte{}
+		cursor := bucket.Cursor()
+
+		for key, _ := cursor.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, _ = cursor.Next() {
+			matched = append(matched, append([]byte{}, key...))
+		}
+
+		for _, key := range matched {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close stops the expiry routine and closes the database
+func (r *BoltStore) Close() error {
+	var err error
+
+	r.once.Do(func() {
+		close(r.stop)
+		err = r.Client.Close()
+	})
+
+	return err
+}
+
+// expire periodically removes any expired keys from the store
+func (r *BoltStore) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			_ = r.purge(time.Now())
+		}
+	}
+}
+
+// purge deletes all the keys which have expired by now
+func (r *BoltStore) purge(now time.Time) error {
+	return r.Client.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(boltBucket))
+		expired := [][]byte{}
+
+		// @note: deleting whilst iterating the cursor skips keys, hence the two passes
+		err := bucket.ForEach(func(key, entry []byte) error {
+			if _, found := decodeBoltEntry(entry, now); !found {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// decodeBoltEntry splits an entry into the value, returning false
+// when the entry is missing or expired
+func decodeBoltEntry(entry []byte, now time.Time) (string, bool) {
+	if len(entry) < boltExpiryHeaderLength {
+		return "", false
+	}
+
+	expiresAt := int64(binary.BigEndian.Uint64(entry[:boltExpiryHeaderLength]))
+	if expiresAt != 0 && now.UnixNano() >= expiresAt {
+		return "", false
+	}
+
+	return string(entry[boltExpiryHeaderLength:]), true
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// memoryDefaultMaxEntries is the default bound on the number of keys
+	memoryDefaultMaxEntries = 10000
+	// memoryDefaultExpiryInterval is how often expired keys are purged
+	memoryDefaultExpiryInterval = time.Minute
+)
+
+var _ Storage = (*MemoryStore)(nil)
+
+// memoryEntry is a single item in the memory store
+type memoryEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+// size is the number of bytes the entry accounts for
+func (r *memoryEntry) size() int {
+	return len(r.key) + len(r.value)
+}
+
+// expired checks if the entry has expired by now
+func (r *memoryEntry) expired(now time.Time) bool {
+	return !r.expiresAt.IsZero() && !now.Before(r.expiresAt)
+}
+
+// MemoryStore is an in-process store bounded by entries and bytes,
+// evicting the least recently used keys once either bound is reached
+type MemoryStore struct {
+	sync.Mutex
+	// maxEntries is the maximum number of keys, zero is unbounded
+	maxEntries int
+	// maxBytes is the maximum size of keys and values, zero is unbounded
+	maxBytes int
+	// bytes is the current size of the keys and values
+	bytes int
+	// items is a map of keys to elements in the lru list
+	items map[string]*list.Element
+	// lru holds the entries, most recently used at the front
+	lru *list.List
+	// stop is closed when the store is shutting down
+	stop chan struct{}
+	// once guards the closing of the store
+	once sync.Once
+}
+
+// NewMemoryStore creates a new memory store with the given bounds, a zero bound is
+// unlimited. Expired keys are purged every interval, a zero interval disables the purge
+func NewMemoryStore(maxEntries, maxBytes int, interval time.Duration) *MemoryStore {
+	store := &MemoryStore{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+		stop:       make(chan struct{}),
+	}
+
+	if interval > 0 {
+		go store.expire(interval)
+	}
+
+	return store
+}
+
+// newMemoryStore creates a memory store from the url, i.e. memory://?max-entries=1000&max-bytes=1048576
+func newMemoryStore(location *url.URL) (Storage, error) {
+	query := location.Query()
+	maxEntries := memoryDefaultMaxEntries
+	maxBytes := 0
+	interval := memoryDefaultExpiryInterval
+
+	if value := query.Get("max-entries"); value != "" {
+		entries, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if entries < 0 {
+			return nil, errors.New("the memory store max-entries cannot be negative")
+		}
+
+		maxEntries = entries
+	}
+
+	if value := query.Get("max-bytes"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if size < 0 {
+			return nil, errors.New("the memory store max-bytes cannot be negative")
+		}
+
+		maxBytes = size
+	}
+
+	if value := query.Get("expiry-interval"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if duration <= 0 {
+			return nil, errors.New("the memory store expiry-interval must be greater than zero")
+		}
+
+		interval = duration
+	}
+
+	return NewMemoryStore(maxEntries, maxBytes, interval), nil
+}
+
+// Set adds a token to the store, a zero expiration means the key never expires. The
+// memory store never blocks on i/o so the context is not consulted
+func (r *MemoryStore) Set(_ context.Context, key, value string, expiration time.Duration) error {
+	entry := &memoryEntry{key: key, value: value}
+
+	if expiration > 0 {
+		entry.expiresAt = time.Now().Add(expiration)
+	}
+
+	if r.maxBytes > 0 && entry.size() > r.maxBytes {
+		return errors.New("the value exceeds the memory store max-bytes")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if element, found := r.items[key]; found {
+		r.remove(element)
+	}
+
+	r.items[key] = r.lru.PushFront(entry)
+	r.bytes += entry.size()
+
+	for r.overflowing() {
+		r.remove(r.lru.Back())
+	}
+
+	return nil
+}
+
+// Checks if key exists in store
+func (r *MemoryStore) Exists(_ context.Context, key string) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.lookup(key) != nil, nil
+}
+
+// Get retrieves a token from the store, an empty value is returned
+// when the key is missing or has expired
+func (r *MemoryStore) Get(_ context.Context, key string) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	entry := r.lookup(key)
+	if entry == nil {
+		return "", nil
+	}
+
+	return entry.value, nil
+}
+
+// Delete remove the key
+func (r *MemoryStore) Delete(_ context.Context, key string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if element, found := r.items[key]; found {
+		r.remove(element)
+	}
+
+	return nil
+}
+
+// DeletePrefix removes all the keys starting with the prefix
+func (r *MemoryStore) DeletePrefix(_ context.Context, prefix string) error {
+	r.Lock()
+	defer r.Unlock()
+
+	for key, element := range r.items {
+		if strings.HasPrefix(key, prefix) {
+			r.remove(element)
+		}
+	}
+
+	return nil
+}
+
+// Close stops the expiry routine
+func (r *MemoryStore) Close() error {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+
+	return nil
+}
+
+// Len returns the number of keys in the store, including any yet to be purged
+func (r *MemoryStore) Len() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.lru.Len()
+}
+
+// lookup finds the entry, marking it as recently used; expired entries are removed
+func (r *MemoryStore) lookup(key string) *memoryEntry {
+	element, found := r.items[key]
+	if !found {
+		return nil
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		r.remove(element)
+		return nil
+	}
+
+	r.lru.MoveToFront(element)
+
+	return entry
+}
+
+// remove deletes the element from the list and index
+func (r *MemoryStore) remove(element *list.Element) {
+	entry := r.lru.Remove(element).(*memoryEntry)
+	delete(r.items, entry.key)
+	r.bytes -= entry.size()
+}
+
+// overflowing checks if the store has grown past any of the bounds
+func (r *MemoryStore) overflowing() bool {
+	if r.maxEntries > 0 && r.lru.Len() > r.maxEntries {
+		return true
+	}
+
+	return r.maxBytes > 0 && r.bytes > r.maxBytes
+}
+
+// expire periodically removes any expired keys from the store
+func (r *MemoryStore) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.purge(time.Now())
+		}
+	}
+}
+
+// purge deletes all the keys which have expired by now
+func (r *MemoryStore) purge(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+
+	for element := r.lru.Back(); element != nil; {
+		previous := element.Prev()
+		if element.Value.(*memoryEntry).expired(now) {
+			r.remove(element)
+		}
+		element = previous
+	}
+}
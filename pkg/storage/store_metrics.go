@@ -0,0 +1,130 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	storeLatencyMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "proxy_store_request_duration_seconds",
+			Help:    "A histogram of the latency of operations against the store",
+			Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+		},
+		[]string{"operation", "backend"},
+	)
+	storeErrorsMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "proxy_store_errors_total",
+			Help: "The total amount of failed operations against the store",
+		},
+		[]string{"operation", "backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(storeLatencyMetric)
+	prometheus.MustRegister(storeErrorsMetric)
+}
+
+var _ Storage = (*InstrumentedStore)(nil)
+
+// InstrumentedStore wraps a store, recording the latency and errors of each operation
+type InstrumentedStore struct {
+	Storage
+	// backend is the label the metrics are recorded under
+	backend string
+}
+
+// NewInstrumentedStore wraps the store so each operation is reported to prometheus
+func NewInstrumentedStore(store Storage) *InstrumentedStore {
+	return &InstrumentedStore{
+		Storage: store,
+		backend: backendName(store),
+	}
+}
+
+// Set adds a token to the store
+func (r *InstrumentedStore) Set(ctx context.Context, key, value string, expiration time.Duration) error {
+	defer r.observe("set", time.Now())
+
+	return r.record("set", r.Storage.Set(ctx, key, value, expiration))
+}
+
+// Get retrieves a token from the store
+func (r *InstrumentedStore) Get(ctx context.Context, key string) (string, error) {
+	defer r.observe("get", time.Now())
+
+	value, err := r.Storage.Get(ctx, key)
+
+	return value, r.record("get", err)
+}
+
+// Exists checks if key exists in store
+func (r *InstrumentedStore) Exists(ctx context.Context, key string) (bool, error) {
+	defer r.observe("exists", time.Now())
+
+	found, err := r.Storage.Exists(ctx, key)
+
+	return found, r.record("exists", err)
+}
+
+// Delete removes a key from the store
+func (r *InstrumentedStore) Delete(ctx context.Context, key string) error {
+	defer r.observe("delete", time.Now())
+
+	return r.record("delete", r.Storage.Delete(ctx, key))
+}
+
+// DeletePrefix removes all the keys starting with the prefix from the store
+func (r *InstrumentedStore) DeletePrefix(ctx context.Context, prefix string) error {
+	defer r.observe("delete_prefix", time.Now())
+
+	return r.record("delete_prefix", r.Storage.DeletePrefix(ctx, prefix))
+}
+
+// observe records the time taken by the operation
+func (r *InstrumentedStore) observe(operation string, start time.Time) {
+	storeLatencyMetric.WithLabelValues(operation, r.backend).Observe(time.Since(start).Seconds())
+}
+
+// record counts the error, if any, and passes it on
+func (r *InstrumentedStore) record(operation string, err error) error {
+	if err != nil {
+		storeErrorsMetric.WithLabelValues(operation, r.backend).Inc()
+	}
+
+	return err
+}
+
+// backendName returns the metrics label for the store implementation
+func backendName(store Storage) string {
+	switch store.(type) {
+	case RedisStore:
+		return "redis"
+	case *BoltStore:
+		return "bolt"
+	case *MemoryStore:
+		return "memory"
+	default:
+		return "unknown"
+	}
+}
@@ -16,41 +16,158 @@ limitations under the License.
 package storage
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
-	redis "gopkg.in/redis.v4"
+	"github.com/go-redis/redis/v8"
 )
 
 var _ Storage = (*RedisStore)(nil)
 
+// redisScanCount is the number of keys asked for on each scan
+const redisScanCount = 100
+
+// redisGlobEscaper escapes the characters having a meaning in the scan patterns
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 type RedisStore struct {
-	Client *redis.Client
+	Client redis.UniversalClient
 }
 
-// newRedisStore creates a new redis store
+// newRedisStore creates a new redis store, the location can be any of
+//
+//	redis://[:PASSWORD@]HOST:PORT[/DB]
+//	rediss://[:PASSWORD@]HOST:PORT[/DB]
+//	redis+sentinel://[:PASSWORD@]HOST:PORT[,HOST:PORT]/MASTER[/DB]
+//	redis+cluster://[:PASSWORD@]HOST:PORT[,HOST:PORT]
+//
+// with the rediss+sentinel and rediss+cluster schemes enabling tls. The db,
+// pool_size, dial_timeout, read_timeout and ca_file query parameters are
+// also understood
 func newRedisStore(location *url.URL) (Storage, error) {
-	// step: get any password
-	password := ""
-	if location.User != nil {
-		password, _ = location.User.Password()
+	options, err := parseRedisOptions(location)
+	if err != nil {
+		return nil, err
 	}
 
-	// step: parse the url notation
-	client := redis.NewClient(&redis.Options{
-		Addr:     location.Host,
-		DB:       0,
-		Password: password,
-	})
+	var client redis.UniversalClient
+
+	switch {
+	case strings.HasSuffix(location.Scheme, "+sentinel"):
+		client = redis.NewFailoverClient(options.Failover())
+	case strings.HasSuffix(location.Scheme, "+cluster"):
+		client = redis.NewClusterClient(options.Cluster())
+	default:
+		client = redis.NewClient(options.Simple())
+	}
 
 	return RedisStore{
 		Client: client,
 	}, nil
 }
 
+// parseRedisOptions converts the url notation into the client options
+// nolint:cyclop
+func parseRedisOptions(location *url.URL) (*redis.UniversalOptions, error) {
+	options := &redis.UniversalOptions{}
+
+	// step: get any credentials
+	if location.User != nil {
+		options.Username = location.User.Username()
+		options.Password, _ = location.User.Password()
+	}
+
+	if location.Host == "" {
+		return nil, errors.New("no host specified for the redis store")
+	}
+
+	options.Addrs = strings.Split(location.Host, ",")
+
+	// step: the path holds the master name for sentinel and the db otherwise
+	segments := strings.FieldsFunc(location.Path, func(r rune) bool { return r == '/' })
+
+	if strings.HasSuffix(location.Scheme, "+sentinel") {
+		if len(segments) == 0 {
+			return nil, errors.New("no master name specified for the redis sentinel store")
+		}
+		options.MasterName = segments[0]
+		segments = segments[1:]
+	}
+
+	query := location.Query()
+
+	if len(segments) > 0 && query.Get("db") == "" {
+		query.Set("db", segments[0])
+	}
+
+	if value := query.Get("db"); value != "" {
+		db, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db: %s", value)
+		}
+
+		if strings.HasSuffix(location.Scheme, "+cluster") && db != 0 {
+			return nil, errors.New("redis cluster does not support selecting a db")
+		}
+
+		options.DB = db
+	}
+
+	if value := query.Get("pool_size"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid redis pool_size: %s", value)
+		}
+		options.PoolSize = size
+	}
+
+	for name, field := range map[string]*time.Duration{
+		"dial_timeout": &options.DialTimeout,
+		"read_timeout": &options.ReadTimeout,
+	} {
+		if value := query.Get(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redis %s: %s", name, value)
+			}
+			*field = duration
+		}
+	}
+
+	if strings.HasPrefix(location.Scheme, "rediss") {
+		options.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if file := query.Get("ca_file"); file != "" {
+			ca, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in redis ca_file: %s", file)
+			}
+
+			options.TLSConfig.RootCAs = pool
+		}
+	} else if query.Get("ca_file") != "" {
+		return nil, errors.New("the redis ca_file requires a tls scheme, i.e. rediss://")
+	}
+
+	return options, nil
+}
+
 // Set adds a token to the store
-func (r RedisStore) Set(key, value string, expiration time.Duration) error {
-	if err := r.Client.Set(key, value, expiration); err.Err() != nil {
+func (r RedisStore) Set(ctx context.Context, key, value string, expiration time.Duration) error {
+	if err := r.Client.Set(ctx, key, value, expiration); err.Err() != nil {
 		return err.Err()
 	}
 
@@ -58,19 +175,24 @@ func (r RedisStore) Set(key, value string, expiration time.Duration) error {
 }
 
 // Checks if key exists in store
-func (r RedisStore) Exists(key string) (bool, error) {
-	result := r.Client.Exists(key)
+func (r RedisStore) Exists(ctx context.Context, key string) (bool, error) {
+	result := r.Client.Exists(ctx, key)
 	if result.Err() != nil {
 		return false, result.Err()
 	}
 
-	return result.Val(), nil
+	return result.Val() > 0, nil
 }
 
-// Get retrieves a token from the store
-func (r RedisStore) Get(key string) (string, error) {
-	result := r.Client.Get(key)
+// Get retrieves a token from the store, an empty value is returned
+// when the key is missing
+func (r RedisStore) Get(ctx context.Context, key string) (string, error) {
+	result := r.Client.Get(ctx, key)
 	if result.Err() != nil {
+		if errors.Is(result.Err(), redis.Nil) {
+			return "", nil
+		}
+
 		return "", result.Err()
 	}
 
@@ -78,8 +200,33 @@ func (r RedisStore) Get(key string) (string, error) {
 }
 
 // Delete remove the key
-func (r RedisStore) Delete(key string) error {
-	return r.Client.Del(key).Err()
+func (r RedisStore) Delete(ctx context.Context, key string) error {
+	return r.Client.Del(ctx, key).Err()
+}
+
+// DeletePrefix removes all the keys starting with the prefix, scanning every master of a cluster
+func (r RedisStore) DeletePrefix(ctx context.Context, prefix string) error {
+	if cluster, ok := r.Client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return deleteRedisPrefix(ctx, client, prefix)
+		})
+	}
+
+	return deleteRedisPrefix(ctx, r.Client, prefix)
+}
+
+// deleteRedisPrefix scans the keys matching the prefix, deleting them one by one as the keys
+// of a cluster node may belong to different slots
+func deleteRedisPrefix(ctx context.Context, client redis.Cmdable, prefix string) error {
+	iter := client.Scan(ctx, 0, redisGlobEscaper.Replace(prefix)+"*", redisScanCount).Iterator()
+
+	for iter.Next(ctx) {
+		if err := client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+
+	return iter.Err()
 }
 
 // Close closes of any open resources
@@ -19,9 +19,17 @@ limitations under the License.
 package storage
 
 import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestCreateStorageRedis(t *testing.T) {
@@ -35,3 +43,457 @@ func TestCreateStorageFail(t *testing.T) {
 	assert.Nil(t, store)
 	assert.Error(t, err)
 }
+
+func TestCreateStorageBolt(t *testing.T) {
+	for _, scheme := range []string{"file", "boltdb"} {
+		path := filepath.Join(t.TempDir(), "tokens.db")
+		store, err := CreateStorage(fmt.Sprintf("%s://%s", scheme, path))
+		assert.NoError(t, err)
+		assert.NotNil(t, store)
+		assert.NoError(t, store.Close())
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	store, err := CreateStorage("file://" + path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Set(context.Background(), "test", "value", 0))
+
+	found, err := store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	value, err := store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, store.Delete(context.Background(), "test"))
+
+	found, err = store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	value, err = store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+
+	assert.NoError(t, store.Close())
+}
+
+func TestBoltStoreExpiration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	store, err := CreateStorage(fmt.Sprintf("file://%s?expiry-interval=10ms", path))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Set(context.Background(), "short", "value", 50*time.Millisecond))
+	assert.NoError(t, store.Set(context.Background(), "long", "value", time.Hour))
+
+	time.Sleep(100 * time.Millisecond)
+
+	found, err := store.Exists(context.Background(), "short")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	value, err := store.Get(context.Background(), "long")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	// the expiry routine should have removed the key from the file as well
+	err = store.(*BoltStore).Client.View(func(tx *bolt.Tx) error {
+		assert.Nil(t, tx.Bucket([]byte(boltBucket)).Get([]byte("short")))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestBoltStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+
+	store, err := CreateStorage("file://" + path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Set(context.Background(), "test", "value", time.Hour))
+	assert.NoError(t, store.Close())
+
+	store, err = CreateStorage("file://" + path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	value, err := store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestCreateStorageBoltLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+
+	store, err := CreateStorage("file://" + path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	second, err := CreateStorage(fmt.Sprintf("file://%s?lock-timeout=100ms", path))
+	assert.Nil(t, second)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "locked")
+}
+
+func TestCreateStorageBoltBadInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.db")
+	store, err := CreateStorage(fmt.Sprintf("file://%s?expiry-interval=bad", path))
+	assert.Nil(t, store)
+	assert.Error(t, err)
+}
+
+func TestCreateStorageMemory(t *testing.T) {
+	testCases := []struct {
+		Location string
+		Ok       bool
+	}{
+		{Location: "memory://", Ok: true},
+		{Location: "memory://?max-entries=10&max-bytes=1024", Ok: true},
+		{Location: "memory://?expiry-interval=1s", Ok: true},
+		{Location: "memory://?max-entries=bad"},
+		{Location: "memory://?max-entries=-1"},
+		{Location: "memory://?max-bytes=-1"},
+		{Location: "memory://?expiry-interval=0s"},
+	}
+
+	for _, testCase := range testCases {
+		store, err := CreateStorage(testCase.Location)
+		if testCase.Ok {
+			assert.NoError(t, err, testCase.Location)
+			assert.NotNil(t, store, testCase.Location)
+			assert.NoError(t, store.Close())
+			continue
+		}
+		assert.Error(t, err, testCase.Location)
+		assert.Nil(t, store, testCase.Location)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(0, 0, 0)
+	defer store.Close()
+
+	assert.NoError(t, store.Set(context.Background(), "test", "value", 0))
+
+	found, err := store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	value, err := store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, store.Set(context.Background(), "test", "updated", 0))
+	value, err = store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "updated", value)
+	assert.Equal(t, 1, store.Len())
+
+	assert.NoError(t, store.Delete(context.Background(), "test"))
+
+	found, err = store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	value, err = store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestMemoryStoreExpiration(t *testing.T) {
+	store := NewMemoryStore(0, 0, 0)
+	defer store.Close()
+
+	assert.NoError(t, store.Set(context.Background(), "short", "value", 20*time.Millisecond))
+	assert.NoError(t, store.Set(context.Background(), "long", "value", time.Hour))
+
+	store.purge(time.Now().Add(time.Minute))
+	assert.Equal(t, 1, store.Len())
+
+	assert.NoError(t, store.Set(context.Background(), "short", "value", 20*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+
+	found, err := store.Exists(context.Background(), "short")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	value, err := store.Get(context.Background(), "long")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestMemoryStoreMaxEntries(t *testing.T) {
+	store := NewMemoryStore(2, 0, 0)
+	defer store.Close()
+
+	assert.NoError(t, store.Set(context.Background(), "a", "1", 0))
+	assert.NoError(t, store.Set(context.Background(), "b", "2", 0))
+
+	// touch a so b becomes the least recently used
+	_, err := store.Get(context.Background(), "a")
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Set(context.Background(), "c", "3", 0))
+	assert.Equal(t, 2, store.Len())
+
+	found, _ := store.Exists(context.Background(), "b")
+	assert.False(t, found)
+	found, _ = store.Exists(context.Background(), "a")
+	assert.True(t, found)
+	found, _ = store.Exists(context.Background(), "c")
+	assert.True(t, found)
+}
+
+func TestMemoryStoreMaxBytes(t *testing.T) {
+	store := NewMemoryStore(0, 8, 0)
+	defer store.Close()
+
+	assert.NoError(t, store.Set(context.Background(), "a", "1234", 0))
+	assert.NoError(t, store.Set(context.Background(), "b", "1234", 0))
+	assert.Equal(t, 1, store.Len())
+
+	found, _ := store.Exists(context.Background(), "a")
+	assert.False(t, found)
+	found, _ = store.Exists(context.Background(), "b")
+	assert.True(t, found)
+
+	assert.Error(t, store.Set(context.Background(), "c", "12345678", 0))
+}
+
+func TestParseRedisOptions(t *testing.T) {
+	testCases := []struct {
+		Location   string
+		Ok         bool
+		Addrs      []string
+		DB         int
+		MasterName string
+		PoolSize   int
+		Timeout    time.Duration
+		TLS        bool
+	}{
+		{
+			Location: "redis://127.0.0.1:6379",
+			Ok:       true,
+			Addrs:    []string{"127.0.0.1:6379"},
+		},
+		{
+			Location: "redis://127.0.0.1:6379/3",
+			Ok:       true,
+			Addrs:    []string{"127.0.0.1:6379"},
+			DB:       3,
+		},
+		{
+			Location: "redis://127.0.0.1:6379?db=4&pool_size=20&dial_timeout=2s&read_timeout=3s",
+			Ok:       true,
+			Addrs:    []string{"127.0.0.1:6379"},
+			DB:       4,
+			PoolSize: 20,
+			Timeout:  2 * time.Second,
+		},
+		{
+			Location: "rediss://127.0.0.1:6379?ca_file=../../tests/ca.pem",
+			Ok:       true,
+			Addrs:    []string{"127.0.0.1:6379"},
+			TLS:      true,
+		},
+		{
+			Location:   "redis+sentinel://:secret@10.0.0.1:26379,10.0.0.2:26379/mymaster/2",
+			Ok:         true,
+			Addrs:      []string{"10.0.0.1:26379", "10.0.0.2:26379"},
+			DB:         2,
+			MasterName: "mymaster",
+		},
+		{
+			Location:   "rediss+sentinel://10.0.0.1:26379/mymaster",
+			Ok:         true,
+			Addrs:      []string{"10.0.0.1:26379"},
+			MasterName: "mymaster",
+			TLS:        true,
+		},
+		{
+			Location: "redis+cluster://10.0.0.1:6379,10.0.0.2:6379,10.0.0.3:6379",
+			Ok:       true,
+			Addrs:    []string{"10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"},
+		},
+		{Location: "redis+sentinel://10.0.0.1:26379"},
+		{Location: "redis+cluster://10.0.0.1:6379/1"},
+		{Location: "redis://127.0.0.1:6379?db=bad"},
+		{Location: "redis://127.0.0.1:6379?pool_size=0"},
+		{Location: "redis://127.0.0.1:6379?dial_timeout=bad"},
+		{Location: "redis://127.0.0.1:6379?ca_file=../../tests/ca.pem"},
+		{Location: "rediss://127.0.0.1:6379?ca_file=/does/not/exist"},
+		{Location: "redis:///"},
+	}
+
+	for _, testCase := range testCases {
+		uri, err := url.Parse(testCase.Location)
+		assert.NoError(t, err, testCase.Location)
+
+		options, err := parseRedisOptions(uri)
+		if !testCase.Ok {
+			assert.Error(t, err, testCase.Location)
+			continue
+		}
+
+		assert.NoError(t, err, testCase.Location)
+		assert.Equal(t, testCase.Addrs, options.Addrs, testCase.Location)
+		assert.Equal(t, testCase.DB, options.DB, testCase.Location)
+		assert.Equal(t, testCase.MasterName, options.MasterName, testCase.Location)
+		assert.Equal(t, testCase.PoolSize, options.PoolSize, testCase.Location)
+		assert.Equal(t, testCase.Timeout, options.DialTimeout, testCase.Location)
+		assert.Equal(t, testCase.TLS, options.TLSConfig != nil, testCase.Location)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	server.RequireAuth("secret")
+
+	store, err := CreateStorage(fmt.Sprintf("redis://:secret@%s?db=2", server.Addr()))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Set(context.Background(), "test", "value", time.Hour))
+
+	// the key should have been written to the selected db
+	value, err := server.DB(2).Get("test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.False(t, server.DB(0).Exists("test"))
+
+	found, err := store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	value, err = store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, store.Delete(context.Background(), "test"))
+
+	found, err = store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	value, err = store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Empty(t, value)
+}
+
+func TestRedisStoreBadPassword(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	server.RequireAuth("secret")
+
+	store, err := CreateStorage(fmt.Sprintf("redis://:wrong@%s", server.Addr()))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.Error(t, store.Set(context.Background(), "test", "value", time.Hour))
+}
+
+func TestRedisStoreCluster(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	store, err := CreateStorage(fmt.Sprintf("redis+cluster://%s", server.Addr()))
+	assert.NoError(t, err)
+	assert.NotNil(t, store)
+	assert.NoError(t, store.Close())
+}
+
+func TestStoreCancelledContext(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	for _, location := range []string{
+		"file://" + filepath.Join(t.TempDir(), "bolt.db"),
+		fmt.Sprintf("redis://%s", server.Addr()),
+	} {
+		store, err := CreateStorage(location)
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		assert.Error(t, store.Set(ctx, "test", "value", time.Hour), location)
+		_, err = store.Get(ctx, "test")
+		assert.Error(t, err, location)
+		_, err = store.Exists(ctx, "test")
+		assert.Error(t, err, location)
+		assert.Error(t, store.Delete(ctx, "test"), location)
+		assert.NoError(t, store.Close())
+	}
+}
+
+func TestStoreDeletePrefix(t *testing.T) {
+	server, err := miniredis.Run()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	for _, location := range []string{
+		"memory://",
+		"file://" + filepath.Join(t.TempDir(), "bolt.db"),
+		fmt.Sprintf("redis://%s", server.Addr()),
+	} {
+		store, err := CreateStorage(location)
+		assert.NoError(t, err)
+
+		ctx := context.Background()
+
+		for _, key := range []string{"a*:1", "a*:2", "a*", "ab:1", "b:1"} {
+			assert.NoError(t, store.Set(ctx, key, "value", time.Hour), location)
+		}
+
+		// @note: the prefix is literal, the glob characters of redis are not expanded
+		assert.NoError(t, store.DeletePrefix(ctx, "a*:"), location)
+
+		for key, expected := range map[string]bool{"a*:1": false, "a*:2": false, "a*": true, "ab:1": true, "b:1": true} {
+			found, err := store.Exists(ctx, key)
+			assert.NoError(t, err, location)
+			assert.Equal(t, expected, found, "%s %s", location, key)
+		}
+
+		assert.NoError(t, store.DeletePrefix(ctx, "missing:"), location)
+		assert.NoError(t, store.Close())
+	}
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	store := NewInstrumentedStore(NewMemoryStore(0, 16, 0))
+	defer store.Close()
+
+	assert.Equal(t, "memory", store.backend)
+
+	failures := storeErrorsMetric.WithLabelValues("set", "memory")
+	failed := testutil.ToFloat64(failures)
+
+	assert.NoError(t, store.Set(context.Background(), "test", "value", 0))
+	assert.Equal(t, failed, testutil.ToFloat64(failures))
+
+	assert.Error(t, store.Set(context.Background(), "test", "12345678901234567", 0))
+	assert.Equal(t, failed+1, testutil.ToFloat64(failures))
+
+	value, err := store.Get(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	found, err := store.Exists(context.Background(), "test")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.NoError(t, store.Delete(context.Background(), "test"))
+
+	// @note: one series per operation on the memory backend
+	assert.Equal(t, 4, testutil.CollectAndCount(storeLatencyMetric))
+}
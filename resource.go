@@ -18,8 +18,12 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func newResource() *Resource {
@@ -34,14 +38,26 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 		return nil, errors.New("the resource has no options")
 	}
 
-	for _, x := range strings.Split(resource, "|") {
-		keyPair := strings.Split(x, "=")
+	// @note: the separators within single quotes, i.e. of the match-claims regexes, are kept
+	options := splitUnquoted(resource, '|')
+
+	for idx, x := range options {
+		// @note: the policy is the last option, as the expression may hold | and =
+		if strings.HasPrefix(x, "policy=") {
+			r.Policy = strings.TrimPrefix(strings.Join(options[idx:], "|"), "policy=")
+			break
+		}
+
+		// @note: only the first = separates the key, the values of the maps hold their own
+		keyPair := strings.SplitN(x, "=", 2)
 
 		if len(keyPair) != 2 {
 			return nil,
 				errors.New(
 					"invalid resource keypair, should be " +
-						"(uri|roles|methods|white-listed)=comma_values",
+						"(uri|hosts|roles|scopes|methods|white-listed|uma-method-scopes|match-claims|shadow|" +
+						"upstream-url|upstream-ca|upstream-timeout|skip-upstream-tls-verify|strip-prefix|add-prefix|rewrite-rules|" +
+						"introspect|policy)=comma_values",
 				)
 		}
 
@@ -52,6 +68,8 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			if !strings.HasPrefix(r.URL, "/") {
 				return nil, errors.New("the resource uri should start with a '/'")
 			}
+		case "hosts":
+			r.Hosts = strings.Split(keyPair[1], ",")
 		case "methods":
 			r.Methods = strings.Split(keyPair[1], ",")
 
@@ -72,6 +90,42 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			r.Roles = strings.Split(keyPair[1], ",")
 		case "groups":
 			r.Groups = strings.Split(keyPair[1], ",")
+		case "scopes":
+			r.Scopes = strings.Split(keyPair[1], ",")
+		case "require-any-scope":
+			val, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.RequireAnyScope = val
+		case "uma-method-scopes":
+			r.UmaMethodScopes = make(map[string]string)
+
+			for _, pair := range strings.Split(keyPair[1], ",") {
+				items := strings.SplitN(pair, "=", 2)
+
+				if len(items) != 2 || items[0] == "" || items[1] == "" {
+					return nil, errors.New("the uma-method-scopes should be method=scope pairs, i.e. GET=read,DELETE=delete")
+				}
+
+				r.UmaMethodScopes[items[0]] = items[1]
+			}
+		case "match-claims":
+			r.MatchClaims = make(map[string]string)
+
+			for _, pair := range splitUnquoted(keyPair[1], ',') {
+				items := append(strings.SplitN(pair, ":", 2), "")
+				regex := unquote(items[1])
+
+				// @note: a quote left in the regex is an unbalanced one
+				if items[0] == "" || regex == "" || strings.Contains(regex, "'") {
+					return nil, errors.New("the match-claims should be claim:regex pairs, i.e. aud:billing-api,tenant:'^(acme|globex)$'")
+				}
+
+				r.MatchClaims[items[0]] = regex
+			}
 		case "white-listed":
 			value, err := strconv.ParseBool(keyPair[1])
 
@@ -83,6 +137,48 @@ func (r *Resource) parse(resource string) (*Resource, error) {
 			}
 
 			r.WhiteListed = value
+		case "upstream-url":
+			r.Upstream = keyPair[1]
+		case "upstream-ca":
+			r.UpstreamCA = keyPair[1]
+		case "upstream-timeout":
+			value, err := time.ParseDuration(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.UpstreamTimeout = value
+		case "skip-upstream-tls-verify":
+			value, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.SkipUpstreamTLSVerify = value
+		case "strip-prefix":
+			r.StripPrefix = keyPair[1]
+		case "add-prefix":
+			r.AddPrefix = keyPair[1]
+		case "rewrite-rules":
+			r.RewriteRules = strings.Split(keyPair[1], ",")
+		case "shadow":
+			value, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.Shadow = value
+		case "introspect":
+			value, err := strconv.ParseBool(keyPair[1])
+
+			if err != nil {
+				return nil, err
+			}
+
+			r.Introspect = value
 		default:
 			return nil,
 				errors.New("invalid identifier, should be roles, uri or methods")
@@ -114,6 +210,55 @@ func (r *Resource) valid() error {
 		)
 	}
 
+	if r.WhiteListed && r.Policy != "" {
+		return fmt.Errorf("the white-listed resource %s can not have a policy", r.URL)
+	}
+
+	if r.WhiteListed && r.Shadow {
+		return fmt.Errorf("the white-listed resource %s can not be in shadow mode", r.URL)
+	}
+
+	if r.WhiteListed && len(r.Scopes) > 0 {
+		return fmt.Errorf("the white-listed resource %s can not require scopes", r.URL)
+	}
+
+	if r.WhiteListed && len(r.MatchClaims) > 0 {
+		return fmt.Errorf("the white-listed resource %s can not match claims", r.URL)
+	}
+
+	for idx, host := range r.Hosts {
+		name := strings.TrimPrefix(host, "*.")
+
+		if name == "" || strings.ContainsAny(name, "*/:") {
+			return fmt.Errorf(
+				"the host %s of resource %s is invalid, should be a name or a wildcard i.e. *.example.com",
+				host,
+				r.URL,
+			)
+		}
+
+		r.Hosts[idx] = strings.ToLower(host)
+	}
+
+	for claim, match := range r.MatchClaims {
+		if _, err := regexp.Compile(match); err != nil {
+			return fmt.Errorf(
+				"the claim matcher: %s for claim: %s of resource %s is not a valid regex",
+				match,
+				claim,
+				r.URL,
+			)
+		}
+	}
+
+	if err := r.isUpstreamValid(); err != nil {
+		return err
+	}
+
+	if _, err := newPathRewrite(r.StripPrefix, r.AddPrefix, r.RewriteRules); err != nil {
+		return fmt.Errorf("invalid rewrite for resource %s: %s", r.URL, err)
+	}
+
 	// step: add any of no methods
 	if len(r.Methods) == 0 {
 		r.Methods = allHTTPMethods
@@ -125,9 +270,75 @@ func (r *Resource) valid() error {
 		}
 	}
 
+	scopes, err := normalizeMethodScopes(r.UmaMethodScopes)
+	if err != nil {
+		return err
+	}
+
+	r.UmaMethodScopes = scopes
+
+	return nil
+}
+
+// isUpstreamValid checks the upstream of the resource, its settings requiring one
+func (r *Resource) isUpstreamValid() error {
+	if r.Upstream == "" {
+		if r.UpstreamCA != "" || r.UpstreamTimeout != 0 || r.SkipUpstreamTLSVerify {
+			return fmt.Errorf("the upstream settings of resource %s require an upstream-url", r.URL)
+		}
+
+		return nil
+	}
+
+	endpoint, err := url.Parse(r.Upstream)
+	if err != nil {
+		return fmt.Errorf("the upstream-url of resource %s is invalid: %s", r.URL, err)
+	}
+
+	if endpoint.Scheme == "" || (endpoint.Host == "" && endpoint.Scheme != "unix") {
+		return fmt.Errorf("the upstream-url of resource %s should be absolute, i.e. http://billing:8080", r.URL)
+	}
+
+	if r.UpstreamTimeout < 0 {
+		return fmt.Errorf("the upstream-timeout of resource %s cannot be negative", r.URL)
+	}
+
+	if r.SkipUpstreamTLSVerify && r.UpstreamCA != "" {
+		return fmt.Errorf("the resource %s cannot skip the upstream tls and load a root ca to verify it", r.URL)
+	}
+
+	if r.UpstreamCA != "" && !fileExists(r.UpstreamCA) {
+		return fmt.Errorf("the upstream-ca of resource %s does not exist", r.URL)
+	}
+
 	return nil
 }
 
+// normalizeMethodScopes checks the methods of the mapping, returning it keyed by upper case method
+func normalizeMethodScopes(scopes map[string]string) (map[string]string, error) {
+	if scopes == nil {
+		return nil, nil
+	}
+
+	normalized := make(map[string]string, len(scopes))
+
+	for method, scope := range scopes {
+		method = strings.ToUpper(method)
+
+		if !isValidHTTPMethod(method) {
+			return nil, fmt.Errorf("invalid method %s in the uma method scopes", method)
+		}
+
+		if scope == "" {
+			return nil, fmt.Errorf("no uma scope for method %s", method)
+		}
+
+		normalized[method] = scope
+	}
+
+	return normalized, nil
+}
+
 // getRoles returns a list of roles for this resource
 func (r Resource) getRoles() string {
 	return strings.Join(r.Roles, ",")
@@ -135,8 +346,18 @@ func (r Resource) getRoles() string {
 
 // String returns a string representation of the resource
 func (r Resource) String() string {
+	uri := r.URL
+
+	if len(r.Hosts) > 0 {
+		uri = fmt.Sprintf("%s, hosts: %s", r.URL, strings.Join(r.Hosts, ","))
+	}
+
+	if r.Upstream != "" {
+		uri = fmt.Sprintf("%s, upstream: %s", uri, r.Upstream)
+	}
+
 	if r.WhiteListed {
-		return fmt.Sprintf("uri: %s, white-listed", r.URL)
+		return fmt.Sprintf("uri: %s, white-listed", uri)
 	}
 
 	roles := "authentication only"
@@ -150,5 +371,34 @@ func (r Resource) String() string {
 		methods = strings.Join(r.Methods, ",")
 	}
 
-	return fmt.Sprintf("uri: %s, methods: %s, required: %s", r.URL, methods, roles)
+	description := fmt.Sprintf("uri: %s, methods: %s, required: %s", uri, methods, roles)
+
+	if len(r.Scopes) > 0 {
+		description += fmt.Sprintf(", scopes: %s", strings.Join(r.Scopes, ","))
+	}
+
+	if r.Policy != "" {
+		description += fmt.Sprintf(", policy: %s", r.Policy)
+	}
+
+	if len(r.MatchClaims) > 0 {
+		claims := make([]string, 0, len(r.MatchClaims))
+
+		for claim, match := range r.MatchClaims {
+			claims = append(claims, claim+"="+match)
+		}
+
+		sort.Strings(claims)
+		description += fmt.Sprintf(", match-claims: %s", strings.Join(claims, ","))
+	}
+
+	if r.Shadow {
+		description += ", shadow"
+	}
+
+	if r.Introspect {
+		description += ", introspect"
+	}
+
+	return description
 }
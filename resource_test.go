@@ -20,6 +20,7 @@ package main
 
 import (
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
@@ -35,6 +36,18 @@ func TestDecodeResourceBad(t *testing.T) {
 		{Option: "uri=hello"},
 		{Option: "uri=/|white-listed=ERROR"},
 		{Option: "uri=/|require-any-role=BAD"},
+		{Option: "uri=/|uma-method-scopes=GET"},
+		{Option: "uri=/|uma-method-scopes=GET="},
+		{Option: "uri=/|uma-method-scopes==read"},
+		{Option: "uri=/|uma-method-scopes=GET:read"},
+		{Option: "uri=/|shadow=maybe"},
+		{Option: "uri=/|introspect=maybe"},
+		{Option: "uri=/|require-any-scope=maybe"},
+		{Option: "uri=/|match-claims=aud"},
+		{Option: "uri=/|match-claims=:billing"},
+		{Option: "uri=/|match-claims=aud:"},
+		{Option: "uri=/|match-claims=aud:''"},
+		{Option: "uri=/|match-claims=aud:'a|b|roles=admin"},
 	}
 	for i, testCase := range testCases {
 		if _, err := newResource().parse(testCase.Option); err == nil {
@@ -88,6 +101,99 @@ func TestResourceParseOk(t *testing.T) {
 			Option:   "uri=/*|require-any-role=true",
 			Resource: &Resource{URL: "/*", Methods: allHTTPMethods, RequireAnyRole: true},
 		},
+		{
+			Option: "uri=/*|uma-method-scopes=GET=read,DELETE=urn:app:delete",
+			Resource: &Resource{
+				URL:             "/*",
+				Methods:         allHTTPMethods,
+				UmaMethodScopes: map[string]string{"GET": "read", "DELETE": "urn:app:delete"},
+			},
+		},
+		{
+			Option: "uri=/api/*|roles=user|policy=claims.tenant == path.segment(2) || 'admin' in roles",
+			Resource: &Resource{
+				URL:     "/api/*",
+				Methods: allHTTPMethods,
+				Roles:   []string{"user"},
+				Policy:  "claims.tenant == path.segment(2) || 'admin' in roles",
+			},
+		},
+		{
+			Option: "uri=/payments/*|introspect=true",
+			Resource: &Resource{
+				URL:        "/payments/*",
+				Methods:    allHTTPMethods,
+				Introspect: true,
+			},
+		},
+		{
+			Option: "uri=/admin/*|roles=admin|shadow=true",
+			Resource: &Resource{
+				URL:     "/admin/*",
+				Methods: allHTTPMethods,
+				Roles:   []string{"admin"},
+				Shadow:  true,
+			},
+		},
+		{
+			Option: "uri=/orders/*|scopes=orders:read,orders:write|require-any-scope=true",
+			Resource: &Resource{
+				URL:             "/orders/*",
+				Methods:         allHTTPMethods,
+				Scopes:          []string{"orders:read", "orders:write"},
+				RequireAnyScope: true,
+			},
+		},
+		{
+			Option: "uri=/admin/*|hosts=admin.example.com,*.admin.example.com|roles=admin",
+			Resource: &Resource{
+				URL:     "/admin/*",
+				Hosts:   []string{"admin.example.com", "*.admin.example.com"},
+				Methods: allHTTPMethods,
+				Roles:   []string{"admin"},
+			},
+		},
+		{
+			Option: "uri=/billing/*|upstream-url=https://billing:8443|upstream-timeout=5s|skip-upstream-tls-verify=true",
+			Resource: &Resource{
+				URL:                   "/billing/*",
+				Methods:               allHTTPMethods,
+				Upstream:              "https://billing:8443",
+				UpstreamTimeout:       5 * time.Second,
+				SkipUpstreamTLSVerify: true,
+			},
+		},
+		{
+			Option: "uri=/app1/*|strip-prefix=/app1|add-prefix=/api|rewrite-rules=^/api/v1/(.*)$ /api/v2/$1",
+			Resource: &Resource{
+				URL:          "/app1/*",
+				Methods:      allHTTPMethods,
+				StripPrefix:  "/app1",
+				AddPrefix:    "/api",
+				RewriteRules: []string{"^/api/v1/(.*)$ /api/v2/$1"},
+			},
+		},
+		{
+			Option: "uri=/acme/*|match-claims=tenant:^acme$,iss:https://sso.acme.com/.*",
+			Resource: &Resource{
+				URL:         "/acme/*",
+				Methods:     allHTTPMethods,
+				MatchClaims: map[string]string{"tenant": "^acme$", "iss": "https://sso.acme.com/.*"},
+			},
+		},
+		{
+			Option: "uri=/acme/*|match-claims=tenant:'^(acme|globex)$',email:'^[a-z]{1,8}@acme.com$',aud:a=b|roles=user",
+			Resource: &Resource{
+				URL:     "/acme/*",
+				Methods: allHTTPMethods,
+				Roles:   []string{"user"},
+				MatchClaims: map[string]string{
+					"tenant": "^(acme|globex)$",
+					"email":  "^[a-z]{1,8}@acme.com$",
+					"aud":    "a=b",
+				},
+			},
+		},
 	}
 	for i, testCase := range testCases {
 		r, err := newResource().parse(testCase.Option)
@@ -152,6 +258,106 @@ func TestIsValid(t *testing.T) {
 	}
 }
 
+func TestIsValidPolicy(t *testing.T) {
+	resource := &Resource{URL: "/test", Policy: "'admin' in roles"}
+	assert.NoError(t, resource.valid())
+
+	resource = &Resource{URL: "/test", WhiteListed: true, Policy: "'admin' in roles"}
+	assert.Error(t, resource.valid())
+}
+
+func TestIsValidShadow(t *testing.T) {
+	resource := &Resource{URL: "/test", Shadow: true}
+	assert.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "shadow")
+
+	resource = &Resource{URL: "/test", WhiteListed: true, Shadow: true}
+	assert.Error(t, resource.valid())
+}
+
+func TestIsValidScopes(t *testing.T) {
+	resource := &Resource{URL: "/test", Scopes: []string{"orders:write"}}
+	assert.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "scopes: orders:write")
+
+	resource = &Resource{URL: "/test", WhiteListed: true, Scopes: []string{"orders:write"}}
+	assert.Error(t, resource.valid())
+}
+
+func TestIsValidHosts(t *testing.T) {
+	resource := &Resource{URL: "/test", Hosts: []string{"Admin.Example.com", "*.example.com"}}
+	assert.NoError(t, resource.valid())
+	assert.Equal(t, []string{"admin.example.com", "*.example.com"}, resource.Hosts)
+	assert.Contains(t, resource.String(), "hosts: admin.example.com,*.example.com")
+
+	for _, host := range []string{"", "*", "*.", "admin.*.com", "example.com:8080", "example.com/admin"} {
+		resource := &Resource{URL: "/test", Hosts: []string{host}}
+		assert.Error(t, resource.valid(), "%s should have failed", host)
+	}
+}
+
+func TestIsValidUpstream(t *testing.T) {
+	resource := &Resource{URL: "/test", Upstream: "http://billing:8080", UpstreamTimeout: time.Second}
+	assert.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "upstream: http://billing:8080")
+
+	resource = &Resource{URL: "/test", Upstream: "unix:///var/run/billing.sock"}
+	assert.NoError(t, resource.valid())
+
+	for _, resource := range []*Resource{
+		{URL: "/test", Upstream: "billing:8080"},
+		{URL: "/test", Upstream: "/billing"},
+		{URL: "/test", Upstream: "http://billing:8080", UpstreamTimeout: -time.Second},
+		{URL: "/test", Upstream: "http://billing:8080", UpstreamCA: "/no/such/ca.pem"},
+		{URL: "/test", Upstream: "https://billing:8443", UpstreamCA: "resource.go", SkipUpstreamTLSVerify: true},
+		{URL: "/test", UpstreamCA: "ca.pem"},
+		{URL: "/test", SkipUpstreamTLSVerify: true},
+	} {
+		assert.Error(t, resource.valid(), "%#v should have failed", resource)
+	}
+}
+
+func TestIsValidRewrite(t *testing.T) {
+	resource := &Resource{URL: "/test", StripPrefix: "/test", RewriteRules: []string{"^/v1/(.*)$ /v2/$1"}}
+	assert.NoError(t, resource.valid())
+
+	resource = &Resource{URL: "/test", StripPrefix: "test"}
+	assert.Error(t, resource.valid())
+
+	resource = &Resource{URL: "/test", RewriteRules: []string{"^/v1/(.*$ /v2/$1"}}
+	assert.Error(t, resource.valid())
+}
+
+func TestIsValidMatchClaims(t *testing.T) {
+	resource := &Resource{URL: "/test", MatchClaims: map[string]string{"aud": "^billing-api$"}}
+	assert.NoError(t, resource.valid())
+	assert.Contains(t, resource.String(), "match-claims: aud=^billing-api$")
+
+	resource = &Resource{URL: "/test", MatchClaims: map[string]string{"aud": "("}}
+	assert.Error(t, resource.valid())
+
+	resource = &Resource{URL: "/test", WhiteListed: true, MatchClaims: map[string]string{"aud": "billing"}}
+	assert.Error(t, resource.valid())
+}
+
+func TestIsValidUmaMethodScopes(t *testing.T) {
+	resource := &Resource{
+		URL:             "/test",
+		UmaMethodScopes: map[string]string{"get": "read", "Delete": "delete"},
+	}
+
+	assert.NoError(t, resource.valid())
+	assert.Equal(t, map[string]string{"GET": "read", "DELETE": "delete"}, resource.UmaMethodScopes)
+
+	for _, scopes := range []map[string]string{
+		{"NO_SUCH_METHOD": "read"},
+		{"GET": ""},
+	} {
+		resource := &Resource{URL: "/test", UmaMethodScopes: scopes}
+		assert.Error(t, resource.valid(), "%v should have failed", scopes)
+	}
+}
+
 var expectedRoles = []string{"1", "2", "3"}
 
 const rolesList = "1,2,3"
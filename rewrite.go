@@ -0,0 +1,194 @@
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// pathRewrite rewrites the paths of the requests to the upstream, and optionally the paths
+// of the redirects and cookies of its responses back
+type pathRewrite struct {
+	// stripPrefix is removed from the start of the paths
+	stripPrefix string
+	// addPrefix is prepended to the paths, once stripped
+	addPrefix string
+	// rules are the regex rewrites, applied in order on the prefixed paths
+	rules []rewriteRule
+}
+
+// rewriteRule replaces the matches of the pattern in the path
+type rewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// newPathRewrite compiles the rewrite, the rules being given as 'pattern replacement', i.e.
+// '^/v1/(.*)$ /api/$1', it returns nil when there is nothing to rewrite
+func newPathRewrite(stripPrefix, addPrefix string, rules []string) (*pathRewrite, error) {
+	if stripPrefix == "" && addPrefix == "" && len(rules) == 0 {
+		return nil, nil
+	}
+
+	for _, prefix := range []string{stripPrefix, addPrefix} {
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("the prefix %s should start with a '/'", prefix)
+		}
+	}
+
+	rewrite := &pathRewrite{
+		stripPrefix: strings.TrimSuffix(stripPrefix, "/"),
+		addPrefix:   strings.TrimSuffix(addPrefix, "/"),
+	}
+
+	for _, rule := range rules {
+		items := strings.Fields(rule)
+
+		if len(items) != 2 {
+			return nil, fmt.Errorf("the rewrite rule %s should be 'pattern replacement', i.e. '^/v1/(.*)$ /api/$1'", rule)
+		}
+
+		pattern, err := regexp.Compile(items[0])
+		if err != nil {
+			return nil, fmt.Errorf("the pattern of the rewrite rule %s is not a valid regex: %s", rule, err)
+		}
+
+		rewrite.rules = append(rewrite.rules, rewriteRule{pattern: pattern, replacement: items[1]})
+	}
+
+	return rewrite, nil
+}
+
+// request returns the path sent to the upstream
+func (p *pathRewrite) request(path string) string {
+	if p.stripPrefix != "" && hasPathPrefix(path, p.stripPrefix) {
+		path = ensureLeadingSlash(strings.TrimPrefix(path, p.stripPrefix))
+	}
+
+	if p.addPrefix != "" {
+		path = p.addPrefix + path
+	}
+
+	for _, rule := range p.rules {
+		path = rule.pattern.ReplaceAllString(path, rule.replacement)
+	}
+
+	return path
+}
+
+// response returns the path of the upstream as seen by the client, only the prefixes can be
+// reverted, not the rules
+func (p *pathRewrite) response(path string) string {
+	if p.stripPrefix == "" && p.addPrefix == "" {
+		return path
+	}
+
+	if p.addPrefix != "" {
+		if !hasPathPrefix(path, p.addPrefix) {
+			return path
+		}
+
+		path = ensureLeadingSlash(strings.TrimPrefix(path, p.addPrefix))
+	}
+
+	if p.stripPrefix == "" {
+		return path
+	}
+
+	if path == "/" {
+		return p.stripPrefix + "/"
+	}
+
+	return p.stripPrefix + path
+}
+
+// responseHeaders rewrites the paths of the redirect of the upstream, when it is relative or on
+// the host the request was proxied to, and of its cookies
+func (p *pathRewrite) responseHeaders(headers http.Header, host string) {
+	if location := headers.Get("Location"); location != "" {
+		if target, err := url.Parse(location); err == nil && (target.Host == "" || target.Host == host) &&
+			strings.HasPrefix(target.Path, "/") {
+			target.Path = p.response(target.Path)
+			target.RawPath = ""
+			headers.Set("Location", target.String())
+		}
+	}
+
+	cookies := headers.Values("Set-Cookie")
+
+	for idx, cookie := range cookies {
+		attributes := strings.Split(cookie, ";")
+
+		for position, attribute := range attributes[1:] {
+			name := strings.SplitN(strings.TrimSpace(attribute), "=", 2)
+
+			if len(name) == 2 && strings.EqualFold(name[0], "path") {
+				attributes[position+1] = " Path=" + p.response(name[1])
+			}
+		}
+
+		cookies[idx] = strings.Join(attributes, ";")
+	}
+}
+
+// hasPathPrefix checks the path is the prefix or below it
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func ensureLeadingSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+
+	return path
+}
+
+// rewriteResponseWriter rewrites the headers of the upstream response before they are written
+type rewriteResponseWriter struct {
+	http.ResponseWriter
+	rewrite     *pathRewrite
+	host        string
+	wroteHeader bool
+}
+
+func (w *rewriteResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.rewrite.responseHeaders(w.Header(), w.host)
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *rewriteResponseWriter) Write(content []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(content)
+}
+
+// Flush sends the buffered content, so streamed responses are kept streaming
+func (w *rewriteResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
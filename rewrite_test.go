@@ -0,0 +1,119 @@
+//go:build !e2e
+// +build !e2e
+
+/*
+Copyright 2015 All rights reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPathRewrite(t *testing.T) {
+	testCases := []struct {
+		StripPrefix string
+		AddPrefix   string
+		Rules       []string
+		Path        string
+		Expected    string
+		Response    string
+	}{
+		{StripPrefix: "/app1", Path: "/app1/users", Expected: "/users", Response: "/app1/users"},
+		{StripPrefix: "/app1/", Path: "/app1", Expected: "/", Response: "/app1/"},
+		{StripPrefix: "/app1", Path: "/app10/users", Expected: "/app10/users", Response: "/app1/app10/users"},
+		{AddPrefix: "/api", Path: "/users", Expected: "/api/users", Response: "/users"},
+		{StripPrefix: "/app1", AddPrefix: "/api", Path: "/app1/users", Expected: "/api/users", Response: "/app1/users"},
+		{
+			StripPrefix: "/app1",
+			Rules:       []string{"^/v1/(.*)$ /api/v1/$1", "/users$ /accounts"},
+			Path:        "/app1/v1/users",
+			Expected:    "/api/v1/accounts",
+			Response:    "/app1/api/v1/accounts",
+		},
+	}
+
+	for idx, testCase := range testCases {
+		rewrite, err := newPathRewrite(testCase.StripPrefix, testCase.AddPrefix, testCase.Rules)
+		require.NoError(t, err, "case %d", idx)
+
+		path := rewrite.request(testCase.Path)
+		assert.Equal(t, testCase.Expected, path, "case %d, request", idx)
+		assert.Equal(t, testCase.Response, rewrite.response(path), "case %d, response", idx)
+	}
+
+	rewrite, err := newPathRewrite("", "/api", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/other", rewrite.response("/other"))
+}
+
+func TestNewPathRewriteInvalid(t *testing.T) {
+	rewrite, err := newPathRewrite("", "", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, rewrite)
+
+	for _, testCase := range []struct {
+		StripPrefix string
+		AddPrefix   string
+		Rules       []string
+	}{
+		{StripPrefix: "app1"},
+		{AddPrefix: "api"},
+		{Rules: []string{"^/v1/(.*)$"}},
+		{Rules: []string{"^/v1/(.*)$ /api/$1 /more"}},
+		{Rules: []string{"^/v1/(.*$ /api/$1"}},
+	} {
+		_, err := newPathRewrite(testCase.StripPrefix, testCase.AddPrefix, testCase.Rules)
+		assert.Error(t, err, "%v should have failed", testCase)
+	}
+}
+
+func TestPathRewriteResponseHeaders(t *testing.T) {
+	rewrite, err := newPathRewrite("/app1", "", nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		Location string
+		Expected string
+	}{
+		{Location: "/login?next=%2Fhome", Expected: "/app1/login?next=%2Fhome"},
+		{Location: "http://upstream:8080/login", Expected: "http://upstream:8080/app1/login"},
+		{Location: "https://sso.example.com/login", Expected: "https://sso.example.com/login"},
+		{Location: "login", Expected: "login"},
+	}
+
+	for idx, testCase := range testCases {
+		headers := http.Header{}
+		headers.Set("Location", testCase.Location)
+		rewrite.responseHeaders(headers, "upstream:8080")
+		assert.Equal(t, testCase.Expected, headers.Get("Location"), "case %d", idx)
+	}
+
+	headers := http.Header{}
+	headers.Add("Set-Cookie", "session=abc; Path=/; HttpOnly")
+	headers.Add("Set-Cookie", "theme=dark; path=/settings; Max-Age=60")
+	headers.Add("Set-Cookie", "lang=en")
+	rewrite.responseHeaders(headers, "upstream:8080")
+
+	assert.Equal(
+		t,
+		[]string{"session=abc; Path=/app1/; HttpOnly", "theme=dark; Path=/app1/settings; Max-Age=60", "lang=en"},
+		headers.Values("Set-Cookie"),
+	)
+}
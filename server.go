@@ -47,6 +47,8 @@ import (
 	"github.com/elazarl/goproxy"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/gogatekeeper/gatekeeper/pkg/authorization"
+	"github.com/gogatekeeper/gatekeeper/pkg/policy"
 	"github.com/gogatekeeper/gatekeeper/pkg/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -71,8 +73,14 @@ type oauthProxy struct {
 	adminRouter    http.Handler
 	server         *http.Server
 	store          storage.Storage
+	authzCache     *storage.MemoryStore
+	umaResources   *authorization.ResourceCache
+	issuers        map[string]*TrustedIssuer
+	introspectURL  string
+	certMapping    *clientCertMapping
 	templates      *template.Template
 	upstream       reverseProxy
+	rewrite        *pathRewrite
 	pat            *PAT
 }
 
@@ -84,6 +92,7 @@ func init() {
 	prometheus.MustRegister(oauthLatencyMetric)
 	prometheus.MustRegister(oauthTokensMetric)
 	prometheus.MustRegister(statusMetric)
+	prometheus.MustRegister(shadowDenialsMetric)
 }
 
 const allPath = "/*"
@@ -123,9 +132,16 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	// initialize the store if any
 	if config.StoreURL != "" {
-		if svc.store, err = storage.CreateStorage(config.StoreURL); err != nil {
+		store, err := storage.CreateStorage(config.StoreURL)
+		if err != nil {
 			return nil, err
 		}
+
+		svc.store = storage.NewInstrumentedStore(store)
+
+		if config.AuthzCacheSize > 0 && config.AuthzCacheTTL > 0 {
+			svc.authzCache = storage.NewMemoryStore(config.AuthzCacheSize, 0, config.AuthzCacheTTL)
+		}
 	}
 
 	svc.log.Info(
@@ -145,12 +161,49 @@ func newProxy(config *Config) (*oauthProxy, error) {
 
 	svc.log.Info("successfully retrieved openid configuration from the discovery")
 
+	if err := svc.newTrustedIssuers(); err != nil {
+		svc.log.Error(
+			"failed to get the configuration of the trusted issuers from discovery",
+			zap.Error(err),
+		)
+		return nil, err
+	}
+
+	if config.useTokenIntrospection() {
+		if svc.introspectURL, err = svc.getIntrospectionEndpoint(); err != nil {
+			svc.log.Error("failed to get the introspection endpoint", zap.Error(err))
+			return nil, err
+		}
+
+		if config.EnableRefreshTokens {
+			svc.log.Warn("the introspected access tokens are not refreshed, their expiry sends the browsers to the login again")
+		}
+	}
+
+	if config.EnableClientCertIdentity {
+		if svc.certMapping, err = newClientCertMapping(config.ClientCertMapping); err != nil {
+			svc.log.Error("failed to load the client certificate mapping", zap.Error(err))
+			return nil, err
+		}
+	}
+
 	if config.EnableUma || config.EnableForwarding {
 		patDone := make(chan bool)
 		go svc.getPAT(patDone)
 		<-patDone
 	}
 
+	if config.EnableUmaResourceCache {
+		svc.umaResources = authorization.NewResourceCache()
+
+		// @note: until the resources are loaded they are retrieved from the idp per request
+		_ = svc.loadUmaResources()
+
+		if config.UmaResourceCacheInterval > 0 {
+			go svc.refreshUmaResources()
+		}
+	}
+
 	if config.SkipTokenVerification {
 		log.Warn(
 			"TESTING ONLY CONFIG - access token verification has been disabled",
@@ -249,7 +302,14 @@ func (r *oauthProxy) createReverseProxy() error {
 		zap.String("url", r.config.Upstream),
 	)
 
-	if err := r.createUpstreamProxy(r.endpoint); err != nil {
+	upstream, err := r.createUpstreamProxy(r.endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	r.upstream = upstream
+
+	if r.rewrite, err = newPathRewrite(r.config.StripPrefix, r.config.AddPrefix, r.config.RewriteRules); err != nil {
 		return err
 	}
 
@@ -288,6 +348,38 @@ func (r *oauthProxy) createReverseProxy() error {
 
 	adminEngine.Get(healthURL, r.healthHandler)
 
+	// @note: the endpoint is not authenticated, so it is never served on the main listener
+	if r.config.EnableUmaResourceCache && r.config.ListenAdmin == "" {
+		r.log.Warn("the uma resources refresh endpoint is only served on the admin listener, see --listen-admin")
+	} else if r.config.EnableUmaResourceCache {
+		r.log.Info(
+			"enabled the uma resources refresh endpoint",
+			zap.String("path", path.Clean(r.config.WithOAuthURI(umaResourcesURL))),
+		)
+
+		if !r.config.isAdminListenerAuthenticated() {
+			r.log.Warn("the admin listener does not require client certificates, anyone reaching it can refresh the uma resources")
+		}
+
+		adminEngine.Post(umaResourcesURL, r.umaResourcesHandler)
+	}
+
+	// @note: the endpoint is not authenticated, so it is never served on the main listener
+	if r.config.StoreURL != "" && (r.config.EnableUma || r.config.EnableHTTPAuthz) && r.config.ListenAdmin == "" {
+		r.log.Warn("the authz decisions invalidation endpoint is only served on the admin listener, see --listen-admin")
+	} else if r.config.StoreURL != "" && (r.config.EnableUma || r.config.EnableHTTPAuthz) {
+		r.log.Info(
+			"enabled the authz decisions invalidation endpoint",
+			zap.String("path", path.Clean(r.config.WithOAuthURI(authzURL))),
+		)
+
+		if !r.config.isAdminListenerAuthenticated() {
+			r.log.Warn("the admin listener does not require client certificates, anyone reaching it can invalidate the authz decisions")
+		}
+
+		adminEngine.Delete(authzURL+"/{subject}", r.authzHandler)
+	}
+
 	if r.config.EnableMetrics {
 		r.log.Info(
 			"enabled the service metrics middleware",
@@ -374,8 +466,7 @@ func (r *oauthProxy) createReverseProxy() error {
 	}
 
 	// step: provision in the protected resources
-	enableDefaultDeny := r.config.EnableDefaultDeny
-	enableDefaultDenyStrict := r.config.EnableDefaultDenyStrict
+	hosts := make([]string, 0)
 
 	for _, res := range r.config.Resources {
 		if res.URL[len(res.URL)-1:] == "/" {
@@ -385,33 +476,158 @@ func (r *oauthProxy) createReverseProxy() error {
 				zap.String("amended", strings.TrimRight(res.URL, "/")))
 		}
 
-		if res.URL == allPath && (r.config.EnableDefaultDeny || r.config.EnableDefaultDenyStrict) {
-			switch res.WhiteListed {
-			case true:
-				return errors.New("you've asked for a default denial but whitelisted everything")
-			default:
-				enableDefaultDeny = false
-				enableDefaultDenyStrict = false
+		if res.URL == allPath && res.WhiteListed && len(res.Hosts) == 0 &&
+			(r.config.EnableDefaultDeny || r.config.EnableDefaultDenyStrict) {
+			return errors.New("you've asked for a default denial but whitelisted everything")
+		}
+
+		r.log.Info(
+			"protecting resource",
+			zap.String("resource", res.String()),
+		)
+
+		if res.Policy != "" {
+			compiled, err := policy.Compile(res.Policy)
+			if err != nil {
+				return fmt.Errorf("invalid policy for resource %s: %s", res.URL, err)
+			}
+
+			res.compiledPolicy = compiled
+		}
+
+		if res.Upstream != "" {
+			if res.endpoint, err = url.Parse(res.Upstream); err != nil {
+				return err
+			}
+
+			if res.upstream, err = r.createUpstreamProxy(res.endpoint, res); err != nil {
+				return err
+			}
+		}
+
+		if res.StripPrefix != "" || res.AddPrefix != "" || len(res.RewriteRules) > 0 {
+			rules := res.RewriteRules
+			if len(rules) == 0 {
+				rules = r.config.RewriteRules
+			}
+
+			res.rewrite, err = newPathRewrite(
+				defaultTo(res.StripPrefix, r.config.StripPrefix),
+				defaultTo(res.AddPrefix, r.config.AddPrefix),
+				rules,
+			)
+			if err != nil {
+				return fmt.Errorf("invalid rewrite for resource %s: %s", res.URL, err)
+			}
+		}
+
+		for _, host := range res.Hosts {
+			if !containedIn(host, hosts) {
+				hosts = append(hosts, host)
 			}
 		}
 	}
 
-	if enableDefaultDeny || enableDefaultDenyStrict {
-		r.log.Info("adding a default denial into the protected resources")
+	// @step: without virtual hosts the resources are routed along with the oauth endpoints,
+	// otherwise each host gets a router of its own resources and the ones of all the hosts
+	if len(hosts) == 0 {
+		r.addResources(engine, r.getHostResources(""))
+	} else {
+		router := &hostRouter{
+			routers:  make(map[string]chi.Router),
+			fallback: r.newResourcesRouter(),
+		}
 
-		r.config.Resources = append(
-			r.config.Resources,
-			&Resource{URL: allPath, Methods: allHTTPMethods},
-		)
+		r.addResources(router.fallback, r.getHostResources(""))
+
+		for _, host := range hosts {
+			r.log.Info("routing the resources of virtual host", zap.String("host", host))
+
+			router.hosts = append(router.hosts, host)
+			router.routers[host] = r.newResourcesRouter()
+			r.addResources(router.routers[host], r.getHostResources(host))
+		}
+
+		engine.Mount("/", router)
 	}
 
-	for _, res := range r.config.Resources {
+	for name, value := range r.config.MatchClaims {
 		r.log.Info(
-			"protecting resource",
-			zap.String("resource", res.String()),
+			"token must contain",
+			zap.String("claim", name),
+			zap.String("value", value),
 		)
+	}
+
+	if r.config.RedirectionURL == "" {
+		r.log.Warn("no redirection url has been set, will use host headers")
+	}
+
+	if r.config.EnableEncryptedToken {
+		r.log.Info("session access tokens will be encrypted")
+	}
+
+	return nil
+}
+
+// getHostResources returns the resources of the virtual host, along with the ones of all the
+// hosts, the latter coming first so the ones of the host override them
+func (r *oauthProxy) getHostResources(host string) []*Resource {
+	resources := make([]*Resource, 0)
+
+	for _, res := range r.config.Resources {
+		if len(res.Hosts) == 0 {
+			resources = append(resources, res)
+		}
+	}
+
+	if host == "" {
+		return resources
+	}
+
+	for _, res := range r.config.Resources {
+		if containedIn(host, res.Hosts) {
+			resources = append(resources, res)
+		}
+	}
+
+	return resources
+}
+
+// newResourcesRouter creates the router of the resources of a virtual host
+func (r *oauthProxy) newResourcesRouter() chi.Router {
+	router := chi.NewRouter()
+	router.NotFound(emptyHandler)
+
+	if !r.config.EnableDefaultDeny && !r.config.EnableDefaultDenyStrict {
+		router.MethodNotAllowed(emptyHandler)
+	}
+
+	return router
+}
+
+// addResources routes the resources, adding the default denial when none of them covers
+// all the paths
+func (r *oauthProxy) addResources(router chi.Router, resources []*Resource) {
+	enableDefaultDeny := r.config.EnableDefaultDeny
+	enableDefaultDenyStrict := r.config.EnableDefaultDenyStrict
 
+	for _, res := range resources {
+		if res.URL == allPath {
+			enableDefaultDeny = false
+			enableDefaultDenyStrict = false
+		}
+	}
+
+	if enableDefaultDeny || enableDefaultDenyStrict {
+		r.log.Info("adding a default denial into the protected resources")
+
+		resources = append(resources, &Resource{URL: allPath, Methods: allHTTPMethods})
+	}
+
+	for _, res := range resources {
 		middlewares := []func(http.Handler) http.Handler{
+			resourceMiddleware(res),
 			r.authenticationMiddleware(),
 			r.admissionMiddleware(res),
 			r.identityHeadersMiddleware(r.config.AddClaims),
@@ -424,16 +640,17 @@ func (r *oauthProxy) createReverseProxy() error {
 			}
 		}
 
-		if r.config.EnableUma {
+		if r.config.EnableUma || r.config.EnableHTTPAuthz {
 			middlewares = []func(http.Handler) http.Handler{
+				resourceMiddleware(res),
 				r.authenticationMiddleware(),
-				r.authorizationMiddleware(),
+				r.authorizationMiddleware(res),
 				r.admissionMiddleware(res),
 				r.identityHeadersMiddleware(r.config.AddClaims),
 			}
 		}
 
-		e := engine.With(middlewares...)
+		e := router.With(middlewares...)
 
 		for _, method := range res.Methods {
 			if !res.WhiteListed {
@@ -441,27 +658,29 @@ func (r *oauthProxy) createReverseProxy() error {
 				continue
 			}
 
-			engine.MethodFunc(method, res.URL, emptyHandler)
+			router.With(resourceMiddleware(res)).MethodFunc(method, res.URL, emptyHandler)
 		}
 	}
+}
 
-	for name, value := range r.config.MatchClaims {
-		r.log.Info(
-			"token must contain",
-			zap.String("claim", name),
-			zap.String("value", value),
-		)
-	}
-
-	if r.config.RedirectionURL == "" {
-		r.log.Warn("no redirection url has been set, will use host headers")
-	}
+// hostRouter hands the requests to the resources router of their virtual host, the requests
+// of the other hosts going to the fallback
+type hostRouter struct {
+	// hosts are the virtual hosts, i.e. admin.example.com or *.example.com
+	hosts []string
+	// routers are the resources routers of the hosts
+	routers map[string]chi.Router
+	// fallback routes the resources of all the hosts
+	fallback chi.Router
+}
 
-	if r.config.EnableEncryptedToken {
-		r.log.Info("session access tokens will be encrypted")
+func (h *hostRouter) ServeHTTP(wrt http.ResponseWriter, req *http.Request) {
+	if host := matchHost(req.Host, h.hosts); host != "" {
+		h.routers[host].ServeHTTP(wrt, req)
+		return
 	}
 
-	return nil
+	h.fallback.ServeHTTP(wrt, req)
 }
 
 // createForwardingProxy creates a forwarding proxy
@@ -478,14 +697,15 @@ func (r *oauthProxy) createForwardingProxy() error {
 		)
 	}
 
-	if err := r.createUpstreamProxy(nil); err != nil {
+	proxy, err := r.createUpstreamProxy(nil, nil)
+	if err != nil {
 		return err
 	}
 	//nolint:bodyclose
 	forwardingHandler := r.forwardProxyHandler()
 
 	// set the http handler
-	proxy := r.upstream.(*goproxy.ProxyHttpServer)
+	r.upstream = proxy
 	r.router = proxy
 
 	// setup the tls configuration
@@ -874,11 +1094,28 @@ func (r *oauthProxy) createHTTPListener(config listenerConfig) (net.Listener, er
 	return listener, nil
 }
 
-// createUpstreamProxy create a reverse http proxy from the upstream
-func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
+// createUpstreamProxy create a reverse http proxy from the upstream, the upstream of a resource
+// having its own tls verification and falling back to the global ca and timeout
+func (r *oauthProxy) createUpstreamProxy(upstream *url.URL, resource *Resource) (*goproxy.ProxyHttpServer, error) {
+	skipTLSVerify := r.config.SkipUpstreamTLSVerify
+	upstreamCA := r.config.UpstreamCA
+	timeout := r.config.UpstreamTimeout
+
+	if resource != nil {
+		skipTLSVerify = resource.SkipUpstreamTLSVerify
+
+		if resource.UpstreamCA != "" {
+			upstreamCA = resource.UpstreamCA
+		}
+
+		if resource.UpstreamTimeout > 0 {
+			timeout = resource.UpstreamTimeout
+		}
+	}
+
 	dialer := (&net.Dialer{
 		KeepAlive: r.config.UpstreamKeepaliveTimeout,
-		Timeout:   r.config.UpstreamTimeout,
+		Timeout:   timeout,
 	}).Dial
 
 	// are we using a unix socket?
@@ -899,7 +1136,7 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 	}
 	// create the upstream tls configure
 	//nolint:gas
-	tlsConfig := &tls.Config{InsecureSkipVerify: r.config.SkipUpstreamTLSVerify}
+	tlsConfig := &tls.Config{InsecureSkipVerify: skipTLSVerify}
 
 	// are we using a client certificate
 	// @TODO provide a means of reload on the client certificate when it expires. I'm not sure if it's just a
@@ -913,7 +1150,7 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 				zap.String("path", r.config.TLSClientCertificate),
 				zap.Error(err),
 			)
-			return err
+			return nil, err
 		}
 
 		pool := x509.NewCertPool()
@@ -924,16 +1161,16 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 
 	{
 		// @check if we have a upstream ca to verify the upstream
-		if r.config.UpstreamCA != "" {
+		if upstreamCA != "" {
 			r.log.Info(
 				"loading the upstream ca",
-				zap.String("path", r.config.UpstreamCA),
+				zap.String("path", upstreamCA),
 			)
 
-			cAuthority, err := ioutil.ReadFile(r.config.UpstreamCA)
+			cAuthority, err := ioutil.ReadFile(upstreamCA)
 
 			if err != nil {
-				return err
+				return nil, err
 			}
 
 			pool := x509.NewCertPool()
@@ -951,10 +1188,9 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 	proxy.KeepDestinationHeaders = true
 	proxy.Logger = httplog.New(ioutil.Discard, "", 0)
 	proxy.KeepDestinationHeaders = true
-	r.upstream = proxy
 
 	// update the tls configuration of the reverse proxy
-	r.upstream.(*goproxy.ProxyHttpServer).Tr = &http.Transport{
+	proxy.Tr = &http.Transport{
 		Dial:                  dialer,
 		DisableKeepAlives:     !r.config.UpstreamKeepalives,
 		ExpectContinueTimeout: r.config.UpstreamExpectContinueTimeout,
@@ -965,7 +1201,7 @@ func (r *oauthProxy) createUpstreamProxy(upstream *url.URL) error {
 		MaxIdleConnsPerHost:   r.config.MaxIdleConnsPerHost,
 	}
 
-	return nil
+	return proxy, nil
 }
 
 // createTemplates loads the custom template
@@ -1014,10 +1250,31 @@ func (r *oauthProxy) createTemplates() error {
 // newOpenIDProvider initializes the openID configuration, note: the redirection url is deliberately left blank
 // in order to retrieve it from the host header on request
 func (r *oauthProxy) newOpenIDProvider() (*oidc3.Provider, gocloak.GoCloak, error) {
+	client := r.newOpenIDClient(r.config.DiscoveryURI)
+
+	// see https://github.com/coreos/go-oidc/issues/214
+	// see https://github.com/coreos/go-oidc/pull/260
+	ctx := oidc3.ClientContext(context.Background(), client.RestyClient().GetClient())
+	provider, err := oidc3.NewProvider(ctx, r.config.DiscoveryURL)
+
+	if err != nil {
+		return nil,
+			nil,
+			fmt.Errorf(
+				"failed to retrieve the provider configuration from discovery url: %w",
+				err,
+			)
+	}
+
+	return provider, client, nil
+}
+
+// newOpenIDClient returns a client to the openid provider of the discovery url
+func (r *oauthProxy) newOpenIDClient(discoveryURI *url.URL) gocloak.GoCloak {
 	host := fmt.Sprintf(
 		"%s://%s",
-		r.config.DiscoveryURI.Scheme,
-		r.config.DiscoveryURI.Host,
+		discoveryURI.Scheme,
+		discoveryURI.Host,
 	)
 	client := gocloak.NewClient(host)
 	restyClient := client.RestyClient()
@@ -1033,21 +1290,76 @@ func (r *oauthProxy) newOpenIDProvider() (*oidc3.Provider, gocloak.GoCloak, erro
 		restyClient.SetProxy(r.config.OpenIDProviderProxy)
 	}
 
-	// see https://github.com/coreos/go-oidc/issues/214
-	// see https://github.com/coreos/go-oidc/pull/260
-	ctx := oidc3.ClientContext(context.Background(), restyClient.GetClient())
-	provider, err := oidc3.NewProvider(ctx, r.config.DiscoveryURL)
+	return client
+}
 
-	if err != nil {
-		return nil,
-			nil,
-			fmt.Errorf(
-				"failed to retrieve the provider configuration from discovery url: %w",
+// newTrustedIssuers retrieves the configuration of the trusted issuers, which are indexed
+// by the issuer their discovery advertises
+func (r *oauthProxy) newTrustedIssuers() error {
+	if len(r.config.TrustedIssuers) == 0 {
+		return nil
+	}
+
+	var primary struct {
+		Issuer string `json:"issuer"`
+	}
+
+	if err := r.provider.Claims(&primary); err != nil {
+		return err
+	}
+
+	r.issuers = make(map[string]*TrustedIssuer)
+
+	for _, issuer := range r.config.TrustedIssuers {
+		discoveryURI, err := url.Parse(issuer.DiscoveryURL)
+
+		if err != nil {
+			return err
+		}
+
+		ctx := oidc3.ClientContext(
+			context.Background(),
+			r.newOpenIDClient(discoveryURI).RestyClient().GetClient(),
+		)
+		provider, err := oidc3.NewProvider(ctx, issuer.DiscoveryURL)
+
+		if err != nil {
+			return fmt.Errorf(
+				"failed to retrieve the provider configuration from discovery url %s: %w",
+				issuer.DiscoveryURL,
 				err,
 			)
+		}
+
+		var advertised struct {
+			Issuer string `json:"issuer"`
+		}
+
+		if err := provider.Claims(&advertised); err != nil {
+			return err
+		}
+
+		if advertised.Issuer == primary.Issuer || r.issuers[advertised.Issuer] != nil {
+			return fmt.Errorf("the issuer %s is trusted more than once", advertised.Issuer)
+		}
+
+		issuer.issuer = advertised.Issuer
+		issuer.verifier = provider.Verifier(
+			&oidc3.Config{
+				ClientID:          issuer.ClientID,
+				SkipClientIDCheck: issuer.SkipClientIDCheck,
+			},
+		)
+		r.issuers[issuer.issuer] = issuer
+
+		r.log.Info(
+			"successfully retrieved openid configuration of the trusted issuer",
+			zap.String("issuer", issuer.issuer),
+			zap.String("url", issuer.DiscoveryURL),
+		)
 	}
 
-	return provider, client, nil
+	return nil
 }
 
 // Render implements the echo Render interface
@@ -1173,3 +1485,36 @@ func (r *oauthProxy) getPAT(done chan bool) {
 		<-time.After(refreshIn)
 	}
 }
+
+// loadUmaResources reloads the uma resources of the client into the local cache
+func (r *oauthProxy) loadUmaResources() error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(),
+		r.config.OpenIDProviderTimeout,
+	)
+
+	defer cancel()
+
+	r.pat.m.Lock()
+	token := r.pat.Token.AccessToken
+	r.pat.m.Unlock()
+
+	if err := r.umaResources.Load(ctx, r.idpClient, token, r.config.Realm); err != nil {
+		r.log.Error("failed to load the uma resources", zap.Error(err))
+		return err
+	}
+
+	r.log.Info("loaded the uma resources", zap.Int("resources", r.umaResources.Len()))
+
+	return nil
+}
+
+// refreshUmaResources reloads the uma resources on every uma resource cache interval
+func (r *oauthProxy) refreshUmaResources() {
+	ticker := time.NewTicker(r.config.UmaResourceCacheInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		_ = r.loadUmaResources()
+	}
+}
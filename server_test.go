@@ -19,7 +19,9 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -27,6 +29,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -56,6 +59,21 @@ func TestNewKeycloakProxy(t *testing.T) {
 	assert.NoError(t, proxy.Run())
 }
 
+func TestNewKeycloakProxyInvalidPolicy(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.DiscoveryURL = newFakeAuthServer(&fakeAuthConfig{}).getLocation()
+	cfg.Resources = []*Resource{
+		{
+			URL:     "/admin*",
+			Methods: allHTTPMethods,
+			Policy:  "'admin' in roles &&",
+		},
+	}
+
+	_, err := newProxy(cfg)
+	assert.Error(t, err)
+}
+
 func TestReverseProxyHeaders(t *testing.T) {
 	p := newFakeProxy(nil, &fakeAuthConfig{})
 	token := newTestToken(p.idp.getLocation())
@@ -876,6 +894,253 @@ func TestDefaultDenialStrict(t *testing.T) {
 	newFakeProxy(config, &fakeAuthConfig{}).RunTests(t, requests)
 }
 
+func TestVirtualHosts(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.EnableDefaultDeny = true
+	config.NoRedirects = true
+	config.Resources = []*Resource{
+		{
+			URL:     "/admin/*",
+			Hosts:   []string{"admin.example.com"},
+			Methods: allHTTPMethods,
+			Roles:   []string{fakeAdminRole},
+		},
+		{
+			URL:         "/admin/*",
+			Hosts:       []string{"docs.example.com"},
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+		{
+			URL:         "/public/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+		{
+			URL:         "/*",
+			Hosts:       []string{"*.static.example.com"},
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/admin/page",
+			Headers:       map[string]string{"Host": "docs.example.com"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/page",
+			Headers:      map[string]string{"Host": "admin.example.com"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           "/admin/page",
+			Headers:       map[string]string{"Host": "admin.example.com:8443"},
+			HasToken:      true,
+			Roles:         []string{fakeAdminRole},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/page",
+			Headers:      map[string]string{"Host": "admin.example.com"},
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		// @note: the default denial applies to each host without a resource on all the paths
+		{
+			URI:          "/other",
+			Headers:      map[string]string{"Host": "docs.example.com"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           "/other",
+			Headers:       map[string]string{"Host": "cdn.static.example.com"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:          "/admin/page",
+			Headers:      map[string]string{"Host": "example.org"},
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			URI:           "/public/page",
+			Headers:       map[string]string{"Host": "admin.example.com"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			URI:           "/public/page",
+			Headers:       map[string]string{"Host": "example.org"},
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+		},
+	}
+	newFakeProxy(config, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestVirtualHostsWhiteListedDefaultDenial(t *testing.T) {
+	config := newFakeKeycloakConfig()
+	config.DiscoveryURL = newFakeAuthServer(&fakeAuthConfig{}).getLocation()
+	config.EnableDefaultDeny = true
+	config.Resources = []*Resource{
+		{
+			URL:         "/*",
+			Hosts:       []string{"docs.example.com"},
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+	}
+
+	_, err := newProxy(config)
+	assert.NoError(t, err)
+
+	config = newFakeKeycloakConfig()
+	config.DiscoveryURL = newFakeAuthServer(&fakeAuthConfig{}).getLocation()
+	config.EnableDefaultDeny = true
+	config.Resources = []*Resource{
+		{
+			URL:         "/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+	}
+
+	_, err = newProxy(config)
+	assert.Error(t, err)
+}
+
+func TestResourceUpstream(t *testing.T) {
+	billing := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		wrt.Header().Set("X-Upstream", "billing")
+		(&fakeUpstreamService{}).ServeHTTP(wrt, req)
+	}))
+	defer billing.Close()
+
+	config := newFakeKeycloakConfig()
+	config.NoRedirects = true
+	config.Resources = []*Resource{
+		{
+			URL:             "/billing/*",
+			Methods:         allHTTPMethods,
+			Roles:           []string{fakeAdminRole},
+			Upstream:        billing.URL,
+			UpstreamTimeout: time.Second,
+		},
+		{
+			URL:         "/billing/public/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+			Upstream:    billing.URL,
+		},
+		{
+			URL:     "/orders/*",
+			Methods: allHTTPMethods,
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:             "/billing/invoices",
+			HasToken:        true,
+			Roles:           []string{fakeAdminRole},
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"X-Upstream": "billing"},
+			ExpectedContent: func(body string, testNum int) {
+				assert.Contains(t, body, "/billing/invoices")
+			},
+		},
+		{
+			URI:          "/billing/invoices",
+			HasToken:     true,
+			ExpectedCode: http.StatusForbidden,
+		},
+		{
+			URI:             "/billing/public/prices",
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"X-Upstream": "billing"},
+		},
+		{
+			URI:             "/orders/1",
+			HasToken:        true,
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"X-Upstream": ""},
+		},
+		{
+			URI:             "/other",
+			ExpectedProxy:   true,
+			ExpectedCode:    http.StatusOK,
+			ExpectedHeaders: map[string]string{"X-Upstream": ""},
+		},
+	}
+	newFakeProxy(config, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
+func TestPathRewriteUpstream(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		http.SetCookie(wrt, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		http.Redirect(wrt, req, "/login?from="+req.URL.Path, http.StatusFound)
+	}))
+	defer app.Close()
+
+	config := newFakeKeycloakConfig()
+	config.StripPrefix = "/app1"
+	config.EnableResponseRewrite = true
+	config.Resources = []*Resource{
+		{
+			URL:         "/app1/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+		},
+		{
+			URL:         "/app2/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+			StripPrefix: "/app2",
+			AddPrefix:   "/api",
+		},
+		{
+			URL:         "/app3/*",
+			Methods:     allHTTPMethods,
+			WhiteListed: true,
+			Upstream:    app.URL,
+			StripPrefix: "/app3",
+		},
+	}
+	requests := []fakeRequest{
+		{
+			URI:           "/app1/users",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedContent: func(body string, testNum int) {
+				assert.Contains(t, body, `"uri":"/users"`)
+			},
+		},
+		{
+			URI:           "/app2/users",
+			ExpectedProxy: true,
+			ExpectedCode:  http.StatusOK,
+			ExpectedContent: func(body string, testNum int) {
+				assert.Contains(t, body, `"uri":"/api/users"`)
+			},
+		},
+		{
+			URI:          "/app3/home",
+			ExpectedCode: http.StatusFound,
+			ExpectedHeaders: map[string]string{
+				"Location":   "/app3/login?from=/home",
+				"Set-Cookie": "session=abc; Path=/app3/",
+			},
+		},
+	}
+	newFakeProxy(config, &fakeAuthConfig{}).RunTests(t, requests)
+}
+
 func TestAuthorizationTemplate(t *testing.T) {
 	cfg := newFakeKeycloakConfig()
 	cfg.SignInPage = "templates/sign_in.html.tmpl"
@@ -1561,7 +1826,7 @@ func TestStoreAuthz(t *testing.T) {
 					t.Fatal("Problem parsing url")
 				}
 
-				err = p.proxy.StoreAuthz(jwt, url, authorization.AllowedAuthz, 1*time.Second)
+				err = p.proxy.StoreAuthz(context.Background(), &authzKey{token: jwt, method: http.MethodGet, path: url.Path}, &authorization.Decision{Result: authorization.AllowedAuthz}, 1*time.Second)
 
 				if err != nil && !testCase.ExpectedFailure {
 					t.Fatalf("error storing authz %v", err)
@@ -1569,7 +1834,7 @@ func TestStoreAuthz(t *testing.T) {
 
 				if !testCase.ExpectedFailure {
 					url.Path += "/append"
-					err = p.proxy.StoreAuthz(jwt, url, authorization.AllowedAuthz, 1*time.Second)
+					err = p.proxy.StoreAuthz(context.Background(), &authzKey{token: jwt, method: http.MethodGet, path: url.Path}, &authorization.Decision{Result: authorization.AllowedAuthz}, 1*time.Second)
 
 					if err != nil {
 						t.Fatalf("error storing authz %v", err)
@@ -1581,14 +1846,16 @@ func TestStoreAuthz(t *testing.T) {
 						t.Fatalf("expected two keys, got %d", len(keys))
 					}
 
-					decision, err := redisServer.Get(keys[0])
+					value, err := redisServer.Get(keys[0])
 
 					if err != nil {
 						t.Fatalf("problem getting value from redis")
 					}
 
-					if decision != authorization.AllowedAuthz.String() {
-						t.Fatalf("bad decision stored, expected allowed, got %v", decision)
+					decision := &authorization.Decision{}
+
+					if err := json.Unmarshal([]byte(value), decision); err != nil || decision.Result != authorization.AllowedAuthz {
+						t.Fatalf("bad decision stored, expected allowed, got %v", value)
 					}
 				}
 			},
@@ -1684,22 +1951,22 @@ func TestGetAuthz(t *testing.T) {
 				}
 
 				if !testCase.ExpectedFailure {
-					err = p.proxy.StoreAuthz(testCase.JWT, url, authorization.AllowedAuthz, 1*time.Second)
+					err = p.proxy.StoreAuthz(context.Background(), &authzKey{token: testCase.JWT, method: http.MethodGet, path: url.Path}, &authorization.Decision{Result: authorization.AllowedAuthz}, 1*time.Second)
 
 					if err != nil {
 						t.Fatalf("error storing authz %s", err)
 					}
 				}
 
-				dec, err := p.proxy.GetAuthz(testCase.JWT, url)
+				dec, err := p.proxy.GetAuthz(context.Background(), &authzKey{token: testCase.JWT, method: http.MethodGet, path: url.Path})
 
 				if err != nil {
 					if !testCase.ExpectedFailure {
 						t.Fatalf("error getting authz %s", err)
 					}
 
-					if dec != authorization.DeniedAuthz {
-						t.Fatalf("expected undefined authz decision, got %s", dec)
+					if dec != nil {
+						t.Fatalf("expected no authz decision, got %v", dec)
 					}
 
 					if testCase.JWT == "" && err != apperrors.ErrZeroLengthToken {
@@ -1712,11 +1979,263 @@ func TestGetAuthz(t *testing.T) {
 				}
 
 				if !testCase.ExpectedFailure {
-					if dec != authorization.AllowedAuthz {
-						t.Fatalf("bad decision stored, expected allowed, got %s", dec)
+					if dec.Result != authorization.AllowedAuthz || dec.CacheStatus != authorization.CacheHit {
+						t.Fatalf("bad decision stored, expected allowed, got %v", dec)
 					}
 				}
 			},
 		)
 	}
 }
+
+func TestStoreContext(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.StoreURL = "file://" + filepath.Join(t.TempDir(), "store.db")
+	cfg.StoreTimeout = time.Minute
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+	defer p.proxy.CloseStore()
+
+	ctx, cancel := p.proxy.storeContext(context.Background())
+	deadline, found := ctx.Deadline()
+	cancel()
+
+	assert.True(t, found)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+
+	// step: the request deadline still applies when it is the shorter
+	parent, stop := context.WithTimeout(context.Background(), time.Second)
+	defer stop()
+
+	ctx, cancel = p.proxy.storeContext(parent)
+	deadline, _ = ctx.Deadline()
+	cancel()
+
+	expected, _ := parent.Deadline()
+	assert.Equal(t, expected, deadline)
+
+	// step: a cancelled request aborts the store operation
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	assert.Error(t, p.proxy.StoreRefreshToken(ctx, "token", "value", time.Minute))
+	assert.NoError(t, p.proxy.StoreRefreshToken(context.Background(), "token", "value", time.Minute))
+}
+
+func TestStoreKeyPrefixAndEncryption(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+	defer redisServer.Close()
+
+	newProxy := func(prefix string) *fakeProxy {
+		cfg := newFakeKeycloakConfig()
+		cfg.StoreURL = fmt.Sprintf("redis://%s", redisServer.Addr())
+		cfg.StoreKeyPrefix = prefix
+		cfg.EnableStoreEncryption = true
+		cfg.EncryptionKey = testEncryptionKey
+
+		return newFakeProxy(cfg, &fakeAuthConfig{})
+	}
+
+	first := newProxy("first:")
+	second := newProxy("second:")
+
+	location, err := url.Parse("http://test.com/test")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, first.proxy.StoreRefreshToken(ctx, "token", "refresh", time.Minute))
+	assert.NoError(t, first.proxy.StoreAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path}, &authorization.Decision{Result: authorization.AllowedAuthz}, time.Minute))
+
+	keys := redisServer.Keys()
+	assert.Len(t, keys, 2)
+
+	for _, key := range keys {
+		assert.True(t, strings.HasPrefix(key, "first:"), key)
+
+		value, err := redisServer.Get(key)
+		assert.NoError(t, err)
+		assert.NotEqual(t, "refresh", value)
+		assert.NotContains(t, value, "token")
+	}
+
+	token, err := first.proxy.GetRefreshToken(ctx, "token")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh", token)
+
+	decision, err := first.proxy.GetAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path})
+	assert.NoError(t, err)
+	assert.Equal(t, authorization.AllowedAuthz, decision.Result)
+
+	// step: a proxy with another prefix cannot see the entries
+	_, err = second.proxy.GetRefreshToken(ctx, "token")
+	assert.Equal(t, apperrors.ErrNoSessionStateFound, err)
+
+	_, err = second.proxy.GetAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path})
+	assert.Equal(t, apperrors.ErrNoAuthzFound, err)
+}
+
+func TestAuthzKey(t *testing.T) {
+	base := authzKey{
+		subject: "subject",
+		token:   "token",
+		method:  http.MethodGet,
+		host:    "a.example.com",
+		path:    "/test",
+		scopes:  []string{"read", "write"},
+	}
+
+	variants := map[string]func(k *authzKey){
+		"token":  func(k *authzKey) { k.token = "other" },
+		"method": func(k *authzKey) { k.method = http.MethodDelete },
+		"host":   func(k *authzKey) { k.host = "b.example.com" },
+		"path":   func(k *authzKey) { k.path = "/other" },
+		"query":  func(k *authzKey) { k.query = "id=1" },
+		"scopes": func(k *authzKey) { k.scopes = []string{"read"} },
+	}
+
+	for name, change := range variants {
+		key := base
+		change(&key)
+		assert.NotEqual(t, base.String(), key.String(), name)
+		assert.True(t, strings.HasPrefix(key.String(), getAuthzSubjectKey("subject")), name)
+	}
+
+	reordered := base
+	reordered.scopes = []string{"write", "read"}
+	assert.Equal(t, base.String(), reordered.String())
+
+	other := base
+	other.subject = "other"
+	assert.False(t, strings.HasPrefix(other.String(), getAuthzSubjectKey("subject")))
+}
+
+func TestGetAuthzExpiration(t *testing.T) {
+	cfg := newFakeKeycloakConfig()
+	cfg.AuthzAllowTTL = time.Minute
+	cfg.AuthzDenyTTL = time.Second
+
+	proxy := &oauthProxy{config: cfg}
+
+	expiresAt := time.Now().Add(time.Hour)
+	assert.Equal(t, time.Minute, proxy.getAuthzExpiration(authorization.AllowedAuthz, expiresAt))
+	assert.Equal(t, time.Second, proxy.getAuthzExpiration(authorization.DeniedAuthz, expiresAt))
+
+	// step: a decision is never cached past the expiration of the token
+	expiresAt = time.Now().Add(500 * time.Millisecond)
+	assert.LessOrEqual(t, int64(proxy.getAuthzExpiration(authorization.DeniedAuthz, expiresAt)), int64(500*time.Millisecond))
+
+	// step: without a ttl the decision is cached until the token expires
+	cfg.AuthzAllowTTL = 0
+	expiresAt = time.Now().Add(time.Hour)
+	assert.Greater(t, int64(proxy.getAuthzExpiration(authorization.AllowedAuthz, expiresAt)), int64(time.Minute))
+}
+
+func TestDeleteAuthz(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+	defer redisServer.Close()
+
+	cfg := newFakeKeycloakConfig()
+	cfg.StoreURL = fmt.Sprintf("redis://%s", redisServer.Addr())
+	cfg.StoreKeyPrefix = "gatekeeper:"
+	p := newFakeProxy(cfg, &fakeAuthConfig{})
+
+	ctx := context.Background()
+	keys := []*authzKey{
+		{subject: "first", token: "token", method: http.MethodGet, path: "/a"},
+		{subject: "first", token: "token", method: http.MethodDelete, path: "/a"},
+		{subject: "second", token: "other", method: http.MethodGet, path: "/a"},
+	}
+
+	for _, key := range keys {
+		assert.NoError(t, p.proxy.StoreAuthz(ctx, key, &authorization.Decision{Result: authorization.AllowedAuthz}, time.Minute))
+	}
+
+	assert.NoError(t, p.proxy.StoreRefreshToken(ctx, "token", "refresh", time.Minute))
+	assert.NoError(t, p.proxy.DeleteAuthz(ctx, "first"))
+
+	// step: the decisions of the subject are gone from the store and the local cache alike
+	for _, key := range keys[:2] {
+		_, err := p.proxy.GetAuthz(ctx, key)
+		assert.Equal(t, apperrors.ErrNoAuthzFound, err)
+	}
+
+	decision, err := p.proxy.GetAuthz(ctx, keys[2])
+	assert.NoError(t, err)
+	assert.Equal(t, authorization.AllowedAuthz, decision.Result)
+
+	refresh, err := p.proxy.GetRefreshToken(ctx, "token")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh", refresh)
+}
+
+func TestAuthzLocalCache(t *testing.T) {
+	redisServer, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Starting redis failed %s", err)
+	}
+	defer redisServer.Close()
+
+	newProxy := func(size int, ttl time.Duration) *fakeProxy {
+		cfg := newFakeKeycloakConfig()
+		cfg.StoreURL = fmt.Sprintf("redis://%s", redisServer.Addr())
+		cfg.AuthzCacheSize = size
+		cfg.AuthzCacheTTL = ttl
+
+		return newFakeProxy(cfg, &fakeAuthConfig{})
+	}
+
+	location, err := url.Parse("http://test.com/test")
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	writer := newProxy(0, 0)
+	assert.Nil(t, writer.proxy.authzCache)
+	stored := &authorization.Decision{
+		Result:         authorization.AllowedAuthz,
+		Reason:         authorization.ReasonPermissionGranted,
+		ResourceID:     "resource",
+		GrantedScopes:  []string{"read", "write"},
+		RequiredScopes: []string{"read"},
+		CacheStatus:    authorization.CacheMiss,
+	}
+	assert.NoError(t, writer.proxy.StoreAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path}, stored, time.Minute))
+
+	// step: a miss in the local cache costs a single round trip to the store
+	reader := newProxy(10, 100*time.Millisecond)
+	commands := redisServer.CommandCount()
+
+	decision, err := reader.proxy.GetAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path})
+	assert.NoError(t, err)
+	assert.Equal(t, authorization.CacheHit, decision.CacheStatus)
+	decision.CacheStatus = stored.CacheStatus
+	assert.Equal(t, stored, decision)
+	assert.Equal(t, commands+1, redisServer.CommandCount())
+
+	// step: a hit is served locally, even once the store has lost the entry
+	redisServer.FlushAll()
+	commands = redisServer.CommandCount()
+
+	decision, err = reader.proxy.GetAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path})
+	assert.NoError(t, err)
+	assert.Equal(t, authorization.AllowedAuthz, decision.Result)
+	assert.Equal(t, commands, redisServer.CommandCount())
+
+	// step: once the local ttl has passed the store is consulted again
+	<-time.After(150 * time.Millisecond)
+
+	_, err = reader.proxy.GetAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path})
+	assert.Equal(t, apperrors.ErrNoAuthzFound, err)
+
+	// step: the local entry never outlives the one in the store
+	assert.NoError(t, reader.proxy.StoreAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path}, &authorization.Decision{Result: authorization.DeniedAuthz}, 10*time.Millisecond))
+	<-time.After(20 * time.Millisecond)
+	redisServer.FlushAll()
+
+	_, err = reader.proxy.GetAuthz(ctx, &authzKey{token: "token", method: http.MethodGet, path: location.Path})
+	assert.Equal(t, apperrors.ErrNoAuthzFound, err)
+}
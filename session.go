@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
 	"go.uber.org/zap"
@@ -28,24 +29,11 @@ import (
 
 // getIdentity retrieves the user identity from a request, either from a session cookie or a bearer token
 func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
-	var isBearer bool
-	// step: check for a bearer token or cookie with jwt token
-	access, isBearer, err := getTokenInRequest(
-		req,
-		r.config.CookieAccessName,
-		r.config.SkipAuthorizationHeaderIdentity,
-	)
-
+	access, isBearer, err := r.getAccessToken(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie && !isBearer {
-		if access, err = decodeText(access, r.config.EncryptionKey); err != nil {
-			return nil, apperrors.ErrDecryption
-		}
-	}
-
 	rawToken := access
 	token, err := jwt.ParseSigned(access)
 
@@ -71,6 +59,131 @@ func (r *oauthProxy) getIdentity(req *http.Request) (*userContext, error) {
 	return user, nil
 }
 
+// getAccessToken returns the access token of the request, decrypted, and whether it is a bearer token
+func (r *oauthProxy) getAccessToken(req *http.Request) (string, bool, error) {
+	var isBearer bool
+	var access string
+	var err error
+
+	// step: check for a bearer token or cookie with jwt token, or the server side session
+	if r.config.EnableServerSideSessions {
+		access, isBearer, err = r.getTokenInSession(req)
+	} else {
+		access, isBearer, err = getTokenInRequest(
+			req,
+			r.config.CookieAccessName,
+			r.config.SkipAuthorizationHeaderIdentity,
+		)
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	// @note: the tokens held in server side sessions are never encrypted
+	fromSession := r.config.EnableServerSideSessions && !isBearer
+
+	if !fromSession && (r.config.EnableEncryptedToken || r.config.ForceEncryptedCookie && !isBearer) {
+		if access, err = decodeText(access, r.config.EncryptionKey); err != nil {
+			return "", false, apperrors.ErrDecryption
+		}
+	}
+
+	return access, isBearer, nil
+}
+
+// getTokenInSession returns the bearer token if any, else the access token of the server side session
+func (r *oauthProxy) getTokenInSession(req *http.Request) (string, bool, error) {
+	if !r.config.SkipAuthorizationHeaderIdentity {
+		token, err := getTokenInBearer(req)
+		if err == nil {
+			return token, true, nil
+		}
+
+		if err != apperrors.ErrSessionNotFound {
+			return "", false, err
+		}
+	}
+
+	session, err := r.getSession(req)
+	if err != nil {
+		return "", false, err
+	}
+
+	return session.AccessToken, false, nil
+}
+
+// getSessionID returns the server side session id from the session cookie
+func (r *oauthProxy) getSessionID(req *http.Request) (string, error) {
+	cookie := findCookie(r.config.CookieSessionName, req.Cookies())
+	if cookie == nil || cookie.Value == "" {
+		return "", apperrors.ErrSessionNotFound
+	}
+
+	return cookie.Value, nil
+}
+
+// getSession retrieves the server side session referenced by the session cookie
+func (r *oauthProxy) getSession(req *http.Request) (*sessionState, error) {
+	id, err := r.getSessionID(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.GetSession(req.Context(), id)
+}
+
+// createSession stores a new server side session and drops the session id cookie,
+// any session the request already had is removed so session ids are never reused
+func (r *oauthProxy) createSession(req *http.Request, wrt http.ResponseWriter, session *sessionState, expiration time.Duration) error {
+	if id, err := r.getSessionID(req); err == nil {
+		_ = r.DeleteSession(req.Context(), id)
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+
+	if err := r.StoreSession(req.Context(), id, session, expiration); err != nil {
+		return err
+	}
+
+	r.dropCookie(wrt, req.Host, r.config.CookieSessionName, id, expiration)
+
+	return nil
+}
+
+// refreshSession updates the server side session with the refreshed tokens
+func (r *oauthProxy) refreshSession(req *http.Request, wrt http.ResponseWriter, accessToken, refreshToken string, expiresAt time.Time, expiration time.Duration) error {
+	id, err := r.getSessionID(req)
+	if err != nil {
+		return err
+	}
+
+	session, err := r.GetSession(req.Context(), id)
+	if err != nil {
+		return err
+	}
+
+	session.AccessToken = accessToken
+	session.ExpiresAt = expiresAt
+
+	if refreshToken != "" {
+		if session.RefreshToken, err = encodeText(refreshToken, r.config.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	if err := r.StoreSession(req.Context(), id, session, expiration); err != nil {
+		return err
+	}
+
+	r.dropCookie(wrt, req.Host, r.config.CookieSessionName, id, expiration)
+
+	return nil
+}
+
 // getRefreshTokenFromCookie returns the refresh token from the cookie if any
 func (r *oauthProxy) getRefreshTokenFromCookie(req *http.Request) (string, error) {
 	token, err := getTokenInCookie(req, r.config.CookieRefreshName)
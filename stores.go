@@ -16,9 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
-	"strconv"
+	"sort"
 	"time"
 
 	"github.com/gogatekeeper/gatekeeper/pkg/apperrors"
@@ -32,15 +35,70 @@ func (r *oauthProxy) useStore() bool {
 	return r.store != nil
 }
 
+// storeContext bounds an operation against the store by the store timeout, on top of any
+// deadline the caller, i.e. the request, already has
+func (r *oauthProxy) storeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.config.StoreTimeout > 0 {
+		return context.WithTimeout(ctx, r.config.StoreTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// storeKey namespaces the key with the store key prefix
+func (r *oauthProxy) storeKey(key string) string {
+	return r.config.StoreKeyPrefix + key
+}
+
+// setValue writes the value to the store, encrypting it when store encryption is enabled
+func (r *oauthProxy) setValue(ctx context.Context, key, value string, expiration time.Duration) error {
+	ctx, cancel := r.storeContext(ctx)
+	defer cancel()
+
+	if r.config.EnableStoreEncryption {
+		var err error
+		if value, err = encodeText(value, r.config.EncryptionKey); err != nil {
+			return err
+		}
+	}
+
+	return r.store.Set(ctx, r.storeKey(key), value, expiration)
+}
+
+// getValue reads the value from the store, an empty value means the key was not found
+func (r *oauthProxy) getValue(ctx context.Context, key string) (string, error) {
+	ctx, cancel := r.storeContext(ctx)
+	defer cancel()
+
+	value, err := r.store.Get(ctx, r.storeKey(key))
+	if err != nil || value == "" || !r.config.EnableStoreEncryption {
+		return value, err
+	}
+
+	if value, err = decodeText(value, r.config.EncryptionKey); err != nil {
+		return "", apperrors.ErrDecryption
+	}
+
+	return value, nil
+}
+
+// deleteValue removes the key from the store
+func (r *oauthProxy) deleteValue(ctx context.Context, key string) error {
+	ctx, cancel := r.storeContext(ctx)
+	defer cancel()
+
+	return r.store.Delete(ctx, r.storeKey(key))
+}
+
 // StoreRefreshToken the token to the store
-func (r *oauthProxy) StoreRefreshToken(token string, value string, expiration time.Duration) error {
-	return r.store.Set(getHashKey(token), value, expiration)
+func (r *oauthProxy) StoreRefreshToken(ctx context.Context, token string, value string, expiration time.Duration) error {
+	return r.setValue(ctx, getHashKey(token), value, expiration)
 }
 
 // Get retrieves a token from the store, the key we are using here is the access token
-func (r *oauthProxy) GetRefreshToken(token string) (string, error) {
+func (r *oauthProxy) GetRefreshToken(ctx context.Context, token string) (string, error) {
 	// step: the key is the access token
-	val, err := r.store.Get(getHashKey(token))
+	val, err := r.getValue(ctx, getHashKey(token))
 
 	if err != nil {
 		return val, err
@@ -53,8 +111,8 @@ func (r *oauthProxy) GetRefreshToken(token string) (string, error) {
 }
 
 // DeleteRefreshToken removes a key from the store
-func (r *oauthProxy) DeleteRefreshToken(token string) error {
-	if err := r.store.Delete(getHashKey(token)); err != nil {
+func (r *oauthProxy) DeleteRefreshToken(ctx context.Context, token string) error {
+	if err := r.deleteValue(ctx, getHashKey(token)); err != nil {
 		r.log.Error("unable to delete token", zap.Error(err))
 
 		return err
@@ -63,56 +121,208 @@ func (r *oauthProxy) DeleteRefreshToken(token string) error {
 	return nil
 }
 
-// StoreAuthz
-// nolint:interfacer
-func (r *oauthProxy) StoreAuthz(token string, url *url.URL, value authorization.AuthzDecision, expiration time.Duration) error {
-	if len(token) == 0 {
-		return fmt.Errorf("token of zero length")
+// StoreSession saves the server side session to the store, keyed by a hash of the session id
+func (r *oauthProxy) StoreSession(ctx context.Context, id string, session *sessionState, expiration time.Duration) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
 	}
 
-	tokenHash := getHashKey(token)
-	pathHash := getHashKey(url.Path)
-	hash := fmt.Sprintf("%s%s", pathHash, tokenHash)
-	return r.store.Set(hash, value.String(), expiration)
+	return r.setValue(ctx, getHashKey(id), string(value), expiration)
 }
 
-// Get retrieves a authz decision from store
-func (r *oauthProxy) GetAuthz(token string, url *url.URL) (authorization.AuthzDecision, error) {
-	if len(token) == 0 {
-		return authorization.DeniedAuthz, apperrors.ErrZeroLengthToken
+// GetSession retrieves the server side session from the store
+func (r *oauthProxy) GetSession(ctx context.Context, id string) (*sessionState, error) {
+	value, err := r.getValue(ctx, getHashKey(id))
+	if err != nil {
+		return nil, err
 	}
 
-	tokenHash := getHashKey(token)
-	pathHash := getHashKey(url.Path)
-	hash := fmt.Sprintf("%s%s", pathHash, tokenHash)
+	if value == "" {
+		return nil, apperrors.ErrSessionNotFound
+	}
 
-	exists, err := r.store.Exists(hash)
+	session := &sessionState{}
+	if err := json.Unmarshal([]byte(value), session); err != nil {
+		return nil, err
+	}
 
-	if err != nil {
-		return authorization.DeniedAuthz, err
+	return session, nil
+}
+
+// DeleteSession removes the server side session from the store, revoking it
+func (r *oauthProxy) DeleteSession(ctx context.Context, id string) error {
+	if err := r.deleteValue(ctx, getHashKey(id)); err != nil {
+		r.log.Error("unable to delete session", zap.Error(err))
+
+		return err
 	}
 
-	if !exists {
-		return authorization.DeniedAuthz, apperrors.ErrNoAuthzFound
+	return nil
+}
+
+// authzKey identifies a cached authz decision: the token, the request and the scopes it needs
+type authzKey struct {
+	// subject is the user the token was issued to, the decisions are invalidated per subject
+	subject string
+	token   string
+	method  string
+	host    string
+	path    string
+	// query and headers are only set when the provider decides on them
+	query   string
+	headers http.Header
+	// scopes are the scopes the request requires, in any order
+	scopes []string
+}
+
+// String returns the key the decision is kept under, prefixed by the subject so all the
+// decisions of a subject can be deleted at once
+func (k *authzKey) String() string {
+	scopes := append([]string{}, k.scopes...)
+	sort.Strings(scopes)
+
+	request := url.Values{
+		"method": {k.method},
+		"host":   {k.host},
+		"path":   {k.path},
+		"query":  {k.query},
+		"scope":  scopes,
 	}
 
-	val, err := r.store.Get(hash)
+	for name, values := range k.headers {
+		request["header:"+name] = values
+	}
+
+	return getAuthzSubjectKey(k.subject) + getHashKey(request.Encode()) + getHashKey(k.token)
+}
+
+// getAuthzSubjectKey returns the prefix of the keys of the authz decisions of the subject
+func getAuthzSubjectKey(subject string) string {
+	return "authz:" + getHashKey(subject) + ":"
+}
+
+// StoreAuthz saves the decision, along with what it is based on, to the store and the local
+// authz cache, the local entry never outlives the one in the store
+func (r *oauthProxy) StoreAuthz(ctx context.Context, key *authzKey, decision *authorization.Decision, expiration time.Duration) error {
+	if len(key.token) == 0 {
+		return fmt.Errorf("token of zero length")
+	}
 
+	value, err := json.Marshal(decision)
 	if err != nil {
-		return authorization.DeniedAuthz, err
+		return err
 	}
 
-	decision, err := strconv.Atoi(val)
+	hash := key.String()
 
-	if err != nil {
-		return authorization.DeniedAuthz, err
+	if err := r.setValue(ctx, hash, string(value), expiration); err != nil {
+		return err
 	}
 
-	return authorization.AuthzDecision(decision), nil
+	r.cacheAuthz(hash, string(value), expiration)
+
+	return nil
+}
+
+// GetAuthz retrieves a authz decision from the local authz cache, else the store, as it was
+// made, only its cache status tells it was cached
+func (r *oauthProxy) GetAuthz(ctx context.Context, key *authzKey) (*authorization.Decision, error) {
+	if len(key.token) == 0 {
+		return nil, apperrors.ErrZeroLengthToken
+	}
+
+	hash := key.String()
+
+	var val string
+	var err error
+
+	if r.authzCache != nil {
+		val, _ = r.authzCache.Get(ctx, hash)
+	}
+
+	cached := val != ""
+
+	if !cached {
+		if val, err = r.getValue(ctx, hash); err != nil {
+			return nil, err
+		}
+
+		if val == "" {
+			return nil, apperrors.ErrNoAuthzFound
+		}
+	}
+
+	decision := &authorization.Decision{}
+	if err := json.Unmarshal([]byte(val), decision); err != nil {
+		return nil, err
+	}
+
+	decision.CacheStatus = authorization.CacheHit
+
+	// @note: the remaining ttl in the store is unknown here, but it is at most the ttl of the
+	// decision and expired tokens are rejected before reaching the authorization
+	if !cached {
+		r.cacheAuthz(hash, val, r.getAuthzTTL(decision.Result))
+	}
+
+	return decision, nil
+}
+
+// DeleteAuthz removes all the authz decisions of the subject from the store and the local
+// authz cache, i.e. once the permissions of the subject have changed
+func (r *oauthProxy) DeleteAuthz(ctx context.Context, subject string) error {
+	prefix := getAuthzSubjectKey(subject)
+
+	if r.authzCache != nil {
+		_ = r.authzCache.DeletePrefix(ctx, prefix)
+	}
+
+	ctx, cancel := r.storeContext(ctx)
+	defer cancel()
+
+	return r.store.DeletePrefix(ctx, r.storeKey(prefix))
+}
+
+// getAuthzTTL returns how long the decision is cached, zero meaning until the token expires
+func (r *oauthProxy) getAuthzTTL(decision authorization.AuthzDecision) time.Duration {
+	if decision == authorization.AllowedAuthz {
+		return r.config.AuthzAllowTTL
+	}
+
+	return r.config.AuthzDenyTTL
+}
+
+// getAuthzExpiration returns how long the decision is cached for a token expiring at the time
+func (r *oauthProxy) getAuthzExpiration(decision authorization.AuthzDecision, expiresAt time.Time) time.Duration {
+	expiration := time.Until(expiresAt)
+
+	if ttl := r.getAuthzTTL(decision); ttl > 0 && ttl < expiration {
+		return ttl
+	}
+
+	return expiration
+}
+
+// cacheAuthz keeps the decision in the local authz cache, for no longer than the authz cache ttl
+func (r *oauthProxy) cacheAuthz(hash, value string, expiration time.Duration) {
+	if r.authzCache == nil {
+		return
+	}
+
+	if expiration <= 0 || expiration > r.config.AuthzCacheTTL {
+		expiration = r.config.AuthzCacheTTL
+	}
+
+	_ = r.authzCache.Set(context.Background(), hash, value, expiration)
 }
 
 // Close is used to close off any resources
 func (r *oauthProxy) CloseStore() error {
+	if r.authzCache != nil {
+		_ = r.authzCache.Close()
+	}
+
 	if r.store != nil {
 		return r.store.Close()
 	}
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -26,6 +27,25 @@ import (
 
 // extractIdentity parse the jwt token and extracts the various elements is order to construct
 func extractIdentity(token *jwt.JSONWebToken) (*userContext, error) {
+	return newUserContext(token.UnsafeClaimsWithoutVerification)
+}
+
+// extractIntrospectedIdentity constructs the identity from the introspection response of a token,
+// which holds the claims of the token
+func extractIntrospectedIdentity(response []byte) (*userContext, error) {
+	return newUserContext(func(claims ...interface{}) error {
+		for _, claim := range claims {
+			if err := json.Unmarshal(response, claim); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// newUserContext constructs the identity from the claims decoded by the decode function
+func newUserContext(decode func(claims ...interface{}) error) (*userContext, error) {
 	stdClaims := &jwt.Claims{}
 
 	type RealmRoles struct {
@@ -42,19 +62,20 @@ func extractIdentity(token *jwt.JSONWebToken) (*userContext, error) {
 		FamilyName     string                    `json:"family_name"`
 		GivenName      string                    `json:"given_name"`
 		Username       string                    `json:"username"`
+		Scope          string                    `json:"scope"`
 		Authorization  authorization.Permissions `json:"authorization"`
 	}
 
 	customClaims := custClaims{}
 
-	err := token.UnsafeClaimsWithoutVerification(stdClaims, &customClaims)
+	err := decode(stdClaims, &customClaims)
 
 	if err != nil {
 		return nil, err
 	}
 
 	jsonMap := make(map[string]interface{})
-	err = token.UnsafeClaimsWithoutVerification(&jsonMap)
+	err = decode(&jsonMap)
 
 	if err != nil {
 		return nil, err
@@ -92,6 +113,7 @@ func extractIdentity(token *jwt.JSONWebToken) (*userContext, error) {
 		name:          preferredName,
 		preferredName: preferredName,
 		roles:         roleList,
+		scopes:        strings.Fields(customClaims.Scope),
 		claims:        jsonMap,
 		permissions:   customClaims.Authorization,
 	}, nil
@@ -108,12 +130,23 @@ func containsString(needle string, haystack []string) bool {
 	return false
 }
 
-// Deprecated:unused
 // isAudience checks the audience
 func (r *userContext) isAudience(aud string) bool {
 	return containsString(aud, r.audiences)
 }
 
+// isIssuedFor checks the token was issued for the client, it being in the audience or the
+// client_id of the introspection response
+func (r *userContext) isIssuedFor(clientID string) bool {
+	if r.isAudience(clientID) {
+		return true
+	}
+
+	client, _ := r.claims["client_id"].(string)
+
+	return client == clientID
+}
+
 // Deprecated:unused
 // getRoles returns a list of roles
 func (r *userContext) getRoles() string {
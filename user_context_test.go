@@ -117,6 +117,36 @@ func TestGetUserRealmRoleContext(t *testing.T) {
 	assert.Equal(t, roles, context.roles)
 }
 
+func TestGetIntrospectedUserContext(t *testing.T) {
+	response := []byte(`{
+		"active": true,
+		"sub": "1e11e539-8256-4b3b-bda8-cc0d56cddb48",
+		"aud": "test",
+		"exp": 1450372669,
+		"scope": "openid orders:read",
+		"email": "gambol99@gmail.com",
+		"preferred_username": "rjayawardene",
+		"realm_access": {"roles": ["vpn-user"]},
+		"resource_access": {"client": {"roles": ["client"]}}
+	}`)
+
+	context, err := extractIntrospectedIdentity(response)
+	assert.NoError(t, err)
+	assert.Equal(t, "1e11e539-8256-4b3b-bda8-cc0d56cddb48", context.id)
+	assert.Equal(t, "gambol99@gmail.com", context.email)
+	assert.Equal(t, "rjayawardene", context.preferredName)
+	assert.Equal(t, []string{"test"}, context.audiences)
+	assert.Equal(t, []string{"openid", "orders:read"}, context.scopes)
+	assert.Equal(t, []string{"vpn-user", "client:client"}, context.roles)
+	assert.Equal(t, int64(1450372669), context.expiresAt.Unix())
+	assert.Equal(t, true, context.claims["active"])
+	assert.True(t, context.isIssuedFor("test"))
+	assert.False(t, context.isIssuedFor("other"))
+
+	_, err = extractIntrospectedIdentity([]byte("not json"))
+	assert.Error(t, err)
+}
+
 func TestUserContextString(t *testing.T) {
 	token := newTestToken("test")
 	jwtToken, err := token.getToken()
@@ -238,6 +238,34 @@ func decodeKeyPairs(list []string) (map[string]string, error) {
 	return keyPairs, nil
 }
 
+// splitUnquoted splits the value on the separator, except within single quotes
+func splitUnquoted(value string, separator rune) []string {
+	items := make([]string, 0)
+	quoted := false
+	start := 0
+
+	for idx, char := range value {
+		switch {
+		case char == '\'':
+			quoted = !quoted
+		case char == separator && !quoted:
+			items = append(items, value[start:idx])
+			start = idx + len(string(separator))
+		}
+	}
+
+	return append(items, value[start:])
+}
+
+// unquote removes the single quotes around the value, if any
+func unquote(value string) string {
+	if len(value) > 1 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		return value[1 : len(value)-1]
+	}
+
+	return value
+}
+
 // isValidHTTPMethod ensure this is a valid http method type
 func isValidHTTPMethod(method string) bool {
 	for _, x := range allHTTPMethods {
@@ -307,6 +335,32 @@ func containedIn(value string, list []string) bool {
 	return false
 }
 
+// matchHost returns the host pattern matching the host of a request, an exact name being
+// preferred to the wildcards and the longest wildcard to the shorter ones
+func matchHost(host string, patterns []string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	matched := ""
+
+	for _, pattern := range patterns {
+		name := strings.ToLower(pattern)
+
+		switch {
+		case name == host:
+			return pattern
+		case strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]):
+			if len(pattern) > len(matched) {
+				matched = pattern
+			}
+		}
+	}
+
+	return matched
+}
+
 // containsSubString checks if substring exists
 func containsSubString(value string, list []string) bool {
 	for _, x := range list {
@@ -481,6 +535,17 @@ func getWithin(expires time.Time, within float64) time.Duration {
 	return time.Duration(seconds) * time.Second
 }
 
+// newSessionID returns a random, url safe, session id
+func newSessionID() (string, error) {
+	id := make([]byte, 32)
+
+	if _, err := cryptorand.Read(id); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
 // getHashKey returns a hash of the encodes jwt token
 func getHashKey(token string) string {
 	hash := sha.Sum512([]byte(token))
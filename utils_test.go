@@ -35,6 +35,29 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+func TestSplitUnquoted(t *testing.T) {
+	testCases := []struct {
+		Value     string
+		Separator rune
+		Expected  []string
+	}{
+		{Value: "", Separator: ',', Expected: []string{""}},
+		{Value: "a,b", Separator: ',', Expected: []string{"a", "b"}},
+		{Value: "a,,b,", Separator: ',', Expected: []string{"a", "", "b", ""}},
+		{Value: "aud:'^(a|b),c$',tenant:x", Separator: ',', Expected: []string{"aud:'^(a|b),c$'", "tenant:x"}},
+		{Value: "a,'b,c", Separator: ',', Expected: []string{"a", "'b,c"}},
+		{
+			Value:     "uri=/|match-claims=aud:'a|b'|roles=c",
+			Separator: '|',
+			Expected:  []string{"uri=/", "match-claims=aud:'a|b'", "roles=c"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.Expected, splitUnquoted(testCase.Value, testCase.Separator), testCase.Value)
+	}
+}
+
 func TestDecodeKeyPairs(t *testing.T) {
 	testCases := []struct {
 		List     []string
@@ -426,6 +449,35 @@ func TestContainedIn(t *testing.T) {
 	assert.True(t, containedIn("1", []string{"1", "2", "3", "4"}))
 }
 
+func TestMatchHost(t *testing.T) {
+	patterns := []string{"*.example.com", "admin.example.com", "*.docs.example.com"}
+
+	testCases := []struct {
+		Host     string
+		Expected string
+	}{
+		{Host: "admin.example.com", Expected: "admin.example.com"},
+		{Host: "ADMIN.example.com:8443", Expected: "admin.example.com"},
+		{Host: "admin.example.com.", Expected: "admin.example.com"},
+		{Host: "api.example.com", Expected: "*.example.com"},
+		{Host: "v1.docs.example.com", Expected: "*.docs.example.com"},
+		{Host: "example.com"},
+		{Host: "example.org"},
+		{Host: "127.0.0.1:3000"},
+	}
+
+	for idx, testCase := range testCases {
+		assert.Equal(
+			t,
+			testCase.Expected,
+			matchHost(testCase.Host, patterns),
+			"case %d, host: %s",
+			idx,
+			testCase.Host,
+		)
+	}
+}
+
 func TestContainsSubString(t *testing.T) {
 	assert.False(t, containsSubString("bar.com", []string{"foo.bar.com"}))
 	assert.True(t, containsSubString("www.foo.bar.com", []string{"foo.bar.com"}))